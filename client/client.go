@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
 	"github.com/kkomitski/exchange/server"
 )
 
@@ -15,24 +20,83 @@ const Endpoint = "http://localhost:3004"
 type Client struct {
 	*http.Client
 	cancelledOrders int64
+
+	// Configs of the markets used so far, fetched from the exchange - they
+	// hold the scales to read and write prices and sizes with
+	mu sync.Mutex
+	markets map[server.Market]server.MarketConfig
 }
 
 func NewClient() *Client {
 	return &Client{
 		Client: http.DefaultClient,
+		markets: make(map[server.Market]server.MarketConfig),
+	}
+}
+
+// Config of the market, fetched on first use
+func (c *Client) market(market server.Market) (server.MarketConfig, error) {
+	c.mu.Lock()
+	cfg, ok := c.markets[market]
+	c.mu.Unlock()
+	if ok {
+		return cfg, nil
+	}
+
+	cfg, err := c.GetMarket(market)
+	if err != nil {
+		return server.MarketConfig{}, err
 	}
+
+	c.mu.Lock()
+	c.markets[market] = cfg
+	c.mu.Unlock()
+
+	return cfg, nil
 }
 
 type PlaceOrderParams struct {
 	UserID int64
+	Market server.Market
 	Bid bool
-	Price float64 // only needed for LIMIT orders
-	Size float64
+	Price decimal.Decimal // only needed for LIMIT and STOP_LIMIT orders
+	StopPrice decimal.Decimal // only needed for STOP and STOP_LIMIT orders
+	TrailAmount decimal.Decimal // trailing stops only, set this or TrailPercent
+	TrailPercent decimal.Decimal // trailing stops only, at orderbook.PercentScale
+	LimitOffset decimal.Decimal // trailing stops only, fires as a limit order this far past the trigger if set
+	Size decimal.Decimal
+	FillPolicy orderbook.FillPolicy // only used by MARKET orders
+	ClientOrderID string // optional, must be unique per user
+	TimeInForce orderbook.TimeInForce // GTC (default), IOC, FOK, GTD or DAY
+	ExpiresAt time.Time // only used by GTD orders
+	PostOnly orderbook.PostOnlyMode // only used by LIMIT orders, empty for a regular order
+	DisplaySize decimal.Decimal // only used by LIMIT orders, set to place an iceberg
+	SelfTradePrevention orderbook.SelfTradePrevention // optional, defaults to the user's setting
+	Peg *orderbook.Peg // only used by PEGGED orders
+}
+
+// The server answers failed requests with a non 2xx status and an APIError body
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	apiErr := &server.APIError{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Error == "" {
+		return fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+
+	return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, apiErr.Error)
 }
 
 // Shows the *LOWEST* price someone is willing to pay to *SELL* an asset for
-func (c *Client) GetBestAsk() (float64, error){
-	e := Endpoint + "/book/ETH/ask"
+func (c *Client) GetBestAsk(market server.Market) (decimal.Decimal, error){
+	cfg, err := c.market(market)
+	if err != nil {
+		return 0, err
+	}
+
+	e := Endpoint + "/book/" + string(market) + "/ask"
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -49,12 +113,17 @@ func (c *Client) GetBestAsk() (float64, error){
 		return 0, err
 	}
 
-	return priceResp.Price, nil
+	return cfg.ParsePrice(priceResp.Price)
 }
 
 // Shows the *HIGHEST* price someone is willing to pay to *BUY* an asset
-func (c *Client) GetBestBid() (float64, error){
-	e := Endpoint + "/book/ETH/bid"
+func (c *Client) GetBestBid(market server.Market) (decimal.Decimal, error){
+	cfg, err := c.market(market)
+	if err != nil {
+		return 0, err
+	}
+
+	e := Endpoint + "/book/" + string(market) + "/bid"
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -71,7 +140,7 @@ func (c *Client) GetBestBid() (float64, error){
 		return 0, err
 	}
 
-	return priceResp.Price, nil
+	return cfg.ParsePrice(priceResp.Price)
 }
 
 func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
@@ -105,53 +174,268 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 }
 
 func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	cfg, err := c.market(p.Market)
+	if err != nil {
+		return nil, err
+	}
+
 	params := &server.PlaceOrderRequest{
 		UserID: p.UserID,
 		Type: server.MarketOrder,
 		Bid: p.Bid,
-		Size: p.Size,
-		Market: server.MarketETH,
+		Size: cfg.FormatSize(p.Size),
+		Market: p.Market,
+		FillPolicy: p.FillPolicy,
+		ClientOrderID: p.ClientOrderID,
+		SelfTradePrevention: p.SelfTradePrevention,
+		TimeInForce: p.TimeInForce,
 	}
 
-	body, err := json.Marshal(params)
+	return c.placeOrder(params)
+}
+
+func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	cfg, err := c.market(p.Market)
 	if err != nil {
 		return nil, err
 	}
 
-	e := Endpoint + "/order"
+	params := &server.PlaceOrderRequest{
+		UserID: p.UserID,
+		Type: server.LimitOrder,
+		Bid: p.Bid,
+		Size: cfg.FormatSize(p.Size),
+		Price: cfg.FormatPrice(p.Price),
+		Market: p.Market,
+		ClientOrderID: p.ClientOrderID,
+		SelfTradePrevention: p.SelfTradePrevention,
+		TimeInForce: p.TimeInForce,
+		ExpiresAt: unixNano(p.ExpiresAt),
+		PostOnly: p.PostOnly,
+	}
 
-	req, err := http.NewRequest("POST", e, bytes.NewReader(body))
-	if err != nil {
-		return nil, err
+	if p.DisplaySize != 0 {
+		params.DisplaySize = cfg.FormatSize(p.DisplaySize)
 	}
 
-	resp, err := c.Do(req)
+	return c.placeOrder(params)
+}
+
+// Places a stop-limit order if Price is set, a stop-market order otherwise
+func (c *Client) PlaceStopOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	cfg, err := c.market(p.Market)
 	if err != nil {
 		return nil, err
 	}
 
-	placeOrderResponse := &server.PlaceOrderResponse{}
+	params := &server.PlaceOrderRequest{
+		UserID: p.UserID,
+		Type: server.StopMarketOrder,
+		Bid: p.Bid,
+		Size: cfg.FormatSize(p.Size),
+		StopPrice: cfg.FormatPrice(p.StopPrice),
+		Market: p.Market,
+		FillPolicy: p.FillPolicy,
+		ClientOrderID: p.ClientOrderID,
+		SelfTradePrevention: p.SelfTradePrevention,
+		TimeInForce: p.TimeInForce,
+		ExpiresAt: unixNano(p.ExpiresAt),
+	}
 
-	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
+	if p.Price != 0 {
+		params.Type = server.StopLimitOrder
+		params.Price = cfg.FormatPrice(p.Price)
+	}
+
+	return c.placeOrder(params)
+}
+
+// Places a limit order that follows p.Peg instead of a fixed price
+func (c *Client) PlacePeggedOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	cfg, err := c.market(p.Market)
+	if err != nil {
 		return nil, err
 	}
 
-	// fmt.Printf("\nreq: \n%+v\n\n", req)
-	// fmt.Printf("res: \n%+v\n\n", resp)
+	params := &server.PlaceOrderRequest{
+		UserID: p.UserID,
+		Type: server.PeggedOrder,
+		Bid: p.Bid,
+		Size: cfg.FormatSize(p.Size),
+		Market: p.Market,
+		ClientOrderID: p.ClientOrderID,
+		SelfTradePrevention: p.SelfTradePrevention,
+		TimeInForce: p.TimeInForce,
+		ExpiresAt: unixNano(p.ExpiresAt),
+		PegReference: p.Peg.Reference,
+		PegOffset: cfg.FormatPrice(p.Peg.Offset),
+	}
 
-	return placeOrderResponse, nil
+	if p.Peg.Cap != 0 {
+		params.PegCap = cfg.FormatPrice(p.Peg.Cap)
+	}
+
+	return c.placeOrder(params)
 }
 
-func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+// Places a trailing stop-limit order if LimitOffset is set, a trailing
+// stop-market order otherwise
+func (c *Client) PlaceTrailingStopOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	cfg, err := c.market(p.Market)
+	if err != nil {
+		return nil, err
+	}
+
 	params := &server.PlaceOrderRequest{
 		UserID: p.UserID,
-		Type: server.LimitOrder,
+		Type: server.TrailingStopOrder,
+		Bid: p.Bid,
+		Size: cfg.FormatSize(p.Size),
+		Market: p.Market,
+		FillPolicy: p.FillPolicy,
+		ClientOrderID: p.ClientOrderID,
+		SelfTradePrevention: p.SelfTradePrevention,
+		TimeInForce: p.TimeInForce,
+		ExpiresAt: unixNano(p.ExpiresAt),
+	}
+
+	if p.TrailPercent != 0 {
+		params.TrailPercent = orderbook.PercentScale.Format(p.TrailPercent)
+	} else {
+		params.TrailAmount = cfg.FormatPrice(p.TrailAmount)
+	}
+
+	if p.LimitOffset != 0 {
+		params.Type = server.TrailingStopLimitOrder
+		params.LimitOffset = cfg.FormatPrice(p.LimitOffset)
+	}
+
+	return c.placeOrder(params)
+}
+
+// Pending trailing stops of a user, StopPrice is their current trigger level
+func (c *Client) GetTrailingStops(userID int64) ([]*server.Order, error) {
+	orders, err := c.GetOrders(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stops := []*server.Order{}
+	for _, o := range orders.Stops {
+		if o.TrailAmount != "" || o.TrailPercent != "" {
+			stops = append(stops, o)
+		}
+	}
+
+	return stops, nil
+}
+
+type GroupLegParams struct {
+	Type server.OrderType // LIMIT, STOP or STOP_LIMIT - MARKET only for a bracket entry
+	Bid bool
+	Size decimal.Decimal
+	Price decimal.Decimal // LIMIT and STOP_LIMIT legs
+	StopPrice decimal.Decimal // STOP and STOP_LIMIT legs
+	ClientOrderID string
+}
+
+func newGroupLegRequest(cfg server.MarketConfig, p *GroupLegParams) *server.GroupLegRequest {
+	leg := &server.GroupLegRequest{
+		Type: p.Type,
 		Bid: p.Bid,
-		Size: p.Size,
-		Price: p.Price,
-		Market: server.MarketETH,
+		Size: cfg.FormatSize(p.Size),
+		ClientOrderID: p.ClientOrderID,
 	}
 
+	if p.Type == server.LimitOrder || p.Type == server.StopLimitOrder {
+		leg.Price = cfg.FormatPrice(p.Price)
+	}
+	if p.Type == server.StopMarketOrder || p.Type == server.StopLimitOrder {
+		leg.StopPrice = cfg.FormatPrice(p.StopPrice)
+	}
+
+	return leg
+}
+
+// Places the legs as one-cancels-other - the first to fill cancels the rest
+func (c *Client) PlaceOCO(userID int64, market server.Market, legs ...*GroupLegParams) (*server.OrderGroup, error) {
+	cfg, err := c.market(market)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &server.PlaceGroupRequest{
+		UserID: userID,
+		Market: market,
+		Type: orderbook.OneCancelsOther,
+	}
+
+	for _, leg := range legs {
+		params.Legs = append(params.Legs, newGroupLegRequest(cfg, leg))
+	}
+
+	return c.placeOrderGroup(params)
+}
+
+// Places the entry order, the take profit and stop loss go in as an OCO once
+// it fills
+func (c *Client) PlaceBracket(userID int64, market server.Market, entry, takeProfit, stopLoss *GroupLegParams) (*server.OrderGroup, error) {
+	cfg, err := c.market(market)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &server.PlaceGroupRequest{
+		UserID: userID,
+		Market: market,
+		Type: orderbook.Bracket,
+		Entry: newGroupLegRequest(cfg, entry),
+		Legs: []*server.GroupLegRequest{newGroupLegRequest(cfg, takeProfit), newGroupLegRequest(cfg, stopLoss)},
+	}
+
+	return c.placeOrderGroup(params)
+}
+
+func (c *Client) placeOrderGroup(params *server.PlaceGroupRequest) (*server.OrderGroup, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/orders/group"
+
+	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	group := &server.OrderGroup{}
+	if err := json.NewDecoder(resp.Body).Decode(group); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// Zero time means no expiry
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+func (c *Client) placeOrder(params *server.PlaceOrderRequest) (*server.PlaceOrderResponse, error) {
 	body, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
@@ -169,12 +453,19 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 		return nil, err
 	}
 
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
 	placeOrderResponse := &server.PlaceOrderResponse{}
 
 	if err := json.NewDecoder(resp.Body).Decode(placeOrderResponse); err != nil {
 		return nil, err
 	}
 
+	// fmt.Printf("\nreq: \n%+v\n\n", req)
+	// fmt.Printf("res: \n%+v\n\n", resp)
+
 	return placeOrderResponse, nil
 }
 
@@ -186,16 +477,65 @@ func (c *Client) CancelOrder(orderID int64) error {
 		return err
 	}
 
-	_, err = c.Do(req)
+	resp, err := c.Do(req)
 	if err != nil {
 		return err
 	}
 
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
 	c.cancelledOrders++
 	fmt.Printf("\n\n Total cancelled orders: %v \n\n", c.cancelledOrders)
 	return nil
 }
 
+// Changes the price and/or open size of a resting order in market, a zero
+// value keeps the current one
+func (c *Client) AmendOrder(market server.Market, orderID int64, price, size decimal.Decimal) (*server.PlaceOrderResponse, error) {
+	cfg, err := c.market(market)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &server.AmendOrderRequest{}
+	if price != 0 {
+		params.Price = cfg.FormatPrice(price)
+	}
+	if size != 0 {
+		params.Size = cfg.FormatSize(size)
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoint + "/order/" + strconv.FormatInt(orderID, 10)
+
+	req, err := http.NewRequest(http.MethodPatch, e, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	amendOrderResponse := &server.PlaceOrderResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(amendOrderResponse); err != nil {
+		return nil, err
+	}
+
+	return amendOrderResponse, nil
+}
+
 func (c *Client) GetTrades(market string) (*server.GetTradesResponse , error) {
 	e := Endpoint + "/trades/" + market
 
@@ -215,4 +555,271 @@ func (c *Client) GetTrades(market string) (*server.GetTradesResponse , error) {
 	}
 
 	return trades, nil
-}	
\ No newline at end of file
+}
+
+// Events the exchange emitted after the given sequence number, e.g. orders
+// that expired
+func (c *Client) GetEvents(after uint64) ([]server.Event, error) {
+	e := Endpoint + "/events?after=" + strconv.FormatUint(after, 10)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	events := []server.Event{}
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Trading rules of a market, use them to round prices and sizes before
+// placing orders
+func (c *Client) GetMarket(market server.Market) (server.MarketConfig, error) {
+	e := Endpoint + "/markets/" + string(market)
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return server.MarketConfig{}, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return server.MarketConfig{}, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return server.MarketConfig{}, err
+	}
+
+	spec := &server.MarketSpec{}
+	if err := json.NewDecoder(resp.Body).Decode(spec); err != nil {
+		return server.MarketConfig{}, err
+	}
+
+	return spec.Config()
+}
+
+func (c *Client) ListMarkets() ([]*server.MarketSpec, error) {
+	e := Endpoint + "/admin/markets"
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	specs := []*server.MarketSpec{}
+	if err := json.NewDecoder(resp.Body).Decode(&specs); err != nil {
+		return nil, err
+	}
+
+	return specs, nil
+}
+
+// Lists a new trading pair, PRE_OPEN unless spec.Status says otherwise
+func (c *Client) CreateMarket(spec *server.MarketSpec) (*server.MarketSpec, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.adminMarket(http.MethodPost, Endpoint+"/admin/markets", bytes.NewReader(body))
+}
+
+func (c *Client) HaltMarket(market server.Market) (*server.MarketSpec, error) {
+	return c.adminMarket(http.MethodPost, Endpoint+"/admin/markets/"+string(market)+"/halt", nil)
+}
+
+func (c *Client) OpenMarket(market server.Market) (*server.MarketSpec, error) {
+	return c.adminMarket(http.MethodPost, Endpoint+"/admin/markets/"+string(market)+"/open", nil)
+}
+
+func (c *Client) adminMarket(method, e string, body io.Reader) (*server.MarketSpec, error) {
+	req, err := http.NewRequest(method, e, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	spec := &server.MarketSpec{}
+	if err := json.NewDecoder(resp.Body).Decode(spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// Puts the market into a call auction, e.g. for the close
+func (c *Client) StartAuction(market server.Market) (*server.MarketSpec, error) {
+	return c.adminMarket(http.MethodPost, Endpoint+"/admin/markets/"+string(market)+"/auction", nil)
+}
+
+// Closes the market, uncrossing it first if it's in an auction
+func (c *Client) CloseMarket(market server.Market) (*server.MarketSpec, error) {
+	return c.adminMarket(http.MethodPost, Endpoint+"/admin/markets/"+string(market)+"/close", nil)
+}
+
+// Indicative price, volume and imbalance of a market in an auction
+func (c *Client) GetAuction(market server.Market) (*server.AuctionResponse, error) {
+	e := Endpoint + "/markets/" + string(market) + "/auction"
+
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	auction := &server.AuctionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(auction); err != nil {
+		return nil, err
+	}
+
+	return auction, nil
+}
+
+// Available and locked funds of the user in every asset
+func (c *Client) GetBalances(userID int64) ([]server.BalanceResponse, error) {
+	body, err := c.get(Endpoint + "/balances/" + strconv.FormatInt(userID, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	balances := []server.BalanceResponse{}
+	if err := json.NewDecoder(body).Decode(&balances); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+// Every ledger posting to the user's accounts, oldest first
+func (c *Client) GetLedger(userID int64) ([]server.LedgerEntry, error) {
+	body, err := c.get(Endpoint + "/ledger/" + strconv.FormatInt(userID, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	entries := []server.LedgerEntry{}
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Where each of the user's trades is at on chain, oldest trade first
+func (c *Client) GetSettlements(userID int64) ([]server.Settlement, error) {
+	body, err := c.get(Endpoint + "/settlements/" + strconv.FormatInt(userID, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	settlements := []server.Settlement{}
+	if err := json.NewDecoder(body).Decode(&settlements); err != nil {
+		return nil, err
+	}
+
+	return settlements, nil
+}
+
+// The fills of a netting next to the transfers that settled them
+func (c *Client) GetNetting(id int64) (*server.Netting, error) {
+	body, err := c.get(Endpoint + "/nettings/" + strconv.FormatInt(id, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	n := &server.Netting{}
+	if err := json.NewDecoder(body).Decode(n); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (c *Client) get(e string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Credits the user with amount of the asset, returning their balances after
+func (c *Client) Deposit(userID int64, asset server.Asset, amount string) ([]server.BalanceResponse, error) {
+	body, err := json.Marshal(&server.DepositRequest{UserID: userID, Asset: asset, Amount: amount})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, Endpoint+"/admin/deposits", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	balances := []server.BalanceResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&balances); err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
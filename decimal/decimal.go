@@ -0,0 +1,181 @@
+package decimal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal is a fixed-point number stored as a whole count of the smallest unit
+// of its scale, so 12.34 at Scale(2) is Decimal(1234).
+//
+// The scale is not carried by the value itself - every market decides the
+// scale of its prices and sizes, and all arithmetic inside a market is plain
+// integer arithmetic on the raw units. That keeps fills exact and lets
+// Decimals be used as map keys.
+type Decimal int64
+
+// Scale is the number of digits after the decimal point
+type Scale uint8
+
+// Anything above this doesn't fit in an int64
+const MaxScale Scale = 18
+
+var (
+	ErrInvalidDecimal = errors.New("invalid decimal")
+	ErrPrecision      = errors.New("too many decimal places")
+	ErrOverflow       = errors.New("decimal overflows int64")
+)
+
+// Size of one whole unit, e.g. 100 at Scale(2)
+func (s Scale) Unit() Decimal {
+	unit := Decimal(1)
+	for i := Scale(0); i < s; i++ {
+		unit *= 10
+	}
+
+	return unit
+}
+
+func (s Scale) FromInt(n int64) Decimal {
+	return Decimal(n) * s.Unit()
+}
+
+// Parses a plain decimal string like "-12.5" into raw units. Strings with more
+// fractional digits than the scale allows are rejected rather than rounded,
+// unless the extra digits are zeros.
+func (s Scale) Parse(str string) (Decimal, error) {
+	if s > MaxScale {
+		return 0, ErrOverflow
+	}
+
+	str = strings.TrimSpace(str)
+
+	neg := false
+	if strings.HasPrefix(str, "-") || strings.HasPrefix(str, "+") {
+		neg = str[0] == '-'
+		str = str[1:]
+	}
+
+	whole, frac, _ := strings.Cut(str, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDecimal, str)
+	}
+
+	for _, r := range whole + frac {
+		if r < '0' || r > '9' {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidDecimal, str)
+		}
+	}
+
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > int(s) {
+		return 0, fmt.Errorf("%w: %q allows at most %d", ErrPrecision, str, s)
+	}
+
+	digits := whole + frac + strings.Repeat("0", int(s)-len(frac))
+
+	var n uint64
+	for _, r := range digits {
+		if n > (math.MaxInt64-uint64(r-'0'))/10 {
+			return 0, ErrOverflow
+		}
+
+		n = n*10 + uint64(r-'0')
+	}
+
+	if neg {
+		return -Decimal(n), nil
+	}
+
+	return Decimal(n), nil
+}
+
+// Raw units, the value doesn't know its scale - use Scale.Format to show it
+// as a number
+func (d Decimal) String() string {
+	return strconv.FormatInt(int64(d), 10)
+}
+
+func (s Scale) Format(d Decimal) string {
+	sign := ""
+	n := uint64(d)
+	if d < 0 {
+		sign = "-"
+		n = uint64(-d)
+	}
+
+	digits := fmt.Sprintf("%0*d", int(s)+1, n)
+	if s == 0 {
+		return sign + digits
+	}
+
+	split := len(digits) - int(s)
+	return sign + digits[:split] + "." + digits[split:]
+}
+
+// Only meant for display and logging - never do arithmetic on the result
+func (s Scale) Float(d Decimal) float64 {
+	return float64(d) / float64(s.Unit())
+}
+
+// Converts d into the integer units of a finer scale, e.g. ETH at Scale(8)
+// into wei at Scale(18). Converting to a coarser scale fails if it would
+// drop digits.
+func (s Scale) Big(d Decimal, to Scale) (*big.Int, error) {
+	n := big.NewInt(int64(d))
+
+	if to >= s {
+		factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(to-s)), nil)
+		return n.Mul(n, factor), nil
+	}
+
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(s-to)), nil)
+	q, r := new(big.Int).QuoRem(n, factor, new(big.Int))
+	if r.Sign() != 0 {
+		return nil, fmt.Errorf("%w: %s at scale %d", ErrPrecision, s.Format(d), to)
+	}
+
+	return q, nil
+}
+
+// Same as Big but for scales that still fit an int64
+func (s Scale) Rescale(d Decimal, to Scale) (Decimal, error) {
+	n, err := s.Big(d, to)
+	if err != nil {
+		return 0, err
+	}
+
+	if !n.IsInt64() {
+		return 0, ErrOverflow
+	}
+
+	return Decimal(n.Int64()), nil
+}
+
+func Min(a, b Decimal) Decimal {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func Max(a, b Decimal) Decimal {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func Abs(d Decimal) Decimal {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
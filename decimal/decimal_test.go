@@ -0,0 +1,77 @@
+package decimal
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	if !reflect.DeepEqual(a,b){
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestParse(t *testing.T) {
+	s := Scale(2)
+
+	d, err := s.Parse("12.34")
+	assert(t, err, nil)
+	assert(t, d, Decimal(1234))
+
+	d, err = s.Parse("-0.5")
+	assert(t, err, nil)
+	assert(t, d, Decimal(-50))
+
+	d, err = s.Parse("7")
+	assert(t, err, nil)
+	assert(t, d, Decimal(700))
+
+	// Trailing zeros past the scale are fine, real digits are not
+	d, err = s.Parse("1.2300")
+	assert(t, err, nil)
+	assert(t, d, Decimal(123))
+
+	_, err = s.Parse("1.234")
+	assert(t, errors.Is(err, ErrPrecision), true)
+
+	_, err = s.Parse("1.2.3")
+	assert(t, errors.Is(err, ErrInvalidDecimal), true)
+
+	_, err = s.Parse("NaN")
+	assert(t, errors.Is(err, ErrInvalidDecimal), true)
+
+	_, err = s.Parse("")
+	assert(t, errors.Is(err, ErrInvalidDecimal), true)
+
+	_, err = Scale(18).Parse("100")
+	assert(t, errors.Is(err, ErrOverflow), true)
+}
+
+func TestFormat(t *testing.T) {
+	assert(t, Scale(2).Format(1234), "12.34")
+	assert(t, Scale(2).Format(5), "0.05")
+	assert(t, Scale(2).Format(-50), "-0.50")
+	assert(t, Scale(0).Format(42), "42")
+	assert(t, Scale(8).Format(Scale(8).FromInt(3)), "3.00000000")
+}
+
+func TestString(t *testing.T) {
+	assert(t, Decimal(1234).String(), "1234")
+	assert(t, Decimal(-5).String(), "-5")
+}
+
+func TestBig(t *testing.T) {
+	// 1.5 ETH at 8 decimals into wei
+	wei, err := Scale(8).Big(150_000_000, 18)
+	assert(t, err, nil)
+	assert(t, wei, big.NewInt(1_500_000_000_000_000_000))
+
+	_, err = Scale(2).Big(1234, 1)
+	assert(t, errors.Is(err, ErrPrecision), true)
+
+	d, err := Scale(2).Rescale(1230, 1)
+	assert(t, err, nil)
+	assert(t, d, Decimal(123))
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
-	"math"
 	"time"
 
 	"github.com/kkomitski/exchange/client"
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
 	"github.com/kkomitski/exchange/server"
 	"github.com/kkomitski/exchange/utils"
 	"github.com/labstack/gommon/log"
@@ -18,8 +19,10 @@ const (
 
 var (
 	tick = 1 * time.Second
-	myAsks = make(map[float64]int64)
-	myBids = make(map[float64]int64)
+
+	market = server.MarketETH
+	// Scales of the market, fetched from the exchange once it's up
+	eth server.MarketConfig
 )
 // BID - desire to BUY
 // ASK - desire to SELL
@@ -27,18 +30,20 @@ var (
 func seedMarket(c *client.Client) error {
 	// ASK - desire to SELL
 	ask := &client.PlaceOrderParams{
+		Market: market,
 		UserID: 22,
 		Bid:    false,
-		Price:  11000,
-		Size:   1000,
+		Price:  eth.PriceScale.FromInt(11000),
+		Size:   eth.SizeScale.FromInt(1000),
 	}
 
 	// BID - desire to BUY
 	bid := &client.PlaceOrderParams{
+		Market: market,
 		UserID: 22,
 		Bid:    true,
-		Price:  10000,
-		Size:   1000,
+		Price:  eth.PriceScale.FromInt(10000),
+		Size:   eth.SizeScale.FromInt(1000),
 	}
 
 	MakeOrder(c, "LIMIT", ask.UserID, ask.Bid, ask.Price, ask.Size)
@@ -58,53 +63,64 @@ func makeMarketSimple(c *client.Client) {
 			panic(err)
 		}
 
-		bestAsk, err := c.GetBestAsk()
+		bestAsk, err := c.GetBestAsk(market)
 		if err != nil {
 			// panic(err)
 			fmt.Println(err)
 		}
 		
-		bestBid, err := c.GetBestBid()
+		bestBid, err := c.GetBestBid(market)
 		if err != nil {
 			// panic(err)
 			fmt.Println(err)
 		}
 
 		// Get the spread
-		spread := math.Abs(bestBid - bestAsk)
-		fmt.Println("Spread: ", spread)
-
-		// Create new bid (buy) limits
-		if len(orders.Bids) < 3 {
-			bidLimit := &client.PlaceOrderParams{
+		spread := bestAsk - bestBid
+		if spread < 0 {
+			spread = -spread
+		}
+		fmt.Println("Spread: ", eth.FormatPrice(spread))
+
+		// Quotes are pegged a dollar inside the touch - the exchange keeps
+		// repricing them, so all that is left to do here is top them up as
+		// they fill
+		if len(orders.Bids) < maxOrders {
+			bidQuote := &client.PlaceOrderParams{
+				Market: market,
 				UserID: 22,
 				Bid: true,
-				Price: bestBid + 100,
-				Size: 1000,
+				Size: eth.SizeScale.FromInt(1000),
+				Peg: &orderbook.Peg{
+					Reference: orderbook.PegBestBid,
+					Offset: eth.PriceScale.FromInt(1),
+				},
 			}
 
-			bidOrderResp, _ := MakeOrder(c, "LIMIT", bidLimit.UserID, bidLimit.Bid, bidLimit.Price, bidLimit.Size)
-			myBids[bidLimit.Price] = bidOrderResp.OrderID
-
-			// fmt.Println("Bid order placed: ", bidLimit.Price)
+			if _, err := c.PlacePeggedOrder(bidQuote); err != nil {
+				log.Errorf("Failed to place bid quote: %v", err)
+			}
 		}
 
-		// Create new ask (sell) limits
-		if len(orders.Asks) < 3 {
-			askLimit := &client.PlaceOrderParams{
+		if len(orders.Asks) < maxOrders {
+			askQuote := &client.PlaceOrderParams{
+				Market: market,
 				UserID: 22,
 				Bid: false,
-				Price: bestAsk - 100,
-				Size: 1000,
+				Size: eth.SizeScale.FromInt(1000),
+				Peg: &orderbook.Peg{
+					Reference: orderbook.PegBestAsk,
+					Offset: -eth.PriceScale.FromInt(1),
+				},
 			}
-			askOrderResp, _ := MakeOrder(c, "LIMIT", askLimit.UserID, askLimit.Bid, askLimit.Price, askLimit.Size)
-			myAsks[askLimit.Price] = askOrderResp.OrderID
 
-			// fmt.Println("Ask order placed: ", askLimit.Price)
+			if _, err := c.PlacePeggedOrder(askQuote); err != nil {
+				log.Errorf("Failed to place ask quote: %v", err)
+			}
 		}
 
-		fmt.Println("Best ask price:", bestAsk)
-		fmt.Println("Best bid price:", bestBid)
+		fmt.Println("Best ask price:", eth.FormatPrice(bestAsk))
+		fmt.Println("Best bid price:", eth.FormatPrice(bestBid))
 
 		<- ticker.C
 	}
@@ -115,17 +131,19 @@ func marketOrderPlacer(c *client.Client) {
 
 	for {
 		buy := &client.PlaceOrderParams{
+			Market: market,
 			UserID: 33,
 			Bid:    true,
-			Size:   1000,
+			Size:   eth.SizeScale.FromInt(1000),
 		}
 
 		MakeOrder(c, "MARKET", buy.UserID, buy.Bid, buy.Price, buy.Size)
 
 		sell := &client.PlaceOrderParams{
+			Market: market,
 			UserID: 33,
 			Bid:    false,
-			Size:   1000,
+			Size:   eth.SizeScale.FromInt(1000),
 		}
 
 		MakeOrder(c, "MARKET", sell.UserID, sell.Bid, sell.Price, sell.Size)
@@ -139,13 +157,13 @@ func marketOrderPlacer(c *client.Client) {
 		fmt.Printf("Response 22 %+v\n\n", resp)
 
 		for i := 0; i < len(resp.Asks); i++ {
-			if resp.Asks[i].Size == 0.0 || resp.Asks[i].Size == 0 {
+			if size, _ := eth.ParseSize(resp.Asks[i].Size); size == 0 {
 				panic("ZERO SIZE")
 			}
 		}
 
 		for i := 0; i < len(resp.Bids); i++ {
-			if resp.Bids[i].Size == 0.0 || resp.Bids[i].Size == 0 {
+			if size, _ := eth.ParseSize(resp.Bids[i].Size); size == 0 {
 				panic("ZERO SIZE")
 			}
 		}
@@ -157,13 +175,13 @@ func marketOrderPlacer(c *client.Client) {
 		}
 
 		for i := 0; i < len(resp.Asks); i++ {
-			if resp.Asks[i].Size == 0.0 || resp.Asks[i].Size == 0 {
+			if size, _ := eth.ParseSize(resp.Asks[i].Size); size == 0 {
 				panic("ZERO SIZE")
 			}
 		}
 
 		for i := 0; i < len(resp.Bids); i++ {
-			if resp.Bids[i].Size == 0.0 || resp.Bids[i].Size == 0 {
+			if size, _ := eth.ParseSize(resp.Bids[i].Size); size == 0 {
 				panic("ZERO SIZE")
 			}
 		}
@@ -181,6 +199,11 @@ func main() {
 
 	c := client.NewClient()
 
+	var err error
+	if eth, err = c.GetMarket(market); err != nil {
+		panic(err)
+	}
+
 	// MakeOrder(c, "LIMIT", 22, false, 	1 , 5)
 	// MakeOrder(c, "LIMIT", 22, false, 	2 , 5)
 	// MakeOrder(c, "LIMIT", 22, false, 	3 , 5)
@@ -243,13 +266,14 @@ func main() {
 func TEST_PutLimitOrdersInBooks(c *client.Client, bidOrders int, askOrders int ) {
 	for i := 0; i < bidOrders; i++ {
 		limitOrderParamsA := &client.PlaceOrderParams{
+			Market: market,
 			UserID: 11,
 			Bid:    true,
-			Price:  1_000 * (float64(i) + 1),
-			Size:   1,
+			Price:  eth.PriceScale.FromInt(1_000 * (int64(i) + 1)),
+			Size:   eth.SizeScale.FromInt(1),
 		}
 
-		limitOrderOut := fmt.Sprintf("CLIENT: Placing LIMIT order: \n UID: %v | Bid: %v | Price: %.2f | Size: %.2f \n", limitOrderParamsA.UserID, limitOrderParamsA.Bid, limitOrderParamsA.Price, limitOrderParamsA.Size)
+		limitOrderOut := fmt.Sprintf("CLIENT: Placing LIMIT order: \n UID: %v | Bid: %v | Price: %v | Size: %v \n", limitOrderParamsA.UserID, limitOrderParamsA.Bid, eth.FormatPrice(limitOrderParamsA.Price), eth.FormatSize(limitOrderParamsA.Size))
 		fmt.Println(utils.PrintColor("yellow", limitOrderOut))
 		
 		_, err := c.PlaceLimitOrder(limitOrderParamsA)
@@ -262,13 +286,14 @@ func TEST_PutLimitOrdersInBooks(c *client.Client, bidOrders int, askOrders int )
 
 	for i := 0; i < askOrders; i++ {
 		limitOrderParamsA := &client.PlaceOrderParams{
+			Market: market,
 			UserID: 22,
 			Bid:    false,
-			Price:  1_000 * (float64(i) + 1),
-			Size:   1,
+			Price:  eth.PriceScale.FromInt(1_000 * (int64(i) + 1)),
+			Size:   eth.SizeScale.FromInt(1),
 		}
 
-		limitOrderOut := fmt.Sprintf("CLIENT: Placing LIMIT order: \n UID: %v | Bid: %v | Price: %.2f | Size: %.2f \n", limitOrderParamsA.UserID, limitOrderParamsA.Bid, limitOrderParamsA.Price, limitOrderParamsA.Size)
+		limitOrderOut := fmt.Sprintf("CLIENT: Placing LIMIT order: \n UID: %v | Bid: %v | Price: %v | Size: %v \n", limitOrderParamsA.UserID, limitOrderParamsA.Bid, eth.FormatPrice(limitOrderParamsA.Price), eth.FormatSize(limitOrderParamsA.Size))
 		fmt.Println(utils.PrintColor("yellow", limitOrderOut))
 		
 		_, err := c.PlaceLimitOrder(limitOrderParamsA)
@@ -283,12 +308,13 @@ func TEST_PutLimitOrdersInBooks(c *client.Client, bidOrders int, askOrders int )
 func TEST_PutMarketOrdersInBooks(c *client.Client, bidOrders int, askOrders int){
 	for i := 0; i < bidOrders; i++ {
 		marketOrderParams := &client.PlaceOrderParams{
+			Market: market,
 			UserID: 33,
 			Bid:    true,
-			Size:   1,
+			Size:   eth.SizeScale.FromInt(1),
 		}
 	
-		marketOrderOut := fmt.Sprintf("CLIENT: Placing MARKET order: \n UID: %v | Bid: %v | Size: %.2f \n", marketOrderParams.UserID, marketOrderParams.Bid, marketOrderParams.Size)
+		marketOrderOut := fmt.Sprintf("CLIENT: Placing MARKET order: \n UID: %v | Bid: %v | Size: %v \n", marketOrderParams.UserID, marketOrderParams.Bid, eth.FormatSize(marketOrderParams.Size))
 		fmt.Println(utils.PrintColor("yellow", marketOrderOut))
 	
 		_, err := c.PlaceMarketOrder(marketOrderParams)
@@ -301,12 +327,13 @@ func TEST_PutMarketOrdersInBooks(c *client.Client, bidOrders int, askOrders int)
 
 	for i := 0; i < askOrders; i++ {
 		marketOrderParamsB := &client.PlaceOrderParams{
+			Market: market,
 			UserID: 33,
 			Bid:    false,
-			Size:   1,
+			Size:   eth.SizeScale.FromInt(1),
 		}
 
-		marketOrderOutB := fmt.Sprintf("CLIENT: Placing MARKET order: \n UID: %v | Bid: %v | Size: %.2f \n", marketOrderParamsB.UserID, marketOrderParamsB.Bid, marketOrderParamsB.Size)
+		marketOrderOutB := fmt.Sprintf("CLIENT: Placing MARKET order: \n UID: %v | Bid: %v | Size: %v \n", marketOrderParamsB.UserID, marketOrderParamsB.Bid, eth.FormatSize(marketOrderParamsB.Size))
 		fmt.Println(utils.PrintColor("yellow", marketOrderOutB))
 
 		_, err := c.PlaceMarketOrder(marketOrderParamsB)
@@ -330,8 +357,9 @@ func TEST_CancelOrders(c *client.Client, orderIDs []int64) {
 	}
 }
 
-func MakeOrder(c *client.Client, OrderType string, UserID int64, Bid bool, Price float64, Size float64) (*server.PlaceOrderResponse, error) {
+func MakeOrder(c *client.Client, OrderType string, UserID int64, Bid bool, Price decimal.Decimal, Size decimal.Decimal) (*server.PlaceOrderResponse, error) {
 	op := &client.PlaceOrderParams{
+		Market: market,
 		UserID: UserID,
 		Bid: Bid,
 		Price: Price,
@@ -347,7 +375,7 @@ func MakeOrder(c *client.Client, OrderType string, UserID int64, Bid bool, Price
 				return nil, err
 			}
 
-			marketOrderOut := fmt.Sprintf("CLIENT: Placing %v order: \n UID: %v | Bid: %v | Size: %.2f | Price %.2f\n", OrderType, UserID, Bid, Size, Price)
+			marketOrderOut := fmt.Sprintf("CLIENT: Placing %v order: \n UID: %v | Bid: %v | Size: %v | Price %v\n", OrderType, UserID, Bid, eth.FormatSize(Size), eth.FormatPrice(Price))
 			fmt.Println(utils.PrintColor("yellow", marketOrderOut))
 
 			return resp, nil
@@ -359,7 +387,7 @@ func MakeOrder(c *client.Client, OrderType string, UserID int64, Bid bool, Price
 				return nil, err
 			}
 
-			marketOrderOut := fmt.Sprintf("CLIENT: Placing %v order: \n UID: %v | Bid: %v | Size: %.2f | Price %.2f\n", OrderType, UserID, Bid, Size, Price)
+			marketOrderOut := fmt.Sprintf("CLIENT: Placing %v order: \n UID: %v | Bid: %v | Size: %v | Price %v\n", OrderType, UserID, Bid, eth.FormatSize(Size), eth.FormatPrice(Price))
 			fmt.Println(utils.PrintColor("yellow", marketOrderOut))
 
 			return resp, nil
@@ -380,7 +408,7 @@ func MakeOrder(c *client.Client, OrderType string, UserID int64, Bid bool, Price
 // 	Size:   1,
 // }
 
-// limitOrderOut := fmt.Sprintf("CLIENT: Placing LIMIT order: \n UID: %v | Bid: %v | Price: %.2f | Size: %.2f \n", limitOrderParamsA.UserID, limitOrderParamsA.Bid, limitOrderParamsA.Price, limitOrderParamsA.Size)
+// limitOrderOut := fmt.Sprintf("CLIENT: Placing LIMIT order: \n UID: %v | Bid: %v | Price: %v | Size: %v \n", limitOrderParamsA.UserID, limitOrderParamsA.Bid, eth.FormatPrice(limitOrderParamsA.Price), eth.FormatSize(limitOrderParamsA.Size))
 // fmt.Println(utils.PrintColor("yellow", limitOrderOut))
 
 // _, err := c.PlaceLimitOrder(limitOrderParamsA)
@@ -400,7 +428,7 @@ func MakeOrder(c *client.Client, OrderType string, UserID int64, Bid bool, Price
 // 	Size:   2,
 // }
 
-// marketOrderOut := fmt.Sprintf("CLIENT: Placing MARKET order: \n UID: %v | Bid: %v | Size: %.2f \n", marketOrderParams.UserID, marketOrderParams.Bid, marketOrderParams.Size)
+// marketOrderOut := fmt.Sprintf("CLIENT: Placing MARKET order: \n UID: %v | Bid: %v | Size: %v \n", marketOrderParams.UserID, marketOrderParams.Bid, eth.FormatSize(marketOrderParams.Size))
 // fmt.Println(utils.PrintColor("yellow", marketOrderOut))
 
 // _, err := c.PlaceMarketOrder(marketOrderParams)
@@ -0,0 +1,248 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/utils"
+)
+
+var ErrInAuction = errors.New("market orders can't be placed during an auction")
+
+// Where the book would uncross if the auction ended now
+type AuctionState struct {
+	Price  decimal.Decimal `json:"price"` // Zero if the book doesn't cross
+	Volume decimal.Decimal `json:"volume"`
+	// Volume left over at Price, positive if it's on the bid side and negative
+	// if it's on the ask side
+	Imbalance decimal.Decimal `json:"imbalance"`
+}
+
+// Puts the book into a call auction. Until Uncross, limit orders collect in
+// the book without matching, even when they cross.
+func (ob *Orderbook) StartAuction() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.auction = true
+}
+
+func (ob *Orderbook) InAuction() bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.auction
+}
+
+// During an auction orders only rest. Those that can't rest, or that must not
+// take liquidity at the uncross, are turned away.
+func (ob *Orderbook) collectOrder(price decimal.Decimal, o *Order) {
+	switch {
+	case o.PostOnly != "":
+		o.PostOnlyResult = PostOnlyRejected
+		o.Status = StatusRejected
+	case o.TimeInForce == ImmediateOrCancel:
+		o.Status = StatusCancelled
+	case o.TimeInForce == FillOrKill:
+		o.Status = StatusKilled
+	default:
+		ob.restOrder(price, o)
+	}
+}
+
+// The indicative uncross price, volume and imbalance
+func (ob *Orderbook) Indicative() AuctionState {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.indicative()
+}
+
+// Picks the uncross price the usual way:
+//  1. the price that executes the most volume
+//  2. then the one that leaves the smallest imbalance
+//  3. then market pressure - the highest price if every candidate has more
+//     bids than asks left over, the lowest if every one has more asks
+//  4. then the price closest to the last trade
+func (ob *Orderbook) indicative() AuctionState {
+	bestBid, bestAsk := ob.bids.Best(), ob.asks.Best()
+	if bestBid == nil || bestAsk == nil || bestBid.Price < bestAsk.Price {
+		return AuctionState{}
+	}
+
+	// Only prices between the best ask and the best bid execute anything
+	var prices []decimal.Decimal
+	seen := make(map[decimal.Decimal]bool)
+
+	ob.asks.Each(func(l *Limit) bool {
+		if l.Price > bestBid.Price {
+			return false
+		}
+
+		seen[l.Price] = true
+		prices = append(prices, l.Price)
+		return true
+	})
+
+	ob.bids.Each(func(l *Limit) bool {
+		if l.Price < bestAsk.Price {
+			return false
+		}
+
+		if !seen[l.Price] {
+			prices = append(prices, l.Price)
+		}
+		return true
+	})
+
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+
+	var best []AuctionState
+	for _, price := range prices {
+		s := ob.auctionAt(price)
+
+		if len(best) > 0 {
+			if s.Volume < best[0].Volume {
+				continue
+			}
+
+			if s.Volume == best[0].Volume {
+				if decimal.Abs(s.Imbalance) > decimal.Abs(best[0].Imbalance) {
+					continue
+				}
+
+				if decimal.Abs(s.Imbalance) == decimal.Abs(best[0].Imbalance) {
+					best = append(best, s)
+					continue
+				}
+			}
+		}
+
+		best = []AuctionState{s}
+	}
+
+	if len(best) == 1 {
+		return best[0]
+	}
+
+	bidSurplus, askSurplus := true, true
+	for _, s := range best {
+		bidSurplus = bidSurplus && s.Imbalance > 0
+		askSurplus = askSurplus && s.Imbalance < 0
+	}
+
+	lo, hi := best[0].Price, best[len(best)-1].Price
+
+	switch {
+	case bidSurplus:
+		return best[len(best)-1]
+	case askSurplus:
+		return best[0]
+	}
+
+	reference, ok := ob.LastPrice()
+	if !ok {
+		// Nothing has traded yet, meet in the middle
+		reference = lo + (hi-lo)/2/ob.TickSize*ob.TickSize
+	}
+
+	return ob.auctionAt(decimal.Min(decimal.Max(reference, lo), hi))
+}
+
+// What would execute at price - every bid at or above it against every ask at
+// or below it
+func (ob *Orderbook) auctionAt(price decimal.Decimal) AuctionState {
+	var buy, sell decimal.Decimal
+
+	ob.bids.Each(func(l *Limit) bool {
+		if l.Price < price {
+			return false
+		}
+
+		buy += l.TotalVolume
+		return true
+	})
+
+	ob.asks.Each(func(l *Limit) bool {
+		if l.Price > price {
+			return false
+		}
+
+		sell += l.TotalVolume
+		return true
+	})
+
+	return AuctionState{
+		Price:     price,
+		Volume:    decimal.Min(buy, sell),
+		Imbalance: buy - sell,
+	}
+}
+
+// Ends the auction. Everything that crosses trades at the single indicative
+// price, in price then time priority, and the book goes back to continuous
+// matching. Icebergs take part with their full size. Self-trade prevention
+// doesn't apply to the uncross.
+func (ob *Orderbook) Uncross() (AuctionState, []Match) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	state := ob.indicative()
+	ob.auction = false
+
+	matches := []Match{}
+
+	for state.Volume > 0 {
+		bidLimit, askLimit := ob.bids.Best(), ob.asks.Best()
+		if bidLimit == nil || askLimit == nil || bidLimit.Price < state.Price || askLimit.Price > state.Price {
+			break
+		}
+
+		bid, ask := bidLimit.Front(), askLimit.Front()
+		size := decimal.Min(bid.Size, ask.Size)
+
+		ob.auctionFill(bid, size)
+		ob.auctionFill(ask, size)
+
+		matches = append(matches, Match{
+			Bid:        bid,
+			Ask:        ask,
+			SizeFilled: size,
+			Price:      state.Price,
+		})
+	}
+
+	if len(matches) > 0 {
+		str := fmt.Sprintf("OB: Auction uncrossed | Price: %d | Volume: %d | Imbalance: %d", state.Price, state.Volume, state.Imbalance)
+		fmt.Println(utils.PrintColor("green", str))
+	}
+
+	// Nobody took liquidity, so the trades are marked with the side that had
+	// the surplus
+	ob.recordTrades(matches, state.Imbalance > 0)
+
+	return state, ob.afterMatch(matches)
+}
+
+// Fills a resting order in place so a partial fill keeps its spot in the
+// queue
+func (ob *Orderbook) auctionFill(o *Order, size decimal.Decimal) {
+	l := o.Limit
+	shown := o.Visible()
+
+	o.Size -= size
+	o.fill(size)
+
+	if o.IsIceberg() {
+		o.shown = decimal.Min(o.Display, o.Size)
+	}
+
+	l.TotalVolume -= size
+	l.DisplayVolume += o.Visible() - shown
+
+	if o.IsFilled() {
+		ob.removeOrder(o)
+	}
+}
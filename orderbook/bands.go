@@ -0,0 +1,167 @@
+package orderbook
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/kkomitski/exchange/decimal"
+)
+
+// Price a band is centred on
+type BandReference string
+
+const (
+	BandLastTrade BandReference = "LAST_TRADE"
+	// Volume weighted average price of the trades in the band window
+	BandVWAP BandReference = "VWAP"
+)
+
+// Keeps trading within a percentage either side of a reference price. Market
+// orders stop matching at the edge of the band, and no order rests outside it -
+// limit and pegged orders priced outside it are rejected, and pegged orders
+// don't follow the touch out of it. There is no band until the first trade,
+// and none during an auction so the uncross can find a new price.
+type PriceBand struct {
+	Percent   decimal.Decimal `json:"percent"`
+	Reference BandReference   `json:"reference"`
+	// VWAP only, counted back from the last trade
+	Window time.Duration `json:"window,omitempty"`
+}
+
+var ErrOutsideBand = errors.New("price is outside the price band")
+
+// Lowest and highest price the band allows right now, false if there is no
+// band
+func (ob *Orderbook) BandLimits() (decimal.Decimal, decimal.Decimal, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bandLimits()
+}
+
+func (ob *Orderbook) bandLimits() (decimal.Decimal, decimal.Decimal, bool) {
+	if ob.Band == nil || ob.Band.Percent == 0 || ob.auction {
+		return 0, 0, false
+	}
+
+	var reference decimal.Decimal
+	switch ob.Band.Reference {
+	case BandVWAP:
+		reference = ob.vwap(ob.Band.Window)
+	default:
+		reference, _ = ob.LastPrice()
+	}
+
+	if reference == 0 {
+		return 0, 0, false
+	}
+
+	width := reference * ob.Band.Percent / (100 * PercentScale.Unit())
+
+	return reference - width, reference + width, true
+}
+
+// Whether an order can go in the book at price, true if there is no band
+func (ob *Orderbook) InBand(price decimal.Decimal) bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.inBand(price)
+}
+
+func (ob *Orderbook) inBand(price decimal.Decimal) bool {
+	lo, hi, ok := ob.bandLimits()
+
+	return !ok || (price >= lo && price <= hi)
+}
+
+// Limits an order on the given side can trade against without going through
+// the band. The band is fixed when the order comes in, so it can't drag the
+// band along as it sweeps the book.
+func (ob *Orderbook) bandCrosses(bid bool) func(l *Limit) bool {
+	lo, hi, ok := ob.bandLimits()
+
+	return func(l *Limit) bool {
+		if !ok {
+			return true
+		}
+
+		if bid {
+			return l.Price <= hi
+		}
+
+		return l.Price >= lo
+	}
+}
+
+// Volume weighted average price of the trades within window of the last one
+func (ob *Orderbook) vwap(window time.Duration) decimal.Decimal {
+	if len(ob.Trades) == 0 {
+		return 0
+	}
+
+	from := ob.Trades[len(ob.Trades)-1].Timestamp - window.Nanoseconds()
+
+	// Price times size runs past int64 quickly
+	notional, volume := new(big.Int), new(big.Int)
+	for i := len(ob.Trades) - 1; i >= 0 && ob.Trades[i].Timestamp >= from; i-- {
+		trade := ob.Trades[i]
+
+		size := big.NewInt(int64(trade.Size))
+		notional.Add(notional, size.Mul(size, big.NewInt(int64(trade.Price))))
+		volume.Add(volume, big.NewInt(int64(trade.Size)))
+	}
+
+	if volume.Sign() == 0 {
+		last, _ := ob.LastPrice()
+		return last
+	}
+
+	return decimal.Decimal(notional.Quo(notional, volume).Int64())
+}
+
+// How far the price moved over the trades within window of the last one, as
+// the range between the highest and the lowest price over the lowest, at
+// PercentScale. Only trades with an ID above after count.
+func (ob *Orderbook) PriceMove(window time.Duration, after int64) decimal.Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.Trades) == 0 {
+		return 0
+	}
+
+	from := ob.Trades[len(ob.Trades)-1].Timestamp - window.Nanoseconds()
+
+	var high, low decimal.Decimal
+	for i := len(ob.Trades) - 1; i >= 0; i-- {
+		trade := ob.Trades[i]
+		if trade.Timestamp < from || trade.ID <= after {
+			break
+		}
+
+		if low == 0 || trade.Price < low {
+			low = trade.Price
+		}
+		high = decimal.Max(high, trade.Price)
+	}
+
+	if low == 0 {
+		return 0
+	}
+
+	return (high - low) * 100 * PercentScale.Unit() / low
+}
+
+// ID of the last trade, zero if nothing has traded
+func (ob *Orderbook) LastTradeID() int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	if len(ob.Trades) == 0 {
+		return 0
+	}
+
+	return ob.Trades[len(ob.Trades)-1].ID
+}
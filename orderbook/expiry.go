@@ -0,0 +1,61 @@
+package orderbook
+
+import "sort"
+
+func (o *Order) expired(now int64) bool {
+	return o.ExpiresAt != 0 && o.ExpiresAt <= now
+}
+
+// Takes every resting and pending stop order whose expiry time has passed out
+// of the book and returns them, oldest first, with the matches of any bracket
+// legs the expired entries sent in. An expired group leg cancels the rest of
+// its group, like a fill or a cancel would. now is in Unix nanoseconds, the
+// caller owns the clock.
+func (ob *Orderbook) ExpireOrders(now int64) ([]*Order, []Match) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	expired := []*Order{}
+
+	for _, o := range ob.Orders {
+		if o.expired(now) {
+			expired = append(expired, o)
+		}
+	}
+
+	for _, o := range ob.stops {
+		if o.expired(now) {
+			expired = append(expired, o)
+		}
+	}
+
+	sort.Sort(Orders(expired))
+
+	done := expired[:0]
+	for _, o := range expired {
+		// Cancelled along with a leg of its group that expired first
+		if o.IsDone() {
+			continue
+		}
+
+		if o.Status == StatusPending {
+			ob.removeStop(o.ID)
+		} else {
+			ob.removeOrder(o)
+		}
+
+		o.Status = StatusExpired
+		done = append(done, o)
+
+		if !o.isEntry() {
+			ob.cancelGroup(o)
+		}
+	}
+	expired = done
+
+	if len(expired) == 0 {
+		return expired, []Match{}
+	}
+
+	return expired, ob.afterMatch(nil)
+}
@@ -0,0 +1,260 @@
+package orderbook
+
+import "github.com/kkomitski/exchange/decimal"
+
+type GroupType string
+
+const (
+	// As soon as one leg fills, even partly, the other legs are cancelled
+	OneCancelsOther GroupType = "OCO"
+	// The legs wait for the entry order to finish, then go into the book as
+	// an OCO sized to what the entry filled. An entry that finishes without
+	// filling at all takes the legs with it.
+	Bracket GroupType = "BRACKET"
+)
+
+// Orders placed and managed together. Group IDs come from the same sequence as
+// order IDs so the two never collide.
+type OrderGroup struct {
+	ID   int64     `json:"id"`
+	Type GroupType `json:"type"`
+	// Bracket only
+	Entry *GroupLeg   `json:"entry,omitempty"`
+	Legs  []*GroupLeg `json:"legs"`
+
+	// Whether the legs are in the book
+	armed bool
+}
+
+// One order of a group and how it goes into the book - as a market order, a
+// stop order if Stop is set or a limit order at Price otherwise
+type GroupLeg struct {
+	Order  *Order          `json:"order"`
+	Market bool            `json:"market,omitempty"`
+	Price  decimal.Decimal `json:"price,omitempty"`
+	Stop   *Stop           `json:"stop,omitempty"`
+}
+
+// Every order in the group, the entry first
+func (g *OrderGroup) Orders() []*Order {
+	orders := []*Order{}
+	if g.Entry != nil {
+		orders = append(orders, g.Entry.Order)
+	}
+
+	for _, leg := range g.Legs {
+		orders = append(orders, leg.Order)
+	}
+
+	return orders
+}
+
+// Places every order of the group. Legs of a bracket wait as PENDING until
+// the entry is done. The matches include everything the group set off.
+func (ob *Orderbook) PlaceOrderGroup(g *OrderGroup) []Match {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if g.ID == 0 {
+		g.ID = ob.sequencer.NextOrderID()
+	}
+
+	for _, o := range g.Orders() {
+		o.Group = g
+		ob.accept(o)
+	}
+
+	matches := []Match{}
+
+	if g.Type == Bracket {
+		for _, leg := range g.Legs {
+			leg.Order.Status = StatusPending
+		}
+		ob.brackets = append(ob.brackets, g)
+
+		return ob.afterMatch(ob.placeLeg(g.Entry))
+	}
+
+	g.armed = true
+
+	for _, leg := range g.Legs {
+		// An earlier leg already filled and cancelled this one
+		if leg.Order.IsDone() {
+			continue
+		}
+
+		matches = append(matches, ob.afterMatch(ob.placeLeg(leg))...)
+	}
+
+	return matches
+}
+
+func (ob *Orderbook) placeLeg(leg *GroupLeg) []Match {
+	switch {
+	case leg.Market:
+		// A market leg that finds no liquidity just ends up CANCELLED
+		matches, _ := ob.placeMarketOrder(leg.Order, PartialFill)
+		return matches
+	case leg.Stop != nil:
+		ob.placeStopOrder(leg.Order, *leg.Stop)
+		return nil
+	default:
+		return ob.placeLimitOrder(leg.Price, leg.Order)
+	}
+}
+
+// Runs everything that reacts to trades - stop orders and order groups - until
+// nothing else happens, returning matches with whatever they added. Pegged
+// orders get repriced last.
+func (ob *Orderbook) afterMatch(matches []Match) []Match {
+	if matches == nil {
+		matches = []Match{}
+	}
+
+	latest := matches
+	for {
+		ob.updateGroups(latest)
+		more := ob.armBrackets()
+		more = append(more, ob.triggerStops()...)
+
+		if len(more) == 0 {
+			// Pegged orders never match, so they can follow whatever the book
+			// ended up as
+			ob.repeg()
+			return matches
+		}
+
+		matches = append(matches, more...)
+		latest = more
+	}
+}
+
+// Cancels the siblings of OCO legs that traded
+func (ob *Orderbook) updateGroups(matches []Match) {
+	for _, match := range matches {
+		if !match.IsTrade() {
+			continue
+		}
+
+		for _, o := range []*Order{match.Ask, match.Bid} {
+			g := o.Group
+			if g == nil || o.isEntry() {
+				continue
+			}
+
+			for _, leg := range g.Legs {
+				if leg.Order != o {
+					ob.cancelLeg(leg.Order)
+				}
+			}
+		}
+	}
+}
+
+// Sends in the legs of every bracket whose entry is done - filled, or
+// cancelled, rejected, killed or expired after filling some of the way - for
+// no more than the entry filled. Legs of an entry that didn't fill at all are
+// cancelled.
+func (ob *Orderbook) armBrackets() []Match {
+	more := []Match{}
+
+	waiting := []*OrderGroup{}
+	for _, g := range ob.brackets {
+		if g.Entry.Order.IsDone() {
+			more = append(more, ob.arm(g)...)
+		} else {
+			waiting = append(waiting, g)
+		}
+	}
+	ob.brackets = waiting
+
+	return more
+}
+
+func (ob *Orderbook) arm(g *OrderGroup) []Match {
+	more := []Match{}
+	filled := g.Entry.Order.Filled
+
+	g.armed = true
+	for _, leg := range g.Legs {
+		// Cancelled along with the entry
+		if leg.Order.IsDone() {
+			continue
+		}
+
+		if filled == 0 {
+			leg.Order.Status = StatusCancelled
+			continue
+		}
+
+		leg.Order.Size = decimal.Min(leg.Order.Size, filled)
+
+		if err := ob.Fund(leg.Order, leg.LimitPrice()); err != nil {
+			leg.Order.Status = StatusCancelled
+			continue
+		}
+
+		// A leg that trades straight away cancels the rest before they go in
+		legMatches := ob.placeLeg(leg)
+		more = append(more, legMatches...)
+		ob.updateGroups(legMatches)
+	}
+
+	return more
+}
+
+// Worst price the leg can trade at, zero for none
+func (leg *GroupLeg) LimitPrice() decimal.Decimal {
+	switch {
+	case leg.Market:
+		return 0
+	case leg.Stop != nil:
+		return leg.Stop.LimitPrice
+	default:
+		return leg.Price
+	}
+}
+
+// Leg of a bracket that's still waiting for its entry to finish
+func (ob *Orderbook) pendingLeg(id int64) (*Order, bool) {
+	for _, g := range ob.brackets {
+		for _, leg := range g.Legs {
+			if leg.Order.ID == id && !leg.Order.IsDone() {
+				return leg.Order, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Whether the order is the entry of a bracket
+func (o *Order) isEntry() bool {
+	return o.Group != nil && o.Group.Entry != nil && o.Group.Entry.Order == o
+}
+
+// Takes a group order out of the book, wherever it is
+func (ob *Orderbook) cancelLeg(o *Order) {
+	if o.IsDone() {
+		return
+	}
+
+	if _, ok := ob.removeStop(o.ID); !ok && o.Limit != nil {
+		ob.removeOrder(o)
+	}
+
+	o.Status = StatusCancelled
+}
+
+// Cancelling any order of a group cancels whatever else of it is still
+// resting or waiting
+func (ob *Orderbook) cancelGroup(o *Order) {
+	g := o.Group
+	if g == nil {
+		return
+	}
+
+	for _, leg := range g.Legs {
+		ob.cancelLeg(leg.Order)
+	}
+}
@@ -0,0 +1,166 @@
+package orderbook
+
+import (
+	"math/rand"
+
+	"github.com/kkomitski/exchange/decimal"
+)
+
+const (
+	maxLevelHeight = 32
+	// Chance of a node being promoted one level up - 1/4 keeps the towers
+	// short without hurting lookups
+	levelPromotion = 0.25
+)
+
+type levelNode struct {
+	limit *Limit
+	next  []*levelNode
+}
+
+// Keeps the limits of one side of the book in a skiplist ordered from the
+// best price to the worst, so the best price is always the first node and
+// inserts and deletes are O(log n)
+type priceLevels struct {
+	head   *levelNode
+	height int
+	length int
+
+	// Returns true if price a is better than price b for this side
+	better func(a, b decimal.Decimal) bool
+
+	rand *rand.Rand
+}
+
+func newPriceLevels(bid bool) *priceLevels {
+	better := func(a, b decimal.Decimal) bool { return a < b }
+	if bid {
+		better = func(a, b decimal.Decimal) bool { return a > b }
+	}
+
+	return &priceLevels{
+		head:   &levelNode{next: make([]*levelNode, maxLevelHeight)},
+		height: 1,
+		better: better,
+		rand:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (p *priceLevels) Len() int {
+	return p.length
+}
+
+// Best priced limit on this side, nil if the side is empty
+func (p *priceLevels) Best() *Limit {
+	if first := p.head.next[0]; first != nil {
+		return first.limit
+	}
+
+	return nil
+}
+
+func (p *priceLevels) Get(price decimal.Decimal) *Limit {
+	node := p.head
+	for i := p.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && p.better(node.next[i].limit.Price, price) {
+			node = node.next[i]
+		}
+	}
+
+	if next := node.next[0]; next != nil && next.limit.Price == price {
+		return next.limit
+	}
+
+	return nil
+}
+
+func (p *priceLevels) Insert(l *Limit) {
+	var update [maxLevelHeight]*levelNode
+
+	node := p.head
+	for i := p.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && p.better(node.next[i].limit.Price, l.Price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	// Already have a level at this price
+	if next := node.next[0]; next != nil && next.limit.Price == l.Price {
+		next.limit = l
+		return
+	}
+
+	height := p.randomHeight()
+	if height > p.height {
+		for i := p.height; i < height; i++ {
+			update[i] = p.head
+		}
+		p.height = height
+	}
+
+	inserted := &levelNode{limit: l, next: make([]*levelNode, height)}
+	for i := 0; i < height; i++ {
+		inserted.next[i] = update[i].next[i]
+		update[i].next[i] = inserted
+	}
+
+	p.length++
+}
+
+func (p *priceLevels) Delete(price decimal.Decimal) bool {
+	var update [maxLevelHeight]*levelNode
+
+	node := p.head
+	for i := p.height - 1; i >= 0; i-- {
+		for node.next[i] != nil && p.better(node.next[i].limit.Price, price) {
+			node = node.next[i]
+		}
+		update[i] = node
+	}
+
+	target := node.next[0]
+	if target == nil || target.limit.Price != price {
+		return false
+	}
+
+	for i := 0; i < len(target.next); i++ {
+		update[i].next[i] = target.next[i]
+	}
+
+	for p.height > 1 && p.head.next[p.height-1] == nil {
+		p.height--
+	}
+
+	p.length--
+	return true
+}
+
+// Walks the limits from the best price to the worst until fn returns false
+func (p *priceLevels) Each(fn func(l *Limit) bool) {
+	for node := p.head.next[0]; node != nil; node = node.next[0] {
+		if !fn(node.limit) {
+			return
+		}
+	}
+}
+
+// All limits from the best price to the worst
+func (p *priceLevels) Limits() []*Limit {
+	limits := make([]*Limit, 0, p.length)
+	p.Each(func(l *Limit) bool {
+		limits = append(limits, l)
+		return true
+	})
+
+	return limits
+}
+
+func (p *priceLevels) randomHeight() int {
+	height := 1
+	for height < maxLevelHeight && p.rand.Float64() < levelPromotion {
+		height++
+	}
+
+	return height
+}
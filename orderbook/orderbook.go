@@ -1,36 +1,153 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
-	"sort"
 	"sync"
 	"time"
 
+	"github.com/kkomitski/exchange/decimal"
 	"github.com/kkomitski/exchange/utils"
 )
 
 type Trade struct {
-    Price float64
+    ID int64
+    Price decimal.Decimal
     Bid bool
     Timestamp int64
-    Size float64
+    Size decimal.Decimal
 }
 
 type Match struct {
     Ask        *Order
     Bid        *Order
-    SizeFilled float64
-    Price      float64
+    SizeFilled decimal.Decimal
+    Price      decimal.Decimal
+    TradeID    int64
+
+    // Set when both orders belong to the same user and self-trade prevention
+    // stopped them from trading. SizeFilled is then zero and SizePrevented is
+    // what would have traded.
+    Prevented     SelfTradePrevention
+    SizePrevented decimal.Decimal
 }
 
+func (m Match) IsTrade() bool {
+    return m.Prevented == ""
+}
+
+// What to do when an incoming order would match a resting order of the same
+// user. The incoming order's mode is the one applied, empty lets the orders
+// trade.
+type SelfTradePrevention string
+
+const (
+    // Cancel the incoming order, the resting one stays
+    CancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+    // Cancel the resting order and keep matching the incoming one
+    CancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+    CancelBoth   SelfTradePrevention = "CANCEL_BOTH"
+    // Take the smaller size off both orders without trading and cancel
+    // whichever ends up empty
+    DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
+)
+
+// How long a limit order stays in the book
+type TimeInForce string
+
+const (
+    // Rests in the book until it fills or is cancelled
+    GoodTillCancel TimeInForce = "GTC"
+    // Matches what it can on arrival and cancels the rest
+    ImmediateOrCancel TimeInForce = "IOC"
+    // Fills completely on arrival or not at all
+    FillOrKill TimeInForce = "FOK"
+    // Rests in the book until ExpiresAt
+    GoodTillDate TimeInForce = "GTD"
+    // Rests in the book until the end of the trading session
+    Day TimeInForce = "DAY"
+)
+
+// Whether whatever is left of the order after matching rests in the book
+func (t TimeInForce) Rests() bool {
+    return t == GoodTillCancel || t == GoodTillDate || t == Day
+}
+
+type OrderStatus string
+
+const (
+    StatusOpen            OrderStatus = "OPEN"
+    StatusPartiallyFilled OrderStatus = "PARTIALLY_FILLED"
+    StatusFilled          OrderStatus = "FILLED"
+    StatusCancelled       OrderStatus = "CANCELLED"
+    // FOK order that couldn't be filled completely on arrival
+    StatusKilled          OrderStatus = "KILLED"
+    // Post-only order that would have taken liquidity
+    StatusRejected        OrderStatus = "REJECTED"
+    // Stop order waiting for its trigger price
+    StatusPending         OrderStatus = "PENDING"
+    // GTD or DAY order that reached its expiry time
+    StatusExpired         OrderStatus = "EXPIRED"
+)
+
+// What to do with a post-only order that would match on arrival
+type PostOnlyMode string
+
+const (
+    PostOnlyReject  PostOnlyMode = "REJECT"
+    // Move the order one tick behind the touch so it rests instead
+    PostOnlyReprice PostOnlyMode = "REPRICE"
+)
+
+type PostOnlyResult string
+
+const (
+    PostOnlyAccepted PostOnlyResult = "ACCEPTED"
+    PostOnlyRejected PostOnlyResult = "REJECTED"
+    PostOnlyRepriced PostOnlyResult = "REPRICED"
+)
+
 type Order struct {
     ID        int64   `json:"id"`
     UserID    int64   `json:"userId"`
-    Size      float64 `json:"size"`
+    // Optional ID picked by the user, echoed back untouched
+    ClientOrderID string `json:"clientOrderId,omitempty"`
+    Size      decimal.Decimal `json:"size"`
     Bid       bool    `json:"bid"`
     Limit     *Limit  `json:"limit"`
     Timestamp int64   `json:"timestamp"`
+    // Assigned by the orderbook on arrival - decides time priority at a limit
+    Seq       uint64  `json:"seq"`
+
+    TimeInForce TimeInForce     `json:"timeInForce"`
+    // Unix nanoseconds, only set for GTD and DAY orders
+    ExpiresAt   int64           `json:"expiresAt,omitempty"`
+    Status      OrderStatus     `json:"status"`
+    // Total size matched so far, Size is what is left
+    Filled      decimal.Decimal `json:"filled"`
+
+    // Set for maker-only orders, empty otherwise
+    PostOnly       PostOnlyMode   `json:"postOnly,omitempty"`
+    PostOnlyResult PostOnlyResult `json:"postOnlyResult,omitempty"`
+
+    // Set for stop and stop-limit orders
+    Stop *Stop `json:"stop,omitempty"`
+    // Set for orders placed as part of an OCO or bracket
+    Group *OrderGroup `json:"-"`
+    // Set for orders priced off the touch
+    Peg *Peg `json:"peg,omitempty"`
+
+    SelfTradePrevention SelfTradePrevention `json:"selfTradePrevention,omitempty"`
+
+    // Iceberg orders only show Display of their size in the book at a time,
+    // zero for a regular order
+    Display decimal.Decimal `json:"display,omitempty"`
+    // What is left of the slice currently on show
+    shown decimal.Decimal
+
+    // Neighbours in the FIFO queue of the limit the order rests at
+    prev *Order
+    next *Order
 }
 
 type Orders []*Order
@@ -39,133 +156,280 @@ func (o Orders) Len() int { return len(o) }
 
 func (o Orders) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
 
-func (o Orders) Less(i, j int) bool { return o[i].Timestamp < o[j].Timestamp }
+func (o Orders) Less(i, j int) bool { return o[i].Seq < o[j].Seq }
 
 func (o *Order) String() string {
-    return fmt.Sprintf("Order{Size: %.2f, Bid: %v, Timestamp: %v}", o.Size, o.Bid, o.Timestamp)
+    return fmt.Sprintf("Order{Size: %s, Bid: %v, Seq: %v}", o.Size.String(), o.Bid, o.Seq)
 }
 
 func (o *Order) IsFilled() bool {
-    return o.Size == 0.0
+    return o.Size == 0
 }
 
-func NewOrder(bid bool, size float64, userID int64) *Order {
+func (o *Order) IsIceberg() bool {
+    return o.Display != 0
+}
+
+// Size the order shows in the book, the rest of an iceberg stays hidden
+func (o *Order) Visible() decimal.Decimal {
+    if o.IsIceberg() {
+        return o.shown
+    }
+
+    return o.Size
+}
+
+// Whether the order is finished with - nothing more can happen to it
+func (o *Order) IsDone() bool {
+    switch o.Status {
+    case StatusFilled, StatusCancelled, StatusKilled, StatusRejected, StatusExpired:
+        return true
+    }
+
+    return false
+}
+
+func (o *Order) fill(size decimal.Decimal) {
+    o.Filled += size
+
+    if o.IsFilled() {
+        o.Status = StatusFilled
+    } else {
+        o.Status = StatusPartiallyFilled
+    }
+}
+
+// The ID is left empty until the order is placed - the orderbook assigns it
+// from its sequencer
+func NewOrder(bid bool, size decimal.Decimal, userID int64) *Order {
     return &Order{
         UserID:    userID,
-        ID:        int64(rand.Intn(1_000_000_000)),
         Size:      size,
         Bid:       bid,
         Timestamp: time.Now().UnixNano(),
+        TimeInForce: GoodTillCancel,
     }
 }
 
+// A price level. Orders resting at the limit form a FIFO queue (an intrusive
+// linked list through the orders themselves), so the head is always the
+// oldest order and removing any order is O(1).
 type Limit struct {
-    Price       float64 `json:"price"`
-    Orders      Orders  `json:"-"`
-    TotalVolume float64 `json:"totalVolume"`
+    Price       decimal.Decimal `json:"price"`
+    // Includes the hidden part of iceberg orders, so it stays out of the JSON
+    TotalVolume decimal.Decimal `json:"-"`
+    // What the book shows at this price
+    DisplayVolume decimal.Decimal `json:"displayVolume"`
+
+    head  *Order
+    tail  *Order
+    count int
+    // How many of the orders are pegged
+    pegged int
 }
 
 type LimitJSON struct {
-    Price       float64 `json:"price"`
-    TotalVolume float64 `json:"totalVolume"`
+    Price       decimal.Decimal `json:"price"`
+    DisplayVolume decimal.Decimal `json:"displayVolume"`
     Orders      Orders  `json:"orders"`
 }
 
 type Limits []*Limit
-type ByBestAsk struct{ Limits }
-
-func (a ByBestAsk) Len() int { return len(a.Limits) }
-
-func (a ByBestAsk) Swap(i, j int) { a.Limits[i], a.Limits[j] = a.Limits[j], a.Limits[i] }
 
-func (a ByBestAsk) Less(i, j int) bool { return a.Limits[i].Price < a.Limits[j].Price }
-
-type ByBestBid struct{ Limits }
+func (l *Limit) String() string {
+    return fmt.Sprintf("[price: %s | volume: %s]", l.Price.String(), l.TotalVolume.String())
+}
 
-func (b ByBestBid) Len() int { return len(b.Limits) }
+// Number of orders resting at the limit
+func (l *Limit) Len() int {
+    return l.count
+}
 
-func (b ByBestBid) Swap(i, j int) { b.Limits[i], b.Limits[j] = b.Limits[j], b.Limits[i] }
+// Oldest order at the limit, next in line to be filled
+func (l *Limit) Front() *Order {
+    return l.head
+}
 
-func (b ByBestBid) Less(i, j int) bool { return b.Limits[i].Price > b.Limits[j].Price }
+// Copy of the queue in priority order
+func (l *Limit) Orders() Orders {
+    orders := make(Orders, 0, l.count)
+    for o := l.head; o != nil; o = o.next {
+        orders = append(orders, o)
+    }
 
-func (l *Limit) String() string {
-    return fmt.Sprintf("[price: %.2f | volume: %.2f]", l.Price, l.TotalVolume)
+    return orders
 }
 
+// Puts the order at the back of the queue. Icebergs come in with a fresh slice
+// on show.
 func (l *Limit) AddOrder(o *Order) {
+    if o.IsIceberg() {
+        o.shown = decimal.Min(o.Display, o.Size)
+    }
+
     o.Limit = l
-    l.Orders = append(l.Orders, o)
+    o.prev = l.tail
+    o.next = nil
+
+    if l.tail != nil {
+        l.tail.next = o
+    } else {
+        l.head = o
+    }
+
+    l.tail = o
+    l.count++
+    if o.Peg != nil {
+        l.pegged++
+    }
     l.TotalVolume += o.Size
+    l.DisplayVolume += o.Visible()
 }
 
 func (l *Limit) DeleteOrder(o *Order) {
-    for i := 0; i < len(l.Orders); i++ {
-        if l.Orders[i] == o {
-            l.Orders[i] = l.Orders[len(l.Orders)-1]
-            l.Orders = l.Orders[:len(l.Orders)-1]
-        }
+    if o.Limit != l {
+        return
+    }
+
+    if o.prev != nil {
+        o.prev.next = o.next
+    } else {
+        l.head = o.next
+    }
+
+    if o.next != nil {
+        o.next.prev = o.prev
+    } else {
+        l.tail = o.prev
     }
 
+    o.prev = nil
+    o.next = nil
     o.Limit = nil
-    l.TotalVolume -= o.Size
 
-    sort.Sort(l.Orders)
-    // TODO: resort the rest of the orders
+    l.count--
+    if o.Peg != nil {
+        l.pegged--
+    }
+    l.TotalVolume -= o.Size
+    l.DisplayVolume -= o.Visible()
 }
 
 func (l *Limit) ProcessOrder(o *Order, ob *Orderbook) []Match {
-    var (
-        matches        []Match
-        ordersToDelete []*Order
-    )
+    var matches []Match
 
-    // Range over all the orders in the limit
-    for _, order := range l.Orders {
-        // If the incoming order is empty -> exit early
-        if o.IsFilled() {
+    // Walk the queue in arrival order
+    for order := l.head; order != nil; {
+        // If the incoming order is empty (or was cancelled) -> exit early
+        if o.IsFilled() || o.IsDone() {
             break
         }
-        
+
+        next := order.next
+
+        if order.UserID == o.UserID && o.SelfTradePrevention != "" {
+            matches = append(matches, l.preventSelfTrade(order, o, ob))
+            order = next
+            continue
+        }
+
         match := l.fillOrder(order, o)
         matches = append(matches, match)
 
         l.TotalVolume -= match.SizeFilled
+        l.DisplayVolume -= match.SizeFilled
 
         // If the the Order sitting at this limit is filled -> delete
         if order.IsFilled() {
-            ordersToDelete = append(ordersToDelete, order)
+            l.DeleteOrder(order)
+            delete(ob.Orders, order.ID)
+        } else if order.IsIceberg() && order.shown == 0 {
+            // Iceberg slice used up - show the next one from the back of the
+            // queue, behind everyone already waiting
+            l.DeleteOrder(order)
+            ob.seq++
+            order.Seq = ob.seq
+            l.AddOrder(order)
+
+            // It was the only order left, keep filling it
+            if next == nil {
+                next = order
+            }
         }
+
+        order = next
     }
 
-    for _, order := range ordersToDelete {
-        l.DeleteOrder(order)
+    return matches
+}
 
-        // TODO: Check this 
-        if ob.Orders[order.ID].Size == 0.0 {
-            delete(ob.Orders, order.ID)
-        }
+// Applies the incoming order's self-trade prevention mode to a resting order of
+// the same user instead of filling them against each other
+func (l *Limit) preventSelfTrade(resting, incoming *Order, ob *Orderbook) Match {
+    match := Match{
+        Price:         l.Price,
+        Prevented:     incoming.SelfTradePrevention,
+        SizePrevented: decimal.Min(resting.Size, incoming.Size),
     }
 
-    // if ob.Orders[o.ID].Size == 0.0 {
-    //     // fmt.Printf("Orderbook orders %+v", ob.Orders[o.ID])
-    //     fmt.Println("here")
-    // }
+    if incoming.Bid {
+        match.Bid, match.Ask = incoming, resting
+    } else {
+        match.Bid, match.Ask = resting, incoming
+    }
 
-    return matches
+    cancelResting := func() {
+        l.DeleteOrder(resting)
+        delete(ob.Orders, resting.ID)
+        resting.Status = StatusCancelled
+    }
+
+    switch incoming.SelfTradePrevention {
+    case CancelNewest:
+        incoming.Status = StatusCancelled
+    case CancelOldest:
+        cancelResting()
+    case CancelBoth:
+        cancelResting()
+        incoming.Status = StatusCancelled
+    case DecrementAndCancel:
+        size := match.SizePrevented
+        visible := resting.Visible()
+
+        resting.Size -= size
+        l.TotalVolume -= size
+        if resting.IsIceberg() {
+            resting.shown = decimal.Min(resting.shown, resting.Size)
+        }
+        l.DisplayVolume -= visible - resting.Visible()
+
+        incoming.Size -= size
+
+        if resting.Size == 0 {
+            cancelResting()
+        }
+        if incoming.Size == 0 {
+            incoming.Status = StatusCancelled
+        }
+    }
+
+    return match
 }
 
 type PrintParams struct {
     BidUserID int64
     AskUserID int64
 
-    SizeFilled float64
+    SizeFilled decimal.Decimal
 }
 
+// Fills the resting order a against the incoming order b. A resting iceberg
+// only fills up to the slice it is showing.
 func (l *Limit) fillOrder(a, b *Order) Match {
     var (
         bid        *Order
         ask        *Order
-        sizeFilled float64
+        sizeFilled decimal.Decimal
     )
 
     if a.Bid {
@@ -176,16 +440,17 @@ func (l *Limit) fillOrder(a, b *Order) Match {
         ask = a
     }
 
-    if a.Size >= b.Size {
-        a.Size -= b.Size
-        sizeFilled = b.Size
-        b.Size = 0.0
-    } else {
-        b.Size -= a.Size
-        sizeFilled = a.Size
-        a.Size = 0.0
+    sizeFilled = decimal.Min(a.Visible(), b.Size)
+    a.Size -= sizeFilled
+    b.Size -= sizeFilled
+
+    if a.IsIceberg() {
+        a.shown -= sizeFilled
     }
 
+    a.fill(sizeFilled)
+    b.fill(sizeFilled)
+
     return Match{
         Bid:        bid,
         Ask:        ask,
@@ -194,104 +459,386 @@ func (l *Limit) fillOrder(a, b *Order) Match {
     }
 }
 
-func NewLimit(price float64) *Limit {
+func NewLimit(price decimal.Decimal) *Limit {
     return &Limit{
         Price:       price,
-        Orders:      []*Order{},
         TotalVolume: 0,
     }
 }
 
 type Orderbook struct {
-    asks []*Limit
-    bids []*Limit
+    // Both sides are kept ordered from the best price to the worst
+    asks *priceLevels
+    bids *priceLevels
 
     Trades []*Trade
 
-    AskLimits map[float64]*Limit `json:"askLimits"`
-    BidLimits map[float64]*Limit `json:"bidLimits"`
+    AskLimits map[decimal.Decimal]*Limit `json:"askLimits"`
+    BidLimits map[decimal.Decimal]*Limit `json:"bidLimits"`
 
     Orders map[int64]*Order `json:"orders"`
 
+    // Smallest price increment, used to reprice post-only orders
+    TickSize decimal.Decimal
+    // Nil for no price band
+    Band *PriceBand
+    // Stamps trades, time.Now unless the owner of the book keeps its own
+    // clock
+    Clock func() time.Time
+    // Asked before the book sends an order in on its own - a stop that
+    // triggered, the leg of a bracket being armed or a pegged order moving
+    // to a new price - at the price it goes in at, zero for none. An order it
+    // refuses is cancelled instead. Lets everything through unless the owner
+    // of the book funds its orders.
+    Fund func(o *Order, price decimal.Decimal) error
+
+    // Stop orders waiting for their trigger, kept out of the visible book
+    stops []*Order
+    // Number of trades already run past the trailing stops
+    trailed int
+    // Pegged orders, repriced whenever the book changes
+    pegged []*Order
+    // Brackets whose legs are waiting for the entry to finish
+    brackets []*OrderGroup
+    // Orders rest without matching until the auction is uncrossed
+    auction bool
+
+    // Last sequence number handed out to an incoming order
+    seq uint64
+
+    sequencer *Sequencer
+
     mu sync.RWMutex
 }
 
 func NewOrderbook() *Orderbook {
+    return NewOrderbookWithSequencer(NewSequencer(SequencerState{}))
+}
+
+// Orderbooks of the same exchange share a sequencer so their IDs never collide
+func NewOrderbookWithSequencer(seq *Sequencer) *Orderbook {
     return &Orderbook{
-        asks:      []*Limit{},
-        bids:      []*Limit{},
+        sequencer: seq,
+        TickSize:  1,
+        Clock:     time.Now,
+        Fund:      func(*Order, decimal.Decimal) error { return nil },
+
+        asks:      newPriceLevels(false),
+        bids:      newPriceLevels(true),
 
         Trades:    []*Trade{},
 
-        AskLimits: make(map[float64]*Limit),
-        BidLimits: make(map[float64]*Limit),
+        AskLimits: make(map[decimal.Decimal]*Limit),
+        BidLimits: make(map[decimal.Decimal]*Limit),
         Orders:    make(map[int64]*Order),
         // mu:       sync.RWMutex{},
     }
 }
 
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
-    matches := []Match{}
+// What to do with a market order that is bigger than the liquidity in the book
+type FillPolicy string
 
-    if o.Bid {
-        // Bid order
-        if o.Size > ob.AskTotalVolume() {
-            panic(fmt.Errorf("not enough volume [size: %.2f] sitting in books for order [size: %.2f]", ob.AskTotalVolume(), o.Size))
-        }
+const (
+    // Fill against whatever is in the book and leave the rest unfilled (IOC)
+    PartialFill FillPolicy = "PARTIAL"
+    // Reject the whole order unless the book can fill all of it
+    RejectUnfilled FillPolicy = "REJECT"
+)
 
-        for _, limit := range ob.Asks() {
-            limitMatches := limit.ProcessOrder(o, ob)
-            // fmt.Println("Limit matches", matches)
-            matches = append(matches, limitMatches...)
+type InsufficientLiquidityError struct {
+    Bid       bool
+    Requested decimal.Decimal
+    Available decimal.Decimal
+}
 
-            if len(limit.Orders) == 0 {
-                ob.clearLimit(false, limit)
-            }
+func (e *InsufficientLiquidityError) Error() string {
+    return fmt.Sprintf("not enough volume [size: %d] sitting in books for order [size: %d]", e.Available, e.Requested)
+}
+
+// Fills the order against the opposite side of the book. Whatever can't be
+// filled is left in o.Size, or the order is rejected outright if the policy
+// is RejectUnfilled. The matches include fills of any stop orders and order
+// group legs the trades set off.
+func (ob *Orderbook) PlaceMarketOrder(o *Order, policy FillPolicy) ([]Match, error) {
+    ob.mu.Lock()
+    defer ob.mu.Unlock()
+
+    matches, err := ob.placeMarketOrder(o, policy)
+    if err != nil {
+        return nil, err
+    }
+
+    return ob.afterMatch(matches), nil
+}
+
+func (ob *Orderbook) placeMarketOrder(o *Order, policy FillPolicy) ([]Match, error) {
+    var available decimal.Decimal
+
+    ob.accept(o)
+
+    // Nothing matches before the uncross and a market order has no price to
+    // wait at
+    if ob.auction {
+        o.Status = StatusRejected
+        return nil, ErrInAuction
+    }
+
+    // Only what's inside the price band can fill
+    crosses := ob.bandCrosses(o.Bid)
+    available = ob.crossingVolume(o, crosses)
+
+    // Market orders never rest
+    o.TimeInForce = ImmediateOrCancel
+
+    if o.Size > available && policy == RejectUnfilled {
+        o.Status = StatusKilled
+
+        return nil, &InsufficientLiquidityError{
+            Bid:       o.Bid,
+            Requested: o.Size,
+            Available: available,
         }
-    } else {
-        // Ask order
-        if o.Size > ob.BidTotalVolume() {
-            panic(fmt.Errorf("not enough volume [size: %.2f] sitting in books for order [size: %.2f]", ob.BidTotalVolume(), o.Size))
+    }
+
+    matches := ob.matchOrder(o, crosses)
+
+    if !o.IsFilled() {
+        o.Status = StatusCancelled
+    }
+
+    return matches, nil
+}
+
+// Walks the opposite side of the book from the best price outwards and fills
+// the incoming order for as long as crosses() accepts the limit
+func (ob *Orderbook) matchOrder(o *Order, crosses func(l *Limit) bool) []Match {
+    matches := []Match{}
+
+    levels := ob.bids
+    if o.Bid {
+        levels = ob.asks
+    }
+
+    for !o.IsFilled() && !o.IsDone() {
+        limit := levels.Best()
+        if limit == nil || !crosses(limit) {
+            break
         }
 
-        for _, limit := range ob.Bids() {
-            limitMatches := limit.ProcessOrder(o, ob)
-            // fmt.Println("Limit matches", matches)
-            matches = append(matches, limitMatches...)
+        limitMatches := limit.ProcessOrder(o, ob)
+        matches = append(matches, limitMatches...)
 
-            if len(limit.Orders) == 0 {
-                ob.clearLimit(true, limit)
-            }
+        if limit.Len() == 0 {
+            ob.clearLimit(!o.Bid, limit)
         }
     }
 
+    if len(matches) == 0 {
+        return matches
+    }
+
     fmt.Println(utils.PrintColor("green", "OB: Orders Matched:"))
     for i := 0; i < len(matches); i++ {
-        str := fmt.Sprintf("- Bid UID: %v | Ask UID: %v | SizeFilled: %.2f | Price: %.2f", matches[i].Bid.UserID, matches[i].Ask.UserID, matches[i].SizeFilled, matches[i].Price)
+        str := fmt.Sprintf("- Bid UID: %v | Ask UID: %v | SizeFilled: %d | Price: %d", matches[i].Bid.UserID, matches[i].Ask.UserID, matches[i].SizeFilled, matches[i].Price)
+        if !matches[i].IsTrade() {
+            str = fmt.Sprintf("- Self-trade prevented [%v] | UID: %v | Size: %d | Price: %d", matches[i].Prevented, matches[i].Bid.UserID, matches[i].SizePrevented, matches[i].Price)
+        }
 
         fmt.Println(utils.PrintColor("green", str))
     }
 
-    for _, match := range matches {
+    ob.recordTrades(matches, o.Bid)
+
+    return matches
+}
+
+// Adds a trade to the tape for every match that traded. bid is the side that
+// took liquidity.
+func (ob *Orderbook) recordTrades(matches []Match, bid bool) {
+    for i, match := range matches {
+        if !match.IsTrade() {
+            continue
+        }
+
         trade := &Trade{
+            ID: ob.sequencer.NextTradeID(),
             Price: match.Price,
             Size: match.SizeFilled,
-            Timestamp: time.Now().UnixNano(),
-            Bid: o.Bid,
+            Timestamp: ob.Clock().UnixNano(),
+            Bid: bid,
         }
 
         ob.Trades = append(ob.Trades, trade)
+        matches[i].TradeID = trade.ID
     }
+}
 
-    return matches
+// Stamps an incoming order with its ID and its place in the arrival sequence
+func (ob *Orderbook) accept(o *Order) {
+    if o.ID == 0 {
+        o.ID = ob.sequencer.NextOrderID()
+    }
+
+    ob.seq++
+    o.Seq = ob.seq
+
+    if o.TimeInForce == "" {
+        o.TimeInForce = GoodTillCancel
+    }
+
+    // Amended orders come through here again with part of them already filled
+    if o.Filled > 0 {
+        o.Status = StatusPartiallyFilled
+    } else {
+        o.Status = StatusOpen
+    }
 }
 
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-    var limit *Limit
+// Price a post-only order can rest at without matching. Returns false if the
+// order has to be rejected.
+func (ob *Orderbook) postOnlyPrice(o *Order, price decimal.Decimal) (decimal.Decimal, bool) {
+    o.PostOnlyResult = PostOnlyAccepted
+
+    if o.Bid {
+        best := ob.BestAsk()
+        if best == nil || price < best.Price {
+            return price, true
+        }
+
+        if o.PostOnly == PostOnlyReprice && best.Price-ob.TickSize > 0 {
+            o.PostOnlyResult = PostOnlyRepriced
+            return best.Price - ob.TickSize, true
+        }
+    } else {
+        best := ob.BestBid()
+        if best == nil || price > best.Price {
+            return price, true
+        }
+
+        if o.PostOnly == PostOnlyReprice {
+            o.PostOnlyResult = PostOnlyRepriced
+            return best.Price + ob.TickSize, true
+        }
+    }
+
+    o.PostOnlyResult = PostOnlyRejected
+    return price, false
+}
+
+// Volume on the opposite side of the book that an incoming order could match
+// against at prices accepted by crosses(). With self-trade prevention on, the
+// user's own orders never trade, so they don't count - and matching stops at
+// the first one of them for the modes that cancel the incoming order.
+func (ob *Orderbook) crossingVolume(o *Order, crosses func(l *Limit) bool) decimal.Decimal {
+    levels := ob.bids
+    if o.Bid {
+        levels = ob.asks
+    }
+
+    volume := decimal.Decimal(0)
+    levels.Each(func(l *Limit) bool {
+        if !crosses(l) {
+            return false
+        }
 
+        if o.SelfTradePrevention == "" {
+            volume += l.TotalVolume
+            return true
+        }
+
+        for resting := l.head; resting != nil; resting = resting.next {
+            if resting.UserID != o.UserID {
+                volume += resting.Size
+                continue
+            }
+
+            if o.SelfTradePrevention == CancelNewest || o.SelfTradePrevention == CancelBoth {
+                return false
+            }
+        }
+
+        return true
+    })
+
+    return volume
+}
+
+// Matches the order against the opposite side up to (and including) the limit
+// price and rests whatever is left over in the book
+// Like PlaceMarketOrder, the matches include fills of triggered stop orders
+func (ob *Orderbook) PlaceLimitOrder(price decimal.Decimal, o *Order) []Match {
     ob.mu.Lock()
     defer ob.mu.Unlock()
 
+    matches := ob.placeLimitOrder(price, o)
+
+    return ob.afterMatch(matches)
+}
+
+func (ob *Orderbook) placeLimitOrder(price decimal.Decimal, o *Order) []Match {
+    ob.accept(o)
+
+    if ob.auction {
+        ob.collectOrder(price, o)
+        return nil
+    }
+
+    if !ob.inBand(price) {
+        o.Status = StatusRejected
+        return nil
+    }
+
+    // Post-only orders must never take liquidity
+    if o.PostOnly != "" {
+        var ok bool
+        if price, ok = ob.postOnlyPrice(o, price); !ok {
+            o.Status = StatusRejected
+            return nil
+        }
+
+        // Repricing can put it behind a touch that's outside the band now
+        if !ob.inBand(price) {
+            o.Status = StatusRejected
+            return nil
+        }
+    }
+
+    crosses := func(l *Limit) bool {
+        if o.Bid {
+            return l.Price <= price
+        }
+
+        return l.Price >= price
+    }
+
+    if o.TimeInForce == FillOrKill && ob.crossingVolume(o, crosses) < o.Size {
+        o.Status = StatusKilled
+        return nil
+    }
+
+    matches := ob.matchOrder(o, crosses)
+
+    // Fully filled on arrival, nothing left to rest. Self-trade prevention may
+    // also have cancelled it.
+    if o.IsFilled() || o.IsDone() {
+        return matches
+    }
+
+    // Whatever didn't match on arrival is dropped
+    if !o.TimeInForce.Rests() {
+        o.Status = StatusCancelled
+        return matches
+    }
+
+    ob.restOrder(price, o)
+
+    return matches
+}
+
+// Puts the order at the back of the queue at price
+func (ob *Orderbook) restOrder(price decimal.Decimal, o *Order) {
+    var limit *Limit
+
     // fmt.Println("Adding order", o)
     if o.Bid {
         limit = ob.BidLimits[price]
@@ -307,11 +854,11 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 
         if o.Bid {
             // fmt.Println("bid")
-            ob.bids = append(ob.bids, limit)
+            ob.bids.Insert(limit)
             ob.BidLimits[price] = limit
         } else {
             // fmt.Println("ask")
-            ob.asks = append(ob.asks, limit)
+            ob.asks.Insert(limit)
             ob.AskLimits[price] = limit
         }
     }
@@ -323,22 +870,10 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
     if bid {
         delete(ob.BidLimits, l.Price)
-
-        for i := 0; i < len(ob.bids); i++ {
-            if ob.bids[i] == l {
-                ob.bids[i] = ob.bids[len(ob.bids)-1]
-                ob.bids = ob.bids[:len(ob.bids)-1]
-            }
-        }
+        ob.bids.Delete(l.Price)
     } else {
         delete(ob.AskLimits, l.Price)
- 
-        for i := 0; i < len(ob.asks); i++ {
-            if ob.asks[i] == l {
-                ob.asks[i] = ob.asks[len(ob.asks)-1]
-                ob.asks = ob.asks[:len(ob.asks)-1]
-            }
-        }
+        ob.asks.Delete(l.Price)
     }
 
     /**
@@ -348,55 +883,184 @@ func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
     // var orderType string
     // if bid {
     //     orderType = "Bid"
-    //     str := fmt.Sprintf("OB: Cleared %v limit at price %.2f. \n- Bids Limits: [%v] %+v \n", orderType, l.Price, len(ob.bids), ob.bids)
+    //     str := fmt.Sprintf("OB: Cleared %v limit at price %d. \n- Bids Limits: [%v] %+v \n", orderType, l.Price, ob.bids.Len(), ob.Bids())
     //     fmt.Println(utils.PrintColor("green", str))
     // } else {
     //     orderType = "Ask"
-    //     str := fmt.Sprintf("OB: Cleared %v limit at price %.2f. \n- Asks Limits: [%v] %+v \n", orderType, l.Price, len(ob.asks), ob.asks)
+    //     str := fmt.Sprintf("OB: Cleared %v limit at price %d. \n- Asks Limits: [%v] %+v \n", orderType, l.Price, ob.asks.Len(), ob.Asks())
     //     fmt.Println(utils.PrintColor("green", str))
     // }
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+    ob.removeOrder(o)
+    o.Status = StatusCancelled
+    fmt.Println("\n Cancelled order with id", o.ID)
+}
+
+// Takes a resting order out of the book
+func (ob *Orderbook) removeOrder(o *Order) {
     limit := o.Limit
     limit.DeleteOrder(o)
 
-    if len(limit.Orders) == 0 {
+    if limit.Len() == 0 {
         ob.clearLimit(o.Bid, limit)
     }
 
     delete(ob.Orders, o.ID)
-    fmt.Println("\n Cancelled order with id", o.ID)
 }
 
-func (ob *Orderbook) BidTotalVolume() float64 {
-    totalVolume := 0.0
+var ErrOrderNotFound = errors.New("order not found")
+
+// Cancels a resting order or a pending stop order, along with the rest of its
+// order group if it has one. Cancelling the entry of a bracket sends its legs
+// in for whatever the entry filled, the matches are what they set off.
+// Cancelling a leg still waiting for its entry cancels the whole bracket.
+func (ob *Orderbook) CancelOrderByID(id int64) (*Order, []Match, error) {
+    o, ok := ob.removeStop(id)
+    if ok {
+        o.Status = StatusCancelled
+    } else if o, ok = ob.Orders[id]; ok {
+        ob.CancelOrder(o)
+    } else if o, ok = ob.pendingLeg(id); ok {
+        // Legs go first so the entry doesn't send them in
+        ob.cancelGroup(o)
+        ob.cancelLeg(o.Group.Entry.Order)
+        return o, ob.afterMatch(nil), nil
+    } else {
+        return nil, nil, ErrOrderNotFound
+    }
 
-    for i := 0; i < len(ob.bids); i++ {
-        totalVolume += ob.bids[i].TotalVolume
+    if !o.isEntry() {
+        ob.cancelGroup(o)
     }
 
-    return totalVolume
+    return o, ob.afterMatch(nil), nil
 }
 
-func (ob *Orderbook) AskTotalVolume() float64 {
-    totalVolume := 0.0
+var (
+    ErrInvalidAmend = errors.New("price and size can't be negative")
+    ErrAmendPegged  = errors.New("pegged orders follow the market, only their size can be amended")
+)
+
+// Changes the price and/or the open size of a resting order, keeping its ID. A
+// zero price or size keeps the current one. Only reducing the size keeps the
+// order's place in the queue, anything else sends it to the back as if it was
+// new - and at a new price it may match straight away.
+func (ob *Orderbook) AmendOrder(id int64, price, size decimal.Decimal) (*Order, []Match, error) {
+    ob.mu.Lock()
+    defer ob.mu.Unlock()
+
+    o, ok := ob.Orders[id]
+    if !ok {
+        return nil, nil, ErrOrderNotFound
+    }
+
+    if price < 0 || size < 0 {
+        return nil, nil, ErrInvalidAmend
+    }
+
+    limit := o.Limit
 
-    for i := 0; i < len(ob.asks); i++ {
-        totalVolume += ob.asks[i].TotalVolume
+    if o.Peg != nil && price != 0 && price != limit.Price {
+        return nil, nil, ErrAmendPegged
     }
 
+    if price == 0 {
+        price = limit.Price
+    }
+    if size == 0 {
+        size = o.Size
+    }
+
+    // Checked up front so a bad amend leaves the order where it was
+    if price != limit.Price && !ob.inBand(price) {
+        return nil, nil, ErrOutsideBand
+    }
+
+    if price == limit.Price && size <= o.Size {
+        visible := o.Visible()
+
+        limit.TotalVolume -= o.Size - size
+        o.Size = size
+
+        if o.IsIceberg() {
+            o.shown = decimal.Min(o.shown, size)
+        }
+        limit.DisplayVolume -= visible - o.Visible()
+
+        return o, []Match{}, nil
+    }
+
+    ob.removeOrder(o)
+    o.Size = size
+
+    matches := ob.placeLimitOrder(price, o)
+
+    return o, ob.afterMatch(matches), nil
+}
+
+func (ob *Orderbook) BidTotalVolume() decimal.Decimal {
+    totalVolume := decimal.Decimal(0)
+
+    ob.bids.Each(func(l *Limit) bool {
+        totalVolume += l.TotalVolume
+        return true
+    })
+
     return totalVolume
 }
 
-func (ob *Orderbook) Asks() []*Limit {
-    sort.Sort(ByBestAsk{ob.asks})
+func (ob *Orderbook) AskTotalVolume() decimal.Decimal {
+    totalVolume := decimal.Decimal(0)
 
-    return ob.asks
+    ob.asks.Each(func(l *Limit) bool {
+        totalVolume += l.TotalVolume
+        return true
+    })
+
+    return totalVolume
+}
+
+// Volume the book shows on the bid side, without the hidden part of icebergs
+func (ob *Orderbook) BidDisplayVolume() decimal.Decimal {
+    displayVolume := decimal.Decimal(0)
+
+    ob.bids.Each(func(l *Limit) bool {
+        displayVolume += l.DisplayVolume
+        return true
+    })
+
+    return displayVolume
+}
+
+func (ob *Orderbook) AskDisplayVolume() decimal.Decimal {
+    displayVolume := decimal.Decimal(0)
+
+    ob.asks.Each(func(l *Limit) bool {
+        displayVolume += l.DisplayVolume
+        return true
+    })
+
+    return displayVolume
+}
+
+// Ask limits from the lowest price to the highest
+func (ob *Orderbook) Asks() []*Limit {
+    return ob.asks.Limits()
 }
 
+// Bid limits from the highest price to the lowest
 func (ob *Orderbook) Bids() []*Limit {
-    sort.Sort(ByBestBid{ob.bids})
+    return ob.bids.Limits()
+}
+
+// Lowest ask, nil if there are no asks in the book
+func (ob *Orderbook) BestAsk() *Limit {
+    return ob.asks.Best()
+}
 
-    return ob.bids
+// Highest bid, nil if there are no bids in the book
+func (ob *Orderbook) BestBid() *Limit {
+    return ob.bids.Best()
 }
\ No newline at end of file
@@ -1,9 +1,13 @@
 package orderbook
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/kkomitski/exchange/decimal"
 )
 
 func assert(t *testing.T, a, b any) {
@@ -42,8 +46,8 @@ func TestOrderbook(t *testing.T) {
 	fmt.Println("ob", ob)
 
 	// fmt.Println("\n Total Bid Orders:", ob.Bids[0].Orders)
-	for i := 0; i < len(ob.bids); i++ {
-		fmt.Printf("\n Bid Price %v: %+v", i, ob.bids[i].Orders)
+	for i, limit := range ob.Bids() {
+		fmt.Printf("\n Bid Price %v: %+v", i, limit.Orders())
 	}
 }
 
@@ -62,7 +66,7 @@ func TestPlaceLimitOrder(t *testing.T){
 	assert(t, len(ob.Orders), 2)
 	assert(t, ob.Orders[sellOrder.ID], sellOrder)
 	assert(t, ob.Orders[sellOrderA.ID], sellOrderA)
-	assert(t, len(ob.asks), 2)
+	assert(t, ob.asks.Len(), 2)
 }
 
 func TestPlaceMarketOrder(t *testing.T){
@@ -78,11 +82,12 @@ func TestPlaceMarketOrder(t *testing.T){
 	buyOrderA := NewOrder(true, 10, 0)
 
 	// ob.PlaceMarketOrder(buyOrder)
-	matches := ob.PlaceMarketOrder(buyOrderA)
+	matches, err := ob.PlaceMarketOrder(buyOrderA, PartialFill)
+	assert(t, err, nil)
 
 	assert(t, len(matches), 1)
-	assert(t, len(ob.asks), 1)
-	assert(t, ob.AskTotalVolume(), 10.0)
+	assert(t, ob.asks.Len(), 1)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(10))
 	assert(t, matches[0].Ask, sellOrderA)
 	assert(t, matches[0].Bid, buyOrderA)
 	assert(t, buyOrderA.IsFilled(), true)
@@ -103,14 +108,15 @@ func TestPlaceMarketOrderMultifill(t *testing.T){
 	ob.PlaceLimitOrder(9_000, buyOrderB)
 	ob.PlaceLimitOrder(5_000, buyOrderD)
 
-	assert(t, ob.BidTotalVolume(), 24.00)
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(24))
 
 	sellOrder := NewOrder(false, 20, 0)
-	matches := ob.PlaceMarketOrder(sellOrder)
+	matches, err := ob.PlaceMarketOrder(sellOrder, PartialFill)
+	assert(t, err, nil)
 
-	assert(t, ob.BidTotalVolume(), 4.00)
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(4))
 	assert(t, len(matches), 3)
-	assert(t, len(ob.bids), 1)
+	assert(t, ob.bids.Len(), 1)
 
 	fmt.Println("\n\n bid limits:", ob.BidLimits)
 	fmt.Println("\n top limit:", ob.Bids()[0].Price)
@@ -121,16 +127,16 @@ func TestCancelOrderBid(t *testing.T){
 	ob := NewOrderbook()
 
 	buyOrder := NewOrder(true, 4, 22)
-	price := 10_000.0
+	price := decimal.Decimal(10_000)
 
 	ob.PlaceLimitOrder(price, buyOrder)
 
-	assert(t, ob.BidTotalVolume(), 4.0)
-	assert(t, len(ob.bids), 1)
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(4))
+	assert(t, ob.bids.Len(), 1)
 	
 	ob.CancelOrder(buyOrder)
-	assert(t, ob.BidTotalVolume(), 0.0)
-	assert(t, len(ob.bids), 0)
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(0))
+	assert(t, ob.bids.Len(), 0)
 
 	_, ok := ob.Orders[buyOrder.ID]
 	assert(t, ok, false)
@@ -143,16 +149,16 @@ func TestCancelOrderAsk(t *testing.T){
 	ob := NewOrderbook()
 
 	sellOrder := NewOrder(false, 4, 11)
-	price := 10_000.0
+	price := decimal.Decimal(10_000)
 
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	assert(t, ob.AskTotalVolume(), 4.0)
-	assert(t, len(ob.asks), 1)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(4))
+	assert(t, ob.asks.Len(), 1)
 	
 	ob.CancelOrder(sellOrder)
-	assert(t, ob.AskTotalVolume(), 0.0)
-	assert(t, len(ob.asks), 0)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(0))
+	assert(t, ob.asks.Len(), 0)
 
 	_, ok := ob.Orders[sellOrder.ID]
 	assert(t, ok, false)
@@ -163,14 +169,15 @@ func TestCancelOrderAsk(t *testing.T){
 
 func TestLastMarketTrades(t *testing.T){
 	ob := NewOrderbook()
-	price := 10_000.0
+	price := decimal.Decimal(10_000)
 
 	sellOrder := NewOrder(false, 10, 0)
 	ob.PlaceLimitOrder(price, sellOrder)
 
 	marketOrder := NewOrder(true, 10, 0)
 
-	matches := ob.PlaceMarketOrder(marketOrder)
+	matches, err := ob.PlaceMarketOrder(marketOrder, PartialFill)
+	assert(t, err, nil)
 	assert(t, len(matches), 1)
 	match := matches[0]
 
@@ -180,4 +187,1151 @@ func TestLastMarketTrades(t *testing.T){
 	assert(t, trade.Price, price)
 	assert(t, trade.Bid, marketOrder.Bid)
 	assert(t, trade.Size, match.SizeFilled)
-}
\ No newline at end of file
+}
+
+func TestPlaceLimitOrderCrossesBook(t *testing.T){
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, 5, 11)
+	sellOrderB := NewOrder(false, 5, 11)
+
+	ob.PlaceLimitOrder(10_000, sellOrderA)
+	ob.PlaceLimitOrder(11_000, sellOrderB)
+
+	// Crosses the first ask only, the rest should rest at the limit price
+	buyOrder := NewOrder(true, 8, 22)
+	matches := ob.PlaceLimitOrder(10_500, buyOrder)
+
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Price, decimal.Decimal(10_000))
+	assert(t, matches[0].SizeFilled, decimal.Decimal(5))
+	assert(t, buyOrder.Size, decimal.Decimal(3))
+
+	assert(t, ob.asks.Len(), 1)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(5))
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(3))
+	assert(t, ob.Bids()[0].Price, decimal.Decimal(10_500))
+	assert(t, ob.Orders[buyOrder.ID], buyOrder)
+
+	_, ok := ob.Orders[sellOrderA.ID]
+	assert(t, ok, false)
+	assert(t, len(ob.Trades), 1)
+}
+
+func TestPlaceLimitOrderFilledOnArrival(t *testing.T){
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 10, 11)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+
+	buyOrder := NewOrder(true, 4, 22)
+	matches := ob.PlaceLimitOrder(12_000, buyOrder)
+
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.IsFilled(), true)
+	assert(t, ob.bids.Len(), 0)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(6))
+
+	_, ok := ob.Orders[buyOrder.ID]
+	assert(t, ok, false)
+}
+
+func TestPlaceMarketOrderPartialFill(t *testing.T){
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 5, 11)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+
+	buyOrder := NewOrder(true, 8, 22)
+	matches, err := ob.PlaceMarketOrder(buyOrder, PartialFill)
+
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, matches[0].SizeFilled, decimal.Decimal(5))
+	assert(t, buyOrder.Size, decimal.Decimal(3))
+	assert(t, ob.asks.Len(), 0)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(0))
+}
+
+func TestPlaceMarketOrderRejectUnfilled(t *testing.T){
+	ob := NewOrderbook()
+
+	buyOrder := NewOrder(true, 5, 11)
+	ob.PlaceLimitOrder(10_000, buyOrder)
+
+	sellOrder := NewOrder(false, 8, 22)
+	matches, err := ob.PlaceMarketOrder(sellOrder, RejectUnfilled)
+
+	assert(t, len(matches), 0)
+	assert(t, err, &InsufficientLiquidityError{Bid: false, Requested: 8, Available: 5})
+
+	// Nothing should have been touched
+	assert(t, sellOrder.Size, decimal.Decimal(8))
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(5))
+	assert(t, len(ob.Trades), 0)
+}
+
+func TestPriceLevelsOrdering(t *testing.T){
+	ob := NewOrderbook()
+
+	for _, price := range []decimal.Decimal{12_000, 9_000, 15_000, 10_000, 9_000} {
+		ob.PlaceLimitOrder(price, NewOrder(false, 1, 11))
+	}
+
+	for _, price := range []decimal.Decimal{7_000, 8_000, 5_000, 8_000} {
+		ob.PlaceLimitOrder(price, NewOrder(true, 1, 22))
+	}
+
+	var askPrices, bidPrices []decimal.Decimal
+	for _, limit := range ob.Asks() {
+		askPrices = append(askPrices, limit.Price)
+	}
+	for _, limit := range ob.Bids() {
+		bidPrices = append(bidPrices, limit.Price)
+	}
+
+	assert(t, askPrices, []decimal.Decimal{9_000, 10_000, 12_000, 15_000})
+	assert(t, bidPrices, []decimal.Decimal{8_000, 7_000, 5_000})
+	assert(t, ob.BestAsk().Price, decimal.Decimal(9_000))
+	assert(t, ob.BestBid().Price, decimal.Decimal(8_000))
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(5))
+
+	// Clearing the best level promotes the next one
+	ob.CancelOrder(ob.BestBid().Front())
+	ob.CancelOrder(ob.BestBid().Front())
+	assert(t, ob.BestBid().Price, decimal.Decimal(7_000))
+	assert(t, ob.bids.Len(), 2)
+	assert(t, ob.bids.Get(8_000) == nil, true)
+	assert(t, ob.bids.Get(5_000).Price, decimal.Decimal(5_000))
+}
+
+// Fills one side of a book with n price levels, one order each
+func seedLevels(ob *Orderbook, bid bool, n int) []*Order {
+	orders := make([]*Order, n)
+
+	for i := 0; i < n; i++ {
+		orders[i] = NewOrder(bid, 1, 11)
+		ob.PlaceLimitOrder(decimal.Decimal(1_000_000+i), orders[i])
+	}
+
+	return orders
+}
+
+func BenchmarkPlaceLimitOrder10kLevels(b *testing.B) {
+	ob := NewOrderbook()
+	seedLevels(ob, false, 10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Spread the new levels through the existing ones without crossing
+		ob.PlaceLimitOrder(decimal.Decimal(1_000_000+(i*7919)%20_000), NewOrder(false, 1, 22))
+	}
+}
+
+func BenchmarkCancelOrder10kLevels(b *testing.B) {
+	ob := NewOrderbook()
+	orders := seedLevels(ob, true, 10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Cancel and re-place so the book stays at 10k levels
+		o := orders[(i*7919)%len(orders)]
+		price := o.Limit.Price
+		ob.CancelOrder(o)
+
+		orders[(i*7919)%len(orders)] = NewOrder(true, 1, 11)
+		ob.PlaceLimitOrder(price, orders[(i*7919)%len(orders)])
+	}
+}
+
+func BenchmarkBestBid10kLevels(b *testing.B) {
+	ob := NewOrderbook()
+	seedLevels(ob, true, 10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ob.BestBid() == nil {
+			b.Fatal("expected a best bid")
+		}
+	}
+}
+
+func BenchmarkBids10kLevels(b *testing.B) {
+	ob := NewOrderbook()
+	seedLevels(ob, true, 10_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.Bids()
+	}
+}
+
+func TestLimitFIFO(t *testing.T){
+	ob := NewOrderbook()
+	price := decimal.Decimal(10_000)
+
+	sellOrderA := NewOrder(false, 1, 11)
+	sellOrderB := NewOrder(false, 2, 22)
+	sellOrderC := NewOrder(false, 3, 33)
+
+	// Same wall-clock timestamp everywhere - only the sequence decides
+	sellOrderB.Timestamp = sellOrderA.Timestamp
+	sellOrderC.Timestamp = sellOrderA.Timestamp
+
+	ob.PlaceLimitOrder(price, sellOrderA)
+	ob.PlaceLimitOrder(price, sellOrderB)
+	ob.PlaceLimitOrder(price, sellOrderC)
+
+	limit := ob.AskLimits[price]
+	assert(t, limit.Orders(), Orders{sellOrderA, sellOrderB, sellOrderC})
+
+	// Removing from the middle keeps everybody else in place
+	_, _, err := ob.CancelOrderByID(sellOrderB.ID)
+	assert(t, err, nil)
+	assert(t, limit.Orders(), Orders{sellOrderA, sellOrderC})
+	assert(t, limit.TotalVolume, decimal.Decimal(4))
+
+	sellOrderD := NewOrder(false, 4, 11)
+	ob.PlaceLimitOrder(price, sellOrderD)
+
+	buyOrder := NewOrder(true, 5, 22)
+	matches, err := ob.PlaceMarketOrder(buyOrder, PartialFill)
+	assert(t, err, nil)
+	assert(t, len(matches), 3)
+	assert(t, matches[0].Ask, sellOrderA)
+	assert(t, matches[1].Ask, sellOrderC)
+	assert(t, matches[2].Ask, sellOrderD)
+	assert(t, limit.Orders(), Orders{sellOrderD})
+	assert(t, sellOrderD.Size, decimal.Decimal(3))
+
+	_, _, err = ob.CancelOrderByID(sellOrderB.ID)
+	assert(t, err, ErrOrderNotFound)
+}
+
+func TestSequencerIDs(t *testing.T){
+	seq := NewSequencer(SequencerState{})
+	obA := NewOrderbookWithSequencer(seq)
+	obB := NewOrderbookWithSequencer(seq)
+
+	sellOrder := NewOrder(false, 10, 11)
+	obA.PlaceLimitOrder(10_000, sellOrder)
+
+	buyOrder := NewOrder(true, 10, 22)
+	obB.PlaceLimitOrder(9_000, buyOrder)
+
+	// IDs come from the shared sequencer, never from the books themselves
+	assert(t, sellOrder.ID, int64(1))
+	assert(t, buyOrder.ID, int64(2))
+
+	marketOrder := NewOrder(true, 4, 33)
+	matches, err := obA.PlaceMarketOrder(marketOrder, PartialFill)
+	assert(t, err, nil)
+	assert(t, marketOrder.ID, int64(3))
+	assert(t, matches[0].TradeID, int64(1))
+	assert(t, obA.Trades[0].ID, int64(1))
+
+	// Picking up from a saved state keeps the IDs increasing
+	restored := NewOrderbookWithSequencer(NewSequencer(seq.State()))
+	next := NewOrder(false, 1, 11)
+	restored.PlaceLimitOrder(10_000, next)
+	assert(t, next.ID, int64(4))
+
+	// Skipping never goes backwards
+	seq.Skip(SequencerState{LastTradeID: 10, LastEventSeq: 7})
+	seq.Skip(SequencerState{LastOrderID: 2, LastTradeID: 5})
+	assert(t, seq.NextTradeID(), int64(11))
+	assert(t, seq.NextOrderID(), int64(4))
+	assert(t, seq.NextEventSeq(), uint64(8))
+}
+
+// A persisted sequencer saves ahead of what it hands out, a block at a time
+func TestSequencerPersist(t *testing.T){
+	var saved []SequencerState
+	seq := NewSequencer(SequencerState{LastOrderID: 5})
+	err := seq.Persist(func(s SequencerState) error {
+		saved = append(saved, s)
+		return nil
+	})
+	assert(t, err, nil)
+	assert(t, saved, []SequencerState{{LastOrderID: 5 + SequencerBlock, LastTradeID: SequencerBlock, LastEventSeq: SequencerBlock}})
+
+	for i := 0; i < SequencerBlock; i++ {
+		seq.NextOrderID()
+	}
+	assert(t, len(saved), 1)
+
+	// Past the reservation, saved before it's handed out
+	id := seq.NextOrderID()
+	assert(t, len(saved), 2)
+	assert(t, saved[1].LastOrderID, id+SequencerBlock)
+
+	// Restarting from any save never hands out an ID twice
+	restored := NewSequencer(saved[1])
+	assert(t, restored.NextOrderID() > id, true)
+
+	seq.Skip(SequencerState{LastTradeID: 5_000})
+	assert(t, len(saved), 3)
+	assert(t, saved[2].LastTradeID, int64(5_000+SequencerBlock))
+
+	failing := NewSequencer(SequencerState{})
+	fails := errors.New("disk full")
+	assert(t, failing.Persist(func(SequencerState) error { return fails }), fails)
+}
+
+func TestImmediateOrCancel(t *testing.T){
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 5, 11)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+
+	buyOrder := NewOrder(true, 8, 22)
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches := ob.PlaceLimitOrder(10_000, buyOrder)
+
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.Status, StatusCancelled)
+	assert(t, buyOrder.Filled, decimal.Decimal(5))
+	assert(t, buyOrder.Size, decimal.Decimal(3))
+	assert(t, sellOrder.Status, StatusFilled)
+
+	// The remainder must not rest
+	assert(t, ob.bids.Len(), 0)
+	_, ok := ob.Orders[buyOrder.ID]
+	assert(t, ok, false)
+}
+
+func TestFillOrKill(t *testing.T){
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, 5, 11)
+	sellOrderB := NewOrder(false, 5, 11)
+	ob.PlaceLimitOrder(10_000, sellOrderA)
+	ob.PlaceLimitOrder(11_000, sellOrderB)
+
+	// Only 5 available at or below the limit
+	buyOrder := NewOrder(true, 8, 22)
+	buyOrder.TimeInForce = FillOrKill
+	matches := ob.PlaceLimitOrder(10_500, buyOrder)
+
+	assert(t, len(matches), 0)
+	assert(t, buyOrder.Status, StatusKilled)
+	assert(t, buyOrder.Size, decimal.Decimal(8))
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(10))
+	assert(t, ob.bids.Len(), 0)
+
+	// Enough once the second level is in range
+	buyOrder = NewOrder(true, 8, 22)
+	buyOrder.TimeInForce = FillOrKill
+	matches = ob.PlaceLimitOrder(11_000, buyOrder)
+
+	assert(t, len(matches), 2)
+	assert(t, buyOrder.Status, StatusFilled)
+	assert(t, sellOrderA.Status, StatusFilled)
+	assert(t, sellOrderB.Status, StatusPartiallyFilled)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(2))
+}
+
+func TestPostOnly(t *testing.T){
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, 5, 11)
+	ob.PlaceLimitOrder(10_000, sellOrder)
+
+	// Doesn't cross - rests as usual
+	buyOrderA := NewOrder(true, 1, 22)
+	buyOrderA.PostOnly = PostOnlyReject
+	ob.PlaceLimitOrder(9_000, buyOrderA)
+
+	assert(t, buyOrderA.PostOnlyResult, PostOnlyAccepted)
+	assert(t, buyOrderA.Status, StatusOpen)
+	assert(t, buyOrderA.Limit.Price, decimal.Decimal(9_000))
+
+	// Would take the ask
+	buyOrderB := NewOrder(true, 1, 22)
+	buyOrderB.PostOnly = PostOnlyReject
+	matches := ob.PlaceLimitOrder(10_000, buyOrderB)
+
+	assert(t, len(matches), 0)
+	assert(t, buyOrderB.PostOnlyResult, PostOnlyRejected)
+	assert(t, buyOrderB.Status, StatusRejected)
+	assert(t, sellOrder.Size, decimal.Decimal(5))
+
+	// Pushed one tick behind the best ask
+	buyOrderC := NewOrder(true, 1, 22)
+	buyOrderC.PostOnly = PostOnlyReprice
+	matches = ob.PlaceLimitOrder(10_500, buyOrderC)
+
+	assert(t, len(matches), 0)
+	assert(t, buyOrderC.PostOnlyResult, PostOnlyRepriced)
+	assert(t, buyOrderC.Limit.Price, decimal.Decimal(9_999))
+	assert(t, ob.BestBid().Price, decimal.Decimal(9_999))
+
+	sellOrderB := NewOrder(false, 1, 11)
+	sellOrderB.PostOnly = PostOnlyReprice
+	ob.PlaceLimitOrder(9_000, sellOrderB)
+
+	assert(t, sellOrderB.PostOnlyResult, PostOnlyRepriced)
+	assert(t, sellOrderB.Limit.Price, decimal.Decimal(10_000))
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(6))
+}
+
+func TestStopOrders(t *testing.T){
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 5, 11))
+	ob.PlaceLimitOrder(11_000, NewOrder(false, 5, 11))
+	ob.PlaceLimitOrder(9_000, NewOrder(true, 5, 22))
+
+	// Buy stop above the market, sell stop-limit below it
+	buyStop := NewOrder(true, 3, 33)
+	matches := ob.PlaceStopOrder(buyStop, Stop{Price: 10_000})
+	assert(t, len(matches), 0)
+	assert(t, buyStop.Status, StatusPending)
+
+	sellStop := NewOrder(false, 2, 33)
+	ob.PlaceStopOrder(sellStop, Stop{Price: 9_000, LimitPrice: 8_500})
+	assert(t, len(ob.Stops()), 2)
+
+	// Stops stay out of the visible book
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(10))
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(5))
+
+	// Trading at 10_000 fires the buy stop, which takes the rest of the level
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 1, 22), PartialFill)
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, matches[1].Bid, buyStop)
+	assert(t, matches[1].SizeFilled, decimal.Decimal(3))
+	assert(t, buyStop.Status, StatusFilled)
+	assert(t, ob.Stops(), []*Order{sellStop})
+
+	// Trading down to 9_000 fires the sell stop-limit, it fills and rests the rest
+	ob.PlaceMarketOrder(NewOrder(false, 4, 11), PartialFill)
+	assert(t, sellStop.Status, StatusPartiallyFilled)
+	assert(t, sellStop.Limit.Price, decimal.Decimal(8_500))
+	assert(t, len(ob.Stops()), 0)
+}
+
+func TestStopOrderCancel(t *testing.T){
+	ob := NewOrderbook()
+
+	stop := NewOrder(false, 1, 11)
+	ob.PlaceStopOrder(stop, Stop{Price: 9_000})
+
+	cancelled, _, err := ob.CancelOrderByID(stop.ID)
+	assert(t, err, nil)
+	assert(t, cancelled, stop)
+	assert(t, stop.Status, StatusCancelled)
+	assert(t, len(ob.Stops()), 0)
+}
+
+func TestTrailingStop(t *testing.T){
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 1, 11))
+	ob.PlaceLimitOrder(10_500, NewOrder(false, 1, 11))
+	ob.PlaceLimitOrder(9_000, NewOrder(true, 5, 22))
+
+	// No trades yet, so nothing to trail
+	buyStop := NewOrder(true, 1, 33)
+	ob.PlaceStopOrder(buyStop, Stop{Trail: &Trail{Percent: PercentScale.FromInt(10)}})
+	assert(t, buyStop.Stop.Trail.Extreme, decimal.Decimal(0))
+	ob.CancelOrderByID(buyStop.ID)
+
+	ob.PlaceMarketOrder(NewOrder(true, 1, 22), PartialFill)
+
+	// Starts trailing from the last trade at 10_000
+	sellStop := NewOrder(false, 2, 33)
+	ob.PlaceStopOrder(sellStop, Stop{Trail: &Trail{Amount: 500}})
+	assert(t, sellStop.Stop.Price, decimal.Decimal(9_500))
+
+	// Price goes up, the trigger follows
+	ob.PlaceMarketOrder(NewOrder(true, 1, 22), PartialFill)
+	assert(t, sellStop.Stop.Trail.Extreme, decimal.Decimal(10_500))
+	assert(t, sellStop.Stop.Price, decimal.Decimal(10_000))
+
+	// Trading down through it fires the stop
+	matches, err := ob.PlaceMarketOrder(NewOrder(false, 1, 11), PartialFill)
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, matches[1].Ask, sellStop)
+	assert(t, sellStop.Status, StatusFilled)
+	assert(t, sellStop.Stop.Price, decimal.Decimal(10_000))
+	assert(t, len(ob.Stops()), 0)
+}
+
+func TestIcebergOrder(t *testing.T){
+	ob := NewOrderbook()
+
+	iceberg := NewOrder(false, 10, 11)
+	iceberg.Display = 3
+	ob.PlaceLimitOrder(100, iceberg)
+
+	regular := NewOrder(false, 2, 22)
+	ob.PlaceLimitOrder(100, regular)
+
+	// Only the slice on show counts as displayed, matching sees everything
+	assert(t, ob.AskDisplayVolume(), decimal.Decimal(5))
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(12))
+	assert(t, iceberg.Visible(), decimal.Decimal(3))
+
+	// Using up the slice sends the iceberg to the back of the queue
+	matches := ob.PlaceLimitOrder(100, NewOrder(true, 4, 33))
+	assert(t, len(matches), 2)
+	assert(t, matches[0].SizeFilled, decimal.Decimal(3))
+	assert(t, matches[1].Ask, regular)
+	assert(t, ob.AskLimits[100].Orders(), Orders{regular, iceberg})
+	assert(t, iceberg.Size, decimal.Decimal(7))
+	assert(t, ob.AskLimits[100].DisplayVolume, decimal.Decimal(4))
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(8))
+
+	// A big enough order keeps refreshing it until it is gone
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, 8, 33), RejectUnfilled)
+	assert(t, err, nil)
+	assert(t, len(matches), 4)
+	assert(t, iceberg.Status, StatusFilled)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(0))
+	assert(t, len(ob.Asks()), 0)
+}
+
+func TestExpireOrders(t *testing.T){
+	ob := NewOrderbook()
+
+	gtd := NewOrder(true, 1, 11)
+	gtd.TimeInForce = GoodTillDate
+	gtd.ExpiresAt = 1_000
+	ob.PlaceLimitOrder(90, gtd)
+
+	day := NewOrder(true, 1, 11)
+	day.TimeInForce = Day
+	day.ExpiresAt = 2_000
+	ob.PlaceLimitOrder(90, day)
+
+	gtc := NewOrder(true, 1, 22)
+	ob.PlaceLimitOrder(90, gtc)
+
+	stop := NewOrder(false, 1, 11)
+	stop.TimeInForce = GoodTillDate
+	stop.ExpiresAt = 1_000
+	ob.PlaceStopOrder(stop, Stop{Price: 80})
+
+	expired, _ := ob.ExpireOrders(999)
+	assert(t, len(expired), 0)
+
+	expired, _ = ob.ExpireOrders(1_000)
+	assert(t, expired, []*Order{gtd, stop})
+	assert(t, gtd.Status, StatusExpired)
+	assert(t, stop.Status, StatusExpired)
+	assert(t, len(ob.Stops()), 0)
+	assert(t, ob.BidTotalVolume(), decimal.Decimal(2))
+
+	expired, _ = ob.ExpireOrders(5_000)
+	assert(t, expired, []*Order{day})
+	assert(t, ob.BestBid().Orders(), Orders{gtc})
+	assert(t, len(ob.Orders), 1)
+}
+
+// An OCO leg that expires takes its siblings with it, even ones that would
+// expire at the same time
+func TestExpireOCOLeg(t *testing.T){
+	ob := NewOrderbook()
+
+	gtd := func(expiresAt int64) *Order {
+		o := NewOrder(false, 1, 11)
+		o.TimeInForce = GoodTillDate
+		o.ExpiresAt = expiresAt
+		return o
+	}
+
+	takeProfit, stopLoss := gtd(1_000), NewOrder(false, 1, 11)
+	ob.PlaceOrderGroup(&OrderGroup{
+		Type: OneCancelsOther,
+		Legs: []*GroupLeg{
+			{Order: takeProfit, Price: 120},
+			{Order: stopLoss, Stop: &Stop{Price: 80}},
+		},
+	})
+
+	expired, _ := ob.ExpireOrders(1_000)
+	assert(t, expired, []*Order{takeProfit})
+	assert(t, stopLoss.Status, StatusCancelled)
+	assert(t, len(ob.Stops()), 0)
+
+	first, second := gtd(1_000), gtd(1_000)
+	ob.PlaceOrderGroup(&OrderGroup{
+		Type: OneCancelsOther,
+		Legs: []*GroupLeg{
+			{Order: first, Price: 120},
+			{Order: second, Price: 130},
+		},
+	})
+
+	expired, _ = ob.ExpireOrders(2_000)
+	assert(t, expired, []*Order{first})
+	assert(t, second.Status, StatusCancelled)
+	assert(t, len(ob.Orders), 0)
+}
+
+func TestAmendOrder(t *testing.T){
+	ob := NewOrderbook()
+
+	first := NewOrder(true, 5, 11)
+	second := NewOrder(true, 5, 22)
+	ob.PlaceLimitOrder(100, first)
+	ob.PlaceLimitOrder(100, second)
+
+	// Reducing the size keeps the place in the queue
+	_, matches, err := ob.AmendOrder(first.ID, 0, 3)
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, ob.BidLimits[100].Orders(), Orders{first, second})
+	assert(t, ob.BidLimits[100].TotalVolume, decimal.Decimal(8))
+
+	// Increasing it goes to the back
+	ob.AmendOrder(first.ID, 0, 4)
+	assert(t, ob.BidLimits[100].Orders(), Orders{second, first})
+	assert(t, ob.BidLimits[100].TotalVolume, decimal.Decimal(9))
+
+	// So does a new price, keeping the ID
+	id := second.ID
+	ob.AmendOrder(second.ID, 101, 0)
+	assert(t, second.ID, id)
+	assert(t, ob.BestBid().Orders(), Orders{second})
+	assert(t, ob.Orders[id], second)
+	assert(t, ob.BidLimits[100].Orders(), Orders{first})
+
+	// A price through the spread matches straight away
+	ask := NewOrder(false, 2, 33)
+	ob.PlaceLimitOrder(110, ask)
+	amended, matches, err := ob.AmendOrder(second.ID, 110, 0)
+	assert(t, err, nil)
+	assert(t, amended, second)
+	assert(t, len(matches), 1)
+	assert(t, second.Status, StatusPartiallyFilled)
+	assert(t, second.Limit.Price, decimal.Decimal(110))
+
+	_, _, err = ob.AmendOrder(ask.ID, 0, 1)
+	assert(t, err, ErrOrderNotFound)
+}
+
+func TestSelfTradePrevention(t *testing.T){
+	place := func(mode SelfTradePrevention, restingSize, incomingSize decimal.Decimal) (*Orderbook, *Order, *Order, []Match) {
+		ob := NewOrderbook()
+
+		resting := NewOrder(false, restingSize, 22)
+		ob.PlaceLimitOrder(100, resting)
+		ob.PlaceLimitOrder(100, NewOrder(false, 5, 11))
+
+		incoming := NewOrder(true, incomingSize, 22)
+		incoming.SelfTradePrevention = mode
+		matches := ob.PlaceLimitOrder(100, incoming)
+
+		return ob, resting, incoming, matches
+	}
+
+	// Newest is cancelled, nothing trades
+	ob, resting, incoming, matches := place(CancelNewest, 3, 2)
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Prevented, CancelNewest)
+	assert(t, matches[0].SizePrevented, decimal.Decimal(2))
+	assert(t, matches[0].IsTrade(), false)
+	assert(t, incoming.Status, StatusCancelled)
+	assert(t, resting.Status, StatusOpen)
+	assert(t, len(ob.Trades), 0)
+	assert(t, len(ob.Bids()), 0)
+
+	// Oldest is cancelled, the incoming order carries on to the next user
+	ob, resting, incoming, matches = place(CancelOldest, 3, 2)
+	assert(t, len(matches), 2)
+	assert(t, resting.Status, StatusCancelled)
+	assert(t, matches[1].SizeFilled, decimal.Decimal(2))
+	assert(t, incoming.Status, StatusFilled)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(3))
+
+	ob, resting, incoming, _ = place(CancelBoth, 3, 2)
+	assert(t, resting.Status, StatusCancelled)
+	assert(t, incoming.Status, StatusCancelled)
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(5))
+
+	// The smaller order is cancelled, the bigger one shrinks and keeps going
+	ob, resting, incoming, matches = place(DecrementAndCancel, 3, 4)
+	assert(t, matches[0].SizePrevented, decimal.Decimal(3))
+	assert(t, resting.Status, StatusCancelled)
+	assert(t, matches[1].SizeFilled, decimal.Decimal(1))
+	assert(t, incoming.Status, StatusFilled)
+	assert(t, incoming.Filled, decimal.Decimal(1))
+	assert(t, ob.AskTotalVolume(), decimal.Decimal(4))
+}
+
+// Volume self-trade prevention takes out of the book can't fill a FOK order
+func TestFillOrKillSelfTradePrevention(t *testing.T){
+	for _, mode := range []SelfTradePrevention{CancelNewest, CancelOldest, CancelBoth, DecrementAndCancel} {
+		ob := NewOrderbook()
+
+		ob.PlaceLimitOrder(100, NewOrder(false, 5, 22))
+		ob.PlaceLimitOrder(100, NewOrder(false, 5, 11))
+
+		incoming := NewOrder(true, 10, 22)
+		incoming.TimeInForce = FillOrKill
+		incoming.SelfTradePrevention = mode
+		matches := ob.PlaceLimitOrder(100, incoming)
+
+		assert(t, len(matches), 0)
+		assert(t, incoming.Status, StatusKilled)
+		assert(t, ob.AskTotalVolume(), decimal.Decimal(10))
+		assert(t, len(ob.Bids()), 0)
+	}
+
+	// The other user's 5 is behind the user's own order, which cancels the
+	// incoming one before it gets there
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 22))
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 11))
+
+	incoming := NewOrder(true, 5, 22)
+	incoming.TimeInForce = FillOrKill
+	incoming.SelfTradePrevention = CancelNewest
+	ob.PlaceLimitOrder(100, incoming)
+	assert(t, incoming.Status, StatusKilled)
+
+	// Enough without the user's own order
+	incoming = NewOrder(true, 5, 22)
+	incoming.TimeInForce = FillOrKill
+	incoming.SelfTradePrevention = CancelOldest
+	ob.PlaceLimitOrder(100, incoming)
+	assert(t, incoming.Status, StatusFilled)
+	assert(t, len(ob.Bids()), 0)
+}
+
+func TestOCOGroup(t *testing.T){
+	ob := NewOrderbook()
+
+	takeProfit := NewOrder(false, 2, 11)
+	stopLoss := NewOrder(false, 2, 11)
+
+	group := &OrderGroup{
+		Type: OneCancelsOther,
+		Legs: []*GroupLeg{
+			{Order: takeProfit, Price: 110},
+			{Order: stopLoss, Stop: &Stop{Price: 90}},
+		},
+	}
+	matches := ob.PlaceOrderGroup(group)
+	assert(t, len(matches), 0)
+	assert(t, takeProfit.Group, group)
+	assert(t, stopLoss.Status, StatusPending)
+
+	// A partial fill of the take profit cancels the stop
+	ob.PlaceMarketOrder(NewOrder(true, 1, 22), PartialFill)
+	assert(t, takeProfit.Status, StatusPartiallyFilled)
+	assert(t, stopLoss.Status, StatusCancelled)
+	assert(t, len(ob.Stops()), 0)
+
+	// Cancelling one leg of another group cancels the other
+	other := &OrderGroup{
+		Type: OneCancelsOther,
+		Legs: []*GroupLeg{
+			{Order: NewOrder(true, 1, 11), Price: 50},
+			{Order: NewOrder(true, 1, 11), Stop: &Stop{Price: 200}},
+		},
+	}
+	ob.PlaceOrderGroup(other)
+	ob.CancelOrderByID(other.Legs[0].Order.ID)
+	assert(t, other.Legs[1].Order.Status, StatusCancelled)
+	assert(t, len(ob.Stops()), 0)
+}
+
+func TestBracketGroup(t *testing.T){
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 22))
+
+	entry := NewOrder(true, 2, 11)
+	takeProfit := NewOrder(false, 2, 11)
+	stopLoss := NewOrder(false, 2, 11)
+
+	group := &OrderGroup{
+		Type: Bracket,
+		Entry: &GroupLeg{Order: entry, Price: 100},
+		Legs: []*GroupLeg{
+			{Order: takeProfit, Price: 120},
+			{Order: stopLoss, Stop: &Stop{Price: 80}},
+		},
+	}
+
+	// Entry only partly fills, the legs keep waiting
+	matches := ob.PlaceOrderGroup(group)
+	assert(t, len(matches), 1)
+	assert(t, entry.Status, StatusPartiallyFilled)
+	assert(t, takeProfit.Status, StatusPending)
+	assert(t, takeProfit.Limit, (*Limit)(nil))
+	assert(t, len(ob.Stops()), 0)
+
+	// Once it fills the legs go in
+	ob.PlaceMarketOrder(NewOrder(false, 1, 22), PartialFill)
+	assert(t, entry.Status, StatusFilled)
+	assert(t, takeProfit.Status, StatusOpen)
+	assert(t, takeProfit.Limit.Price, decimal.Decimal(120))
+	assert(t, ob.Stops(), []*Order{stopLoss})
+
+	// and the take profit filling cancels the stop
+	ob.PlaceMarketOrder(NewOrder(true, 2, 22), PartialFill)
+	assert(t, takeProfit.Status, StatusFilled)
+	assert(t, stopLoss.Status, StatusCancelled)
+}
+
+// A leg still waiting for its entry can be cancelled by its ID, which takes
+// the whole bracket with it
+func TestBracketPendingLegCancel(t *testing.T){
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 22))
+
+	entry := NewOrder(true, 2, 11)
+	takeProfit := NewOrder(false, 2, 11)
+	stopLoss := NewOrder(false, 2, 11)
+
+	ob.PlaceOrderGroup(&OrderGroup{
+		Type: Bracket,
+		Entry: &GroupLeg{Order: entry, Price: 100},
+		Legs: []*GroupLeg{
+			{Order: takeProfit, Price: 120},
+			{Order: stopLoss, Stop: &Stop{Price: 80}},
+		},
+	})
+	assert(t, entry.Status, StatusPartiallyFilled)
+
+	o, matches, err := ob.CancelOrderByID(stopLoss.ID)
+	assert(t, err, nil)
+	assert(t, o, stopLoss)
+	assert(t, len(matches), 0)
+
+	// Nothing goes in for the part of the entry that filled
+	for _, o := range []*Order{entry, takeProfit, stopLoss} {
+		assert(t, o.Status, StatusCancelled)
+	}
+	assert(t, ob.BestBid(), (*Limit)(nil))
+	assert(t, ob.BestAsk(), (*Limit)(nil))
+	assert(t, len(ob.Stops()), 0)
+
+	_, _, err = ob.CancelOrderByID(takeProfit.ID)
+	assert(t, err, ErrOrderNotFound)
+}
+
+// Legs of an entry that finishes without filling completely go in for what
+// it did fill, or not at all
+func TestBracketEntryDone(t *testing.T){
+	bracket := func(entry *GroupLeg) *OrderGroup {
+		return &OrderGroup{
+			Type: Bracket,
+			Entry: entry,
+			Legs: []*GroupLeg{
+				{Order: NewOrder(false, 2, 11), Price: 120},
+				{Order: NewOrder(false, 2, 11), Stop: &Stop{Price: 80}},
+			},
+		}
+	}
+
+	// Market entry that only finds 1 of 2
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 22))
+
+	group := bracket(&GroupLeg{Order: NewOrder(true, 2, 11), Market: true})
+	ob.PlaceOrderGroup(group)
+	takeProfit, stopLoss := group.Legs[0].Order, group.Legs[1].Order
+	assert(t, group.Entry.Order.Status, StatusCancelled)
+	assert(t, takeProfit.Status, StatusOpen)
+	assert(t, takeProfit.Size, decimal.Decimal(1))
+	assert(t, stopLoss.Size, decimal.Decimal(1))
+	assert(t, ob.Stops(), []*Order{stopLoss})
+
+	// Killed entry takes the legs with it
+	entry := NewOrder(true, 2, 11)
+	entry.TimeInForce = FillOrKill
+	group = bracket(&GroupLeg{Order: entry, Price: 100})
+	ob.PlaceOrderGroup(group)
+	assert(t, entry.Status, StatusKilled)
+	for _, leg := range group.Legs {
+		assert(t, leg.Order.Status, StatusCancelled)
+	}
+	assert(t, len(ob.Stops()), 1)
+
+	// Cancelling a partly filled entry arms the legs for the part that filled
+	ob = NewOrderbook()
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 22))
+
+	entry = NewOrder(true, 2, 11)
+	group = bracket(&GroupLeg{Order: entry, Price: 100})
+	ob.PlaceOrderGroup(group)
+	assert(t, entry.Status, StatusPartiallyFilled)
+	assert(t, group.Legs[0].Order.Status, StatusPending)
+
+	_, _, err := ob.CancelOrderByID(entry.ID)
+	assert(t, err, nil)
+	assert(t, group.Legs[0].Order.Status, StatusOpen)
+	assert(t, group.Legs[0].Order.Size, decimal.Decimal(1))
+	assert(t, ob.Stops(), []*Order{group.Legs[1].Order})
+}
+
+func TestPeggedOrder(t *testing.T){
+	ob := NewOrderbook()
+
+	// Nothing to peg to yet
+	rejected := NewOrder(true, 1, 22)
+	ob.PlacePeggedOrder(rejected, Peg{Reference: PegBestBid})
+	assert(t, rejected.Status, StatusRejected)
+
+	ob.PlaceLimitOrder(100, NewOrder(true, 1, 11))
+	ob.PlaceLimitOrder(110, NewOrder(false, 1, 11))
+
+	bid := NewOrder(true, 2, 22)
+	ob.PlacePeggedOrder(bid, Peg{Reference: PegBestBid})
+	assert(t, bid.Limit.Price, decimal.Decimal(100))
+
+	// Mid is 105, the cap keeps it at 106
+	ask := NewOrder(false, 2, 22)
+	ob.PlacePeggedOrder(ask, Peg{Reference: PegMid, Offset: -3, Cap: 106})
+	assert(t, ask.Limit.Price, decimal.Decimal(106))
+
+	// A better bid moves the peg, which goes behind it like an amend would
+	other := NewOrder(true, 1, 33)
+	ob.PlaceLimitOrder(103, other)
+	assert(t, bid.Limit.Price, decimal.Decimal(103))
+	assert(t, ob.BidLimits[103].Orders(), Orders{other, bid})
+	assert(t, len(ob.BidLimits), 2)
+
+	// Mid moves to 111 once the ask at 110 is gone
+	ob.PlaceLimitOrder(120, NewOrder(false, 1, 11))
+	ob.CancelOrderByID(ob.AskLimits[110].Front().ID)
+	assert(t, ask.Limit.Price, decimal.Decimal(108))
+
+	// Pegs never cross - they stop one tick behind the other side
+	ob.PlacePeggedOrder(NewOrder(true, 1, 33), Peg{Reference: PegBestBid, Offset: 50})
+	assert(t, ob.BestBid().Price, decimal.Decimal(107))
+
+	_, _, err := ob.AmendOrder(bid.ID, 90, 0)
+	assert(t, err, ErrAmendPegged)
+}
+
+// Orders the book sends in by itself are cancelled if the owner won't fund
+// them
+func TestFundRefused(t *testing.T){
+	ob := NewOrderbook()
+
+	var asked []decimal.Decimal
+	ob.Fund = func(o *Order, price decimal.Decimal) error {
+		asked = append(asked, price)
+		if o.UserID == 33 {
+			return errors.New("no funds")
+		}
+		return nil
+	}
+
+	ob.PlaceLimitOrder(100, NewOrder(true, 1, 11))
+	ob.PlaceLimitOrder(110, NewOrder(false, 5, 11))
+
+	stop := NewOrder(true, 1, 33)
+	ob.PlaceStopOrder(stop, Stop{Price: 110, LimitPrice: 115})
+
+	peg := NewOrder(true, 1, 33)
+	ob.PlacePeggedOrder(peg, Peg{Reference: PegBestBid})
+	assert(t, peg.Limit.Price, decimal.Decimal(100))
+
+	// Trades at 110 and fires the stop. A better bid moves the peg.
+	ob.PlaceMarketOrder(NewOrder(true, 1, 22), PartialFill)
+	ob.PlaceLimitOrder(105, NewOrder(true, 1, 22))
+
+	assert(t, stop.Status, StatusCancelled)
+	assert(t, stop.Filled, decimal.Decimal(0))
+	assert(t, peg.Status, StatusCancelled)
+	assert(t, peg.Limit == nil, true)
+	assert(t, len(ob.BidLimits[105].Orders()), 1)
+	assert(t, asked, []decimal.Decimal{115, 105})
+}
+
+func TestAuction(t *testing.T){
+	ob := NewOrderbook()
+	ob.StartAuction()
+
+	bigBid := NewOrder(true, 10, 11)
+	smallBid := NewOrder(true, 5, 11)
+	ob.PlaceLimitOrder(102, bigBid)
+	ob.PlaceLimitOrder(101, smallBid)
+	ob.PlaceLimitOrder(100, NewOrder(false, 8, 22))
+	ob.PlaceLimitOrder(101, NewOrder(false, 6, 22))
+
+	// Crossed, but nothing trades until the uncross
+	assert(t, len(ob.Trades), 0)
+	assert(t, ob.BestBid().Price, decimal.Decimal(102))
+	assert(t, ob.BestAsk().Price, decimal.Decimal(100))
+
+	// 100 executes 8, 101 executes 14 and 102 executes 10
+	assert(t, ob.Indicative(), AuctionState{Price: 101, Volume: 14, Imbalance: 1})
+
+	_, err := ob.PlaceMarketOrder(NewOrder(true, 1, 33), PartialFill)
+	assert(t, err, ErrInAuction)
+
+	ioc := NewOrder(true, 1, 33)
+	ioc.TimeInForce = ImmediateOrCancel
+	ob.PlaceLimitOrder(105, ioc)
+	assert(t, ioc.Status, StatusCancelled)
+
+	pegged := NewOrder(true, 1, 33)
+	ob.PlacePeggedOrder(pegged, Peg{Reference: PegBestBid})
+	assert(t, pegged.Status, StatusRejected)
+
+	state, matches := ob.Uncross()
+	assert(t, state.Price, decimal.Decimal(101))
+	assert(t, ob.InAuction(), false)
+	assert(t, len(matches), 3)
+	assert(t, len(ob.Trades), 3)
+
+	for _, match := range matches {
+		assert(t, match.Price, decimal.Decimal(101))
+	}
+
+	// The bid surplus stays in the book and the book is no longer crossed
+	assert(t, bigBid.Status, StatusFilled)
+	assert(t, smallBid.Status, StatusPartiallyFilled)
+	assert(t, smallBid.Size, decimal.Decimal(1))
+	assert(t, ob.BestAsk() == nil, true)
+
+	// Continuous matching again
+	matches = ob.PlaceLimitOrder(101, NewOrder(false, 1, 22))
+	assert(t, len(matches), 1)
+}
+
+func TestAuctionTieBreaks(t *testing.T){
+	// 100 and 101 both execute 5 with 5 bids left over - market pressure
+	// takes the higher price
+	ob := NewOrderbook()
+	ob.StartAuction()
+	ob.PlaceLimitOrder(101, NewOrder(true, 10, 11))
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 22))
+	assert(t, ob.Indicative(), AuctionState{Price: 101, Volume: 5, Imbalance: 5})
+
+	// No imbalance at either price - without a last trade the price is in the
+	// middle, with one it's as close to it as possible
+	ob = NewOrderbook()
+	ob.StartAuction()
+	ob.PlaceLimitOrder(102, NewOrder(true, 5, 11))
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 22))
+	assert(t, ob.Indicative().Price, decimal.Decimal(101))
+
+	ob.Trades = append(ob.Trades, &Trade{Price: 110})
+	assert(t, ob.Indicative().Price, decimal.Decimal(102))
+
+	// Nothing crosses
+	ob = NewOrderbook()
+	ob.StartAuction()
+	ob.PlaceLimitOrder(99, NewOrder(true, 5, 11))
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 22))
+	assert(t, ob.Indicative(), AuctionState{})
+
+	_, matches := ob.Uncross()
+	assert(t, len(matches), 0)
+}
+
+func TestPriceBand(t *testing.T){
+	ob := NewOrderbook()
+	ob.Band = &PriceBand{Percent: 1000, Reference: BandLastTrade}
+
+	// No band before the first trade
+	_, _, ok := ob.BandLimits()
+	assert(t, ok, false)
+
+	ob.PlaceLimitOrder(100, NewOrder(false, 1, 22))
+	ob.PlaceLimitOrder(105, NewOrder(false, 1, 22))
+	ob.PlaceLimitOrder(120, NewOrder(false, 1, 22))
+
+	ob.PlaceMarketOrder(NewOrder(true, 1, 11), PartialFill)
+
+	// 10% either side of the last trade at 100
+	lo, hi, _ := ob.BandLimits()
+	assert(t, lo, decimal.Decimal(90))
+	assert(t, hi, decimal.Decimal(110))
+
+	// Stops at the band instead of sweeping up to 120
+	sweep := NewOrder(true, 5, 11)
+	matches, err := ob.PlaceMarketOrder(sweep, PartialFill)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, sweep.Filled, decimal.Decimal(1))
+	assert(t, sweep.Status, StatusCancelled)
+	assert(t, ob.BestAsk().Price, decimal.Decimal(120))
+
+	_, err = ob.PlaceMarketOrder(NewOrder(true, 1, 11), RejectUnfilled)
+	assert(t, err, &InsufficientLiquidityError{Bid: true, Requested: 1, Available: 0})
+
+	// The band is now 95 to 115
+	outside := NewOrder(false, 1, 22)
+	ob.PlaceLimitOrder(80, outside)
+	assert(t, outside.Status, StatusRejected)
+
+	bid := NewOrder(true, 1, 11)
+	ob.PlaceLimitOrder(110, bid)
+	assert(t, bid.Status, StatusOpen)
+
+	_, _, err = ob.AmendOrder(bid.ID, 130, 0)
+	assert(t, err, ErrOutsideBand)
+	assert(t, bid.Limit.Price, decimal.Decimal(110))
+}
+
+// Nothing goes in the book outside the band, however its price is set
+func TestPriceBandRestingPrices(t *testing.T){
+	ob := NewOrderbook()
+	ob.Band = &PriceBand{Percent: 1000, Reference: BandLastTrade}
+
+	// Rests before there is a band, which then goes 90 to 110
+	stale := NewOrder(false, 1, 11)
+	ob.PlaceLimitOrder(85, stale)
+	ob.Trades = []*Trade{{ID: 1, Price: 100, Size: 1}}
+
+	// Repriced to 84, a tick behind the ask
+	postOnly := NewOrder(true, 1, 22)
+	postOnly.PostOnly = PostOnlyReprice
+	ob.PlaceLimitOrder(95, postOnly)
+	assert(t, postOnly.Status, StatusRejected)
+	assert(t, postOnly.PostOnlyResult, PostOnlyRepriced)
+	assert(t, postOnly.Limit == nil, true)
+
+	pegged := NewOrder(false, 1, 22)
+	_, err := ob.PlacePeggedOrder(pegged, Peg{Reference: PegBestAsk, Offset: 30})
+	assert(t, err, ErrOutsideBand)
+	assert(t, pegged.Status, StatusRejected)
+	assert(t, pegged.Limit == nil, true)
+
+	ob.CancelOrderByID(stale.ID)
+	ob.PlaceLimitOrder(95, NewOrder(true, 1, 11))
+
+	follower := NewOrder(true, 1, 22)
+	_, err = ob.PlacePeggedOrder(follower, Peg{Reference: PegBestBid, Offset: 10})
+	assert(t, err, nil)
+	assert(t, follower.Limit.Price, decimal.Decimal(105))
+
+	// Following the bid to 113 would leave the band
+	ob.PlaceLimitOrder(103, NewOrder(true, 1, 33))
+	assert(t, follower.Limit.Price, decimal.Decimal(105))
+}
+
+func TestPriceBandVWAP(t *testing.T){
+	ob := NewOrderbook()
+	ob.Band = &PriceBand{Percent: 1000, Reference: BandVWAP, Window: time.Minute}
+
+	now := time.Now().UnixNano()
+	ob.Trades = []*Trade{
+		// Too old to count
+		{ID: 1, Price: 1000, Size: 100, Timestamp: now - 2*time.Minute.Nanoseconds()},
+		{ID: 2, Price: 100, Size: 3, Timestamp: now},
+		{ID: 3, Price: 200, Size: 1, Timestamp: now},
+	}
+
+	lo, hi, _ := ob.BandLimits()
+	assert(t, lo, decimal.Decimal(113))
+	assert(t, hi, decimal.Decimal(137))
+
+	// From 100 to 200 is a 100% move
+	assert(t, ob.PriceMove(time.Minute, 0), decimal.Decimal(10_000))
+	assert(t, ob.PriceMove(time.Minute, 2), decimal.Decimal(0))
+	assert(t, ob.LastTradeID(), int64(3))
+}
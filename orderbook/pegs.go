@@ -0,0 +1,172 @@
+package orderbook
+
+import "github.com/kkomitski/exchange/decimal"
+
+// Price a pegged order follows
+type PegReference string
+
+const (
+	PegBestBid PegReference = "BEST_BID"
+	PegBestAsk PegReference = "BEST_ASK"
+	// Halfway between the best bid and the best ask
+	PegMid PegReference = "MID"
+)
+
+// Prices a limit order off the touch. The reference only looks at orders that
+// aren't pegged themselves, so pegged orders can't chase each other around.
+type Peg struct {
+	Reference PegReference    `json:"reference"`
+	Offset    decimal.Decimal `json:"offset"` // Added to the reference, negative to go below it
+	// Highest price for a bid, lowest for an ask - zero for no cap
+	Cap decimal.Decimal `json:"cap,omitempty"`
+}
+
+// Rests the order at its pegged price and keeps it there as the book moves.
+// Pegged orders only ever add liquidity - one that would cross the spread sits
+// a tick behind the touch instead. If there is nothing to peg to, or the book
+// is in an auction, the order is REJECTED. So is one pegged outside the price
+// band, with ErrOutsideBand.
+func (ob *Orderbook) PlacePeggedOrder(o *Order, peg Peg) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.accept(o)
+
+	o.Peg = &peg
+
+	price, ok := ob.pegPrice(o)
+	if !ok || ob.auction {
+		o.Status = StatusRejected
+		return []Match{}, nil
+	}
+
+	if !ob.inBand(price) {
+		o.Status = StatusRejected
+		return []Match{}, ErrOutsideBand
+	}
+
+	ob.restOrder(price, o)
+	ob.pegged = append(ob.pegged, o)
+
+	return ob.afterMatch(nil), nil
+}
+
+// Best price on one side, leaving out levels with nothing but pegged orders
+func (ob *Orderbook) touch(bid bool) (decimal.Decimal, bool) {
+	levels := ob.asks
+	if bid {
+		levels = ob.bids
+	}
+
+	var (
+		price decimal.Decimal
+		found bool
+	)
+
+	levels.Each(func(l *Limit) bool {
+		if l.Len() > l.pegged {
+			price, found = l.Price, true
+			return false
+		}
+
+		return true
+	})
+
+	return price, found
+}
+
+// Where the pegged order should be right now, false if there is nothing to
+// peg to
+func (ob *Orderbook) pegPrice(o *Order) (decimal.Decimal, bool) {
+	var (
+		price decimal.Decimal
+		ok    bool
+	)
+
+	switch o.Peg.Reference {
+	case PegBestBid:
+		price, ok = ob.touch(true)
+	case PegBestAsk:
+		price, ok = ob.touch(false)
+	case PegMid:
+		bid, bidOk := ob.touch(true)
+		ask, askOk := ob.touch(false)
+		price, ok = (bid+ask)/2, bidOk && askOk
+	}
+
+	if !ok {
+		return 0, false
+	}
+
+	price += o.Peg.Offset
+
+	if o.Peg.Cap != 0 {
+		if o.Bid {
+			price = decimal.Min(price, o.Peg.Cap)
+		} else {
+			price = decimal.Max(price, o.Peg.Cap)
+		}
+	}
+
+	// Stay on the tick grid, rounding away from the other side
+	if rem := price % ob.TickSize; rem != 0 {
+		price -= rem
+		if !o.Bid {
+			price += ob.TickSize
+		}
+	}
+
+	// Never cross
+	if o.Bid {
+		if best := ob.BestAsk(); best != nil && best.Price <= price {
+			price = best.Price - ob.TickSize
+		}
+	} else {
+		if best := ob.BestBid(); best != nil && best.Price >= price {
+			price = best.Price + ob.TickSize
+		}
+	}
+
+	return price, price > 0
+}
+
+// Moves every pegged order whose price is out of date to the back of the
+// queue at its new price, the same as an amend would. One whose new price is
+// outside the price band stays where it is until it isn't, one that can't be
+// funded at the new price is cancelled.
+func (ob *Orderbook) repeg() {
+	// The book can be crossed during an auction - pegs stay put until the
+	// uncross
+	if ob.auction {
+		return
+	}
+
+	live := ob.pegged[:0]
+
+	for _, o := range ob.pegged {
+		// Filled, cancelled or expired since
+		if o.Limit == nil {
+			continue
+		}
+
+		price, ok := ob.pegPrice(o)
+		if !ok || price == o.Limit.Price || !ob.inBand(price) {
+			live = append(live, o)
+			continue
+		}
+
+		ob.removeOrder(o)
+
+		if err := ob.Fund(o, price); err != nil {
+			o.Status = StatusCancelled
+			continue
+		}
+		live = append(live, o)
+
+		ob.seq++
+		o.Seq = ob.seq
+		ob.restOrder(price, o)
+	}
+
+	ob.pegged = live
+}
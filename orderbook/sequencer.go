@@ -0,0 +1,144 @@
+package orderbook
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Last values handed out by a Sequencer. Persist this and pass it back to
+// NewSequencer on start up so IDs keep increasing across restarts.
+type SequencerState struct {
+	LastOrderID  int64  `json:"lastOrderId"`
+	LastTradeID  int64  `json:"lastTradeId"`
+	LastEventSeq uint64 `json:"lastEventSeq"`
+}
+
+// How far ahead of the counters a persisted sequencer reserves, so it only
+// saves once every this many values of a counter
+const SequencerBlock = 1_000
+
+// Hands out strictly increasing order IDs, trade IDs and event sequence
+// numbers. An exchange shares one sequencer between all of its orderbooks so
+// IDs never collide across markets.
+type Sequencer struct {
+	orderID  atomic.Int64
+	tradeID  atomic.Int64
+	eventSeq atomic.Uint64
+
+	// What the last save covers, nil unless persisted
+	reserved atomic.Pointer[SequencerState]
+	mu       sync.Mutex // Serialises saves
+	save     func(SequencerState) error
+}
+
+func NewSequencer(state SequencerState) *Sequencer {
+	s := &Sequencer{}
+	s.orderID.Store(state.LastOrderID)
+	s.tradeID.Store(state.LastTradeID)
+	s.eventSeq.Store(state.LastEventSeq)
+
+	return s
+}
+
+// Has the sequencer save a state a block ahead of its counters, and save again
+// before it hands out anything past it. Restoring the last save after a crash
+// skips at most a block of each counter but never hands a value out twice. A
+// save that fails later panics - carrying on would risk exactly that.
+func (s *Sequencer) Persist(save func(SequencerState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.save = save
+
+	return s.reserveLocked()
+}
+
+func (s *Sequencer) NextOrderID() int64 {
+	id := s.orderID.Add(1)
+	s.reserve(func(r *SequencerState) bool { return id > r.LastOrderID })
+
+	return id
+}
+
+func (s *Sequencer) NextTradeID() int64 {
+	id := s.tradeID.Add(1)
+	s.reserve(func(r *SequencerState) bool { return id > r.LastTradeID })
+
+	return id
+}
+
+func (s *Sequencer) NextEventSeq() uint64 {
+	seq := s.eventSeq.Add(1)
+	s.reserve(func(r *SequencerState) bool { return seq > r.LastEventSeq })
+
+	return seq
+}
+
+// Makes sure values handed out from now on come after the ones in last, e.g.
+// the highest ones found in storage on start up. Never goes backwards.
+func (s *Sequencer) Skip(last SequencerState) {
+	raise(&s.orderID, last.LastOrderID)
+	raise(&s.tradeID, last.LastTradeID)
+	raise(&s.eventSeq, last.LastEventSeq)
+
+	s.reserve(func(r *SequencerState) bool {
+		return last.LastOrderID > r.LastOrderID || last.LastTradeID > r.LastTradeID || last.LastEventSeq > r.LastEventSeq
+	})
+}
+
+func raise[T int64 | uint64, A interface {
+	Load() T
+	CompareAndSwap(old, new T) bool
+}](counter A, last T) {
+	for {
+		current := counter.Load()
+		if current >= last || counter.CompareAndSwap(current, last) {
+			return
+		}
+	}
+}
+
+// Saves a new reservation if past says the current one is used up
+func (s *Sequencer) reserve(past func(r *SequencerState) bool) {
+	r := s.reserved.Load()
+	if r == nil || !past(r) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Someone else got there first
+	if !past(s.reserved.Load()) {
+		return
+	}
+
+	if err := s.reserveLocked(); err != nil {
+		panic(fmt.Sprintf("sequencer: saving state failed: %v", err))
+	}
+}
+
+// Called with mu held
+func (s *Sequencer) reserveLocked() error {
+	state := s.State()
+	state.LastOrderID += SequencerBlock
+	state.LastTradeID += SequencerBlock
+	state.LastEventSeq += SequencerBlock
+
+	if err := s.save(state); err != nil {
+		return err
+	}
+
+	s.reserved.Store(&state)
+
+	return nil
+}
+
+func (s *Sequencer) State() SequencerState {
+	return SequencerState{
+		LastOrderID:  s.orderID.Load(),
+		LastTradeID:  s.tradeID.Load(),
+		LastEventSeq: s.eventSeq.Load(),
+	}
+}
@@ -0,0 +1,207 @@
+package orderbook
+
+import (
+	"sort"
+
+	"github.com/kkomitski/exchange/decimal"
+)
+
+// Trigger of a stop order. A buy stop fires once the last trade price rises
+// to the stop price, a sell stop once it falls to it. Without a LimitPrice
+// the order goes to the book as a market order, otherwise as a limit order.
+type Stop struct {
+	Price      decimal.Decimal `json:"price"`
+	LimitPrice decimal.Decimal `json:"limitPrice,omitempty"`
+	// Only used by stop-market orders
+	Policy FillPolicy `json:"policy,omitempty"`
+
+	// Set for trailing stops, Price and LimitPrice are then kept up to date by
+	// the orderbook
+	Trail *Trail `json:"trail,omitempty"`
+}
+
+// Percentages are fixed-point with two decimals, so 150 is 1.5%
+const PercentScale decimal.Scale = 2
+
+// A trailing stop follows the best trade price seen since it was placed - the
+// highest for a sell stop, the lowest for a buy stop - and keeps its trigger a
+// fixed amount or a percentage away from it
+type Trail struct {
+	Amount  decimal.Decimal `json:"amount,omitempty"`
+	Percent decimal.Decimal `json:"percent,omitempty"`
+
+	// Fire as a limit order LimitOffset past the trigger price instead of as
+	// a market order
+	Limit       bool            `json:"limit,omitempty"`
+	LimitOffset decimal.Decimal `json:"limitOffset,omitempty"`
+
+	// Best price seen so far, zero until the first trade
+	Extreme decimal.Decimal `json:"extreme"`
+}
+
+// Moves the trigger of a trailing stop after a trade at price
+func (s *Stop) trail(bid bool, price decimal.Decimal) {
+	t := s.Trail
+
+	if t.Extreme == 0 || (bid && price < t.Extreme) || (!bid && price > t.Extreme) {
+		t.Extreme = price
+	}
+
+	offset := t.Amount
+	if t.Percent != 0 {
+		offset = t.Extreme * t.Percent / (100 * PercentScale.Unit())
+	}
+
+	if bid {
+		s.Price = t.Extreme + offset
+		if t.Limit {
+			s.LimitPrice = s.Price + t.LimitOffset
+		}
+	} else {
+		s.Price = t.Extreme - offset
+		if t.Limit {
+			s.LimitPrice = s.Price - t.LimitOffset
+		}
+	}
+}
+
+func (s *Stop) IsLimit() bool {
+	return s.LimitPrice != 0
+}
+
+// Price of the most recent trade, false if nothing has traded yet
+func (ob *Orderbook) LastPrice() (decimal.Decimal, bool) {
+	if len(ob.Trades) == 0 {
+		return 0, false
+	}
+
+	return ob.Trades[len(ob.Trades)-1].Price, true
+}
+
+// Holds the order outside of the visible book until the last trade price
+// reaches its stop price. If the market is already through the stop price the
+// order triggers straight away and the returned matches are its fills.
+func (ob *Orderbook) PlaceStopOrder(o *Order, stop Stop) []Match {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.placeStopOrder(o, stop)
+
+	return ob.afterMatch(nil)
+}
+
+func (ob *Orderbook) placeStopOrder(o *Order, stop Stop) {
+	ob.accept(o)
+
+	o.Stop = &stop
+	o.Status = StatusPending
+	ob.stops = append(ob.stops, o)
+
+	// Trailing stops start following the market from the last trade
+	if stop.Trail != nil {
+		if last, ok := ob.LastPrice(); ok {
+			stop.trail(o.Bid, last)
+		}
+	}
+}
+
+// Pending stop orders in the order they were placed
+func (ob *Orderbook) Stops() []*Order {
+	return append([]*Order{}, ob.stops...)
+}
+
+func (ob *Orderbook) removeStop(id int64) (*Order, bool) {
+	for i, o := range ob.stops {
+		if o.ID == id {
+			ob.stops = append(ob.stops[:i], ob.stops[i+1:]...)
+			return o, true
+		}
+	}
+
+	return nil, false
+}
+
+func (o *Order) stopTriggered(last decimal.Decimal) bool {
+	// Trailing stop that hasn't seen a trade yet
+	if o.Stop.Trail != nil && o.Stop.Trail.Extreme == 0 {
+		return false
+	}
+
+	if o.Bid {
+		return last >= o.Stop.Price
+	}
+
+	return last <= o.Stop.Price
+}
+
+// Sends every stop order the last trade price has reached into the book.
+// Their trades can move the price again, so keep going until nothing else
+// triggers.
+func (ob *Orderbook) triggerStops() []Match {
+	matches := []Match{}
+
+	for {
+		ob.trailStops()
+
+		last, ok := ob.LastPrice()
+		if !ok {
+			return matches
+		}
+
+		var triggered, pending []*Order
+		for _, o := range ob.stops {
+			if o.stopTriggered(last) {
+				triggered = append(triggered, o)
+			} else {
+				pending = append(pending, o)
+			}
+		}
+
+		if len(triggered) == 0 {
+			return matches
+		}
+
+		ob.stops = pending
+
+		// Oldest stop goes first
+		sort.Sort(Orders(triggered))
+
+		for _, o := range triggered {
+			matches = append(matches, ob.executeStop(o)...)
+		}
+	}
+}
+
+// Runs every trade since the last call past the trailing stops
+func (ob *Orderbook) trailStops() {
+	for ; ob.trailed < len(ob.Trades); ob.trailed++ {
+		price := ob.Trades[ob.trailed].Price
+
+		for _, o := range ob.stops {
+			if o.Stop.Trail != nil {
+				o.Stop.trail(o.Bid, price)
+			}
+		}
+	}
+}
+
+func (ob *Orderbook) executeStop(o *Order) []Match {
+	if err := ob.Fund(o, o.Stop.LimitPrice); err != nil {
+		o.Status = StatusCancelled
+		return nil
+	}
+
+	if o.Stop.IsLimit() {
+		return ob.placeLimitOrder(o.Stop.LimitPrice, o)
+	}
+
+	policy := o.Stop.Policy
+	if policy == "" {
+		policy = PartialFill
+	}
+
+	// A rejected stop-market order just ends up KILLED
+	matches, _ := ob.placeMarketOrder(o, policy)
+
+	return matches
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/kkomitski/exchange/orderbook"
+	"github.com/kkomitski/exchange/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// Moves a market to status. PRE_OPEN and AUCTION put the book into a call
+// auction. Going from an auction to OPEN or CLOSED uncrosses it first. A
+// market halted during an auction stays in it until it's reopened.
+func (ex *Exchange) SetMarketStatus(market Market, status MarketStatus) error {
+	l, ok := ex.registry.Get(market)
+	if !ok {
+		return ErrMarketNotFound
+	}
+
+	if !status.valid() {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
+
+	return ex.changeStatus(l, status, "")
+}
+
+// Does the work of SetMarketStatus. Every change is published as a market
+// status event.
+func (ex *Exchange) changeStatus(l *Listing, status MarketStatus, reason string) error {
+	market := l.Symbol
+
+	var (
+		fills     []fill
+		uncrossed bool
+		state     orderbook.AuctionState
+	)
+
+	l.do(func(ob *orderbook.Orderbook) {
+		switch {
+		case status.inAuction():
+			ob.StartAuction()
+		case (status == MarketOpen || status == MarketClosed) && ob.InAuction():
+			// Uncross before the status changes, so no order sneaks in
+			// between that expects to rest without matching
+			var matches []orderbook.Match
+			state, matches = ob.Uncross()
+			fills = ex.handleMatches(l, matches)
+			uncrossed = true
+		}
+	})
+
+	if uncrossed {
+		str := fmt.Sprintf("SERVER: Uncrossed [%s] at %s, volume %s", market, l.Config.FormatPrice(state.Price), l.Config.FormatSize(state.Volume))
+		fmt.Println(utils.PrintColor("yellow", str))
+
+		if err := ex.settle(l, fills); err != nil {
+			return err
+		}
+	}
+
+	if err := ex.registry.SetStatus(market, status); err != nil {
+		return err
+	}
+
+	ex.emit(Event{
+		Type:   EventMarketStatus,
+		Market: market,
+		Status: status,
+		Reason: reason,
+	})
+
+	str := fmt.Sprintf("SERVER: Market [%s] is %s", market, status)
+	if reason != "" {
+		str += " - " + reason
+	}
+	fmt.Println(utils.PrintColor("yellow", str))
+
+	return nil
+}
+
+type AuctionResponse struct {
+	Market Market
+	Status MarketStatus
+	Price  string // Empty while the book doesn't cross
+	Volume string
+	// Left over at Price, positive on the bid side and negative on the ask
+	// side
+	Imbalance string
+}
+
+// Indicative uncross of a market in an auction
+func (ex *Exchange) handleGetAuction(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	l, ok := ex.registry.Get(market)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
+
+	snap := l.snapshot()
+	if !snap.inAuction {
+		return c.JSON(http.StatusConflict, APIError{Error: fmt.Sprintf("%s is not in an auction", market)})
+	}
+
+	status, _ := ex.registry.Status(market)
+	state := snap.auction
+	cfg := l.Config
+
+	resp := &AuctionResponse{
+		Market:    market,
+		Status:    status,
+		Volume:    cfg.FormatSize(state.Volume),
+		Imbalance: cfg.FormatSize(state.Imbalance),
+	}
+
+	if state.Price != 0 {
+		resp.Price = cfg.FormatPrice(state.Price)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
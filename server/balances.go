@@ -0,0 +1,334 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
+	"github.com/kkomitski/exchange/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// Hold an order draws on. The legs of an OCO group or a bracket share their
+// group's, only one of them can trade. A bracket entry has its own.
+func holdID(o *orderbook.Order) int64 {
+	if g := o.Group; g != nil && (g.Entry == nil || g.Entry.Order != o) {
+		return g.ID
+	}
+
+	return o.ID
+}
+
+// What an order needs locked before it goes in the book. Sells lock their
+// size. Buys lock price times size, price being the worst they can trade at.
+// Buys without one (market orders, stops without a limit) lock what sweeping
+// the asks would cost right now, the most they can pay if they go in straight
+// away - stops are topped up again when they trigger. Runs inside the loop.
+func holdAmount(l *Listing, ob *orderbook.Orderbook, o *orderbook.Order, price, size decimal.Decimal) (Asset, decimal.Decimal) {
+	cfg := l.Config
+
+	if !o.Bid {
+		return Asset(l.Base), size
+	}
+
+	if price != 0 {
+		return Asset(l.Quote), toDecimal(cfg.NotionalUp(price, size))
+	}
+
+	// Own asks trade like any other unless self-trade prevention stops them,
+	// the same way matching would
+	cost := new(big.Int)
+sweep:
+	for _, limit := range ob.Asks() {
+		for _, resting := range limit.Orders() {
+			if size == 0 {
+				break sweep
+			}
+
+			take := decimal.Min(size, resting.Size)
+			if resting.UserID == o.UserID {
+				switch o.SelfTradePrevention {
+				case orderbook.CancelNewest, orderbook.CancelBoth:
+					break sweep
+				case orderbook.CancelOldest:
+					continue
+				case orderbook.DecrementAndCancel:
+					size -= take
+					continue
+				}
+			}
+
+			cost.Add(cost, cfg.NotionalUp(limit.Price, take))
+			size -= take
+		}
+	}
+
+	return Asset(l.Quote), toDecimal(cost)
+}
+
+// Worst price a resting order can trade at, the cap of a capped pegged bid
+func worstPrice(o *orderbook.Order) decimal.Decimal {
+	if o.Bid && o.Peg != nil && o.Peg.Cap != 0 {
+		return o.Peg.Cap
+	}
+
+	return o.Limit.Price
+}
+
+// Big enough to never be affordable if it doesn't fit
+func toDecimal(n *big.Int) decimal.Decimal {
+	if !n.IsInt64() {
+		return math.MaxInt64
+	}
+
+	return decimal.Decimal(n.Int64())
+}
+
+// Locks amount for the orders under hold ID id. Runs inside the loop.
+func (ex *Exchange) fund(l *Listing, id int64, userID int64, asset Asset, amount decimal.Decimal, orders ...*orderbook.Order) error {
+	if err := ex.ledger.Hold(userID, id, asset, amount); err != nil {
+		return err
+	}
+
+	l.funded[id] = append(l.funded[id], orders...)
+
+	return nil
+}
+
+// Funds a group before it's placed. An OCO group holds, for each side, the
+// most any one of its legs needs, since only one of them trades. A bracket
+// only holds for its entry - the legs go in once it has filled and sell (or
+// buy back) what it traded, and are funded then. Runs inside the loop.
+func (ex *Exchange) fundGroup(l *Listing, ob *orderbook.Orderbook, g *orderbook.OrderGroup) error {
+	if g.Entry != nil {
+		o := g.Entry.Order
+		o.ID = ex.sequencer.NextOrderID()
+
+		asset, amount := holdAmount(l, ob, o, g.Entry.LimitPrice(), o.Size)
+		if err := ex.fund(l, o.ID, o.UserID, asset, amount, o); err != nil {
+			return err
+		}
+
+		// The legs share the group's hold, topped up as they're armed
+		g.ID = ex.sequencer.NextOrderID()
+		for _, leg := range g.Legs {
+			l.funded[g.ID] = append(l.funded[g.ID], leg.Order)
+		}
+
+		return nil
+	}
+
+	g.ID = ex.sequencer.NextOrderID()
+
+	needs := make(map[Asset]decimal.Decimal)
+	for _, leg := range g.Legs {
+		asset, amount := holdAmount(l, ob, leg.Order, leg.LimitPrice(), leg.Order.Size)
+		needs[asset] = decimal.Max(needs[asset], amount)
+	}
+
+	userID := g.Legs[0].Order.UserID
+	for asset, amount := range needs {
+		if err := ex.ledger.Hold(userID, g.ID, asset, amount); err != nil {
+			ex.ledger.Release(g.ID, Asset(l.Base), Asset(l.Quote))
+			return err
+		}
+	}
+
+	l.funded[g.ID] = g.Orders()
+
+	return nil
+}
+
+// Unlocks what's left of the holds of orders that finished. Runs inside the
+// loop after anything that can end orders.
+func (ex *Exchange) releaseHolds(l *Listing) {
+	for id, orders := range l.funded {
+		done := true
+		for _, o := range orders {
+			done = done && o.IsDone()
+		}
+
+		if done {
+			ex.ledger.Release(id, Asset(l.Base), Asset(l.Quote))
+			delete(l.funded, id)
+		}
+	}
+}
+
+// Brings the hold of a resting order back down to what is left of it, e.g.
+// after an amend shrinks it. Runs inside the loop.
+func (ex *Exchange) trimHold(l *Listing, o *orderbook.Order) {
+	if l.funded[o.ID] == nil || o.IsDone() {
+		return
+	}
+
+	asset, amount := holdAmount(l, l.orderbook, o, worstPrice(o), o.Size)
+	if amount < ex.ledger.Held(o.ID, asset) {
+		ex.ledger.SetHold(o.UserID, o.ID, asset, amount)
+	}
+}
+
+// Tops up the hold of an order the book is about to send in on its own at
+// price, zero for none, to what it can cost now. Set as the Fund of every
+// orderbook, the book cancels the order if it fails. Runs inside the loop.
+func (ex *Exchange) topUp(l *Listing, o *orderbook.Order, price decimal.Decimal) error {
+	id := holdID(o)
+
+	// Funded once it rests, e.g. a pegged order on its way in
+	if l.funded[id] == nil {
+		return nil
+	}
+
+	asset, need := holdAmount(l, l.orderbook, o, price, o.Size)
+	if need <= ex.ledger.Held(id, asset) {
+		return nil
+	}
+
+	return ex.ledger.SetHold(o.UserID, id, asset, need)
+}
+
+// Books the trades of the matches in the ledger, returning the IDs of the
+// ones it refused. Those aren't paid for, so they mustn't be settled either.
+// Runs inside the loop.
+func (ex *Exchange) bookTrades(l *Listing, matches []orderbook.Match) map[int64]bool {
+	refused := make(map[int64]bool)
+
+	for _, match := range matches {
+		if !match.IsTrade() {
+			continue
+		}
+
+		err := ex.ledger.Trade(ledgerTrade{
+			TradeID:     match.TradeID,
+			Base:        Asset(l.Base),
+			Quote:       Asset(l.Quote),
+			Size:        match.SizeFilled,
+			Notional:    toDecimal(l.Config.Notional(match.Price, match.SizeFilled)),
+			BuyerID:     match.Bid.UserID,
+			BuyOrderID:  match.Bid.ID,
+			BuyHold:     holdID(match.Bid),
+			SellerID:    match.Ask.UserID,
+			SellOrderID: match.Ask.ID,
+			SellHold:    holdID(match.Ask),
+		})
+		if err != nil {
+			fmt.Println(utils.PrintColor("red", fmt.Sprintf("SERVER: Trade %d not booked or settled: %v", match.TradeID, err)))
+			refused[match.TradeID] = true
+		}
+	}
+
+	return refused
+}
+
+// Error message with the amounts at the asset's scale
+func (ex *Exchange) balanceError(err *InsufficientBalanceError) string {
+	scale, _ := ex.registry.AssetScale(err.Asset)
+
+	return fmt.Sprintf("%v: %s %s needed, %s available", ErrInsufficientBalance, scale.Format(err.Needed), err.Asset, scale.Format(err.Available))
+}
+
+type BalanceResponse struct {
+	Asset     Asset
+	Available string
+	Locked    string
+}
+
+type LedgerEntry struct {
+	ID        int64
+	Type      EntryType
+	Asset     Asset
+	Account   Account
+	Amount    string
+	OrderID   int64 `json:",omitempty"`
+	TradeID   int64 `json:",omitempty"`
+	Timestamp int64
+}
+
+func (ex *Exchange) handleGetBalances(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	return c.JSON(http.StatusOK, ex.balances(userID))
+}
+
+func (ex *Exchange) balances(userID int64) []BalanceResponse {
+	resp := []BalanceResponse{}
+	for asset, b := range ex.ledger.Balances(userID) {
+		scale, _ := ex.registry.AssetScale(asset)
+
+		resp = append(resp, BalanceResponse{
+			Asset:     asset,
+			Available: scale.Format(b.Available),
+			Locked:    scale.Format(b.Locked),
+		})
+	}
+
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Asset < resp[j].Asset })
+
+	return resp
+}
+
+// Every posting to the user's accounts, for auditing their balances
+func (ex *Exchange) handleGetLedger(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	resp := []LedgerEntry{}
+	for _, e := range ex.ledger.Entries(userID) {
+		scale, _ := ex.registry.AssetScale(e.Asset)
+
+		resp = append(resp, LedgerEntry{
+			ID:        e.ID,
+			Type:      e.Type,
+			Asset:     e.Asset,
+			Account:   e.Account,
+			Amount:    scale.Format(e.Amount),
+			OrderID:   e.OrderID,
+			TradeID:   e.TradeID,
+			Timestamp: e.Timestamp,
+		})
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+type DepositRequest struct {
+	UserID int64
+	Asset  Asset
+	Amount string
+}
+
+// Credits a user with funds from outside the exchange
+func (ex *Exchange) handleDeposit(c echo.Context) error {
+	var req DepositRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	scale, ok := ex.registry.AssetScale(req.Asset)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("unknown asset: %q", req.Asset)})
+	}
+
+	amount, err := scale.Parse(req.Amount)
+	if err == nil && amount <= 0 {
+		err = decimal.ErrInvalidDecimal
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid amount: %v", err)})
+	}
+
+	ex.ledger.Deposit(req.UserID, req.Asset, amount)
+
+	return c.JSON(http.StatusOK, ex.balances(req.UserID))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kkomitski/exchange/orderbook"
+	"github.com/kkomitski/exchange/utils"
+)
+
+// Markets halted by their circuit breaker and when they come back
+type circuitBreakers struct {
+	mu sync.Mutex
+	// Trades up to this ID happened before the last halt and don't count
+	// towards the next one
+	after map[Market]int64
+	// End of the cool-off
+	resumeAt map[Market]time.Time
+	// End of the auction the market reopens through
+	reopenAt map[Market]time.Time
+	// Why the breaker tripped, until the market is halted
+	tripped map[Market]string
+}
+
+func newCircuitBreakers() circuitBreakers {
+	return circuitBreakers{
+		after:    make(map[Market]int64),
+		resumeAt: make(map[Market]time.Time),
+		reopenAt: make(map[Market]time.Time),
+		tripped:  make(map[Market]string),
+	}
+}
+
+// Runs inside the matching loop, right after the trades it checks. Trips the
+// breaker of an open market whose price moved more than it allows - the halt
+// itself needs the loop, so haltTripped makes it once the command is done.
+func (ex *Exchange) checkBreaker(l *Listing, ob *orderbook.Orderbook) {
+	cfg := l.Config
+	if cfg.BreakerPercent == 0 {
+		return
+	}
+
+	ex.breakers.mu.Lock()
+	defer ex.breakers.mu.Unlock()
+
+	move := ob.PriceMove(cfg.BreakerWindow, ex.breakers.after[l.Symbol])
+	if move <= cfg.BreakerPercent {
+		return
+	}
+
+	// e.g. uncross trades while the market is still in its auction
+	if status, _ := ex.registry.Status(l.Symbol); status != MarketOpen {
+		return
+	}
+
+	ex.breakers.after[l.Symbol] = ob.LastTradeID()
+	ex.breakers.resumeAt[l.Symbol] = ex.Clock.Now().Add(cfg.CoolOff)
+	ex.breakers.tripped[l.Symbol] = fmt.Sprintf("circuit breaker, price moved %s%% within %v", orderbook.PercentScale.Format(move), cfg.BreakerWindow)
+}
+
+// Halts the market if its breaker tripped. Runs outside the matching loop.
+func (ex *Exchange) haltTripped(l *Listing) error {
+	ex.breakers.mu.Lock()
+	reason, ok := ex.breakers.tripped[l.Symbol]
+	delete(ex.breakers.tripped, l.Symbol)
+	ex.breakers.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return ex.changeStatus(l, MarketHalted, reason)
+}
+
+// Reopens markets whose cool-off is over, through an auction if they have one
+// configured, and uncrosses reopening auctions that are over. Markets whose
+// status was changed by hand in the meantime are left alone.
+func (ex *Exchange) ResumeMarkets() {
+	now := ex.Clock.Now()
+
+	var resume, reopen []Market
+
+	// Changing the status can uncross the book, and the trades go through
+	// checkBreaker, so the lock can't be held past here
+	ex.breakers.mu.Lock()
+	for market, at := range ex.breakers.resumeAt {
+		if !now.Before(at) {
+			resume = append(resume, market)
+			delete(ex.breakers.resumeAt, market)
+		}
+	}
+	for market, at := range ex.breakers.reopenAt {
+		if !now.Before(at) {
+			reopen = append(reopen, market)
+			delete(ex.breakers.reopenAt, market)
+		}
+	}
+	ex.breakers.mu.Unlock()
+
+	for _, market := range resume {
+		l, _ := ex.registry.Get(market)
+		if status, _ := ex.registry.Status(market); status != MarketHalted {
+			continue
+		}
+
+		var err error
+		if l.Config.ReopenAuction > 0 {
+			ex.breakers.mu.Lock()
+			ex.breakers.reopenAt[market] = now.Add(l.Config.ReopenAuction)
+			ex.breakers.mu.Unlock()
+
+			err = ex.changeStatus(l, MarketAuction, "cool-off over, reopening through an auction")
+		} else {
+			err = ex.changeStatus(l, MarketOpen, "cool-off over")
+		}
+
+		if err != nil {
+			fmt.Println(utils.PrintColor("red", fmt.Sprintf("SERVER: Failed to resume [%s]: %v", market, err)))
+		}
+	}
+
+	for _, market := range reopen {
+		l, _ := ex.registry.Get(market)
+		if status, _ := ex.registry.Status(market); status != MarketAuction {
+			continue
+		}
+
+		if err := ex.changeStatus(l, MarketOpen, "reopening auction over"); err != nil {
+			fmt.Println(utils.PrintColor("red", fmt.Sprintf("SERVER: Failed to reopen [%s]: %v", market, err)))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	seq := orderbook.NewSequencer(orderbook.SequencerState{})
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	ex := &Exchange{
+		registry:  NewMarketRegistry(seq, clock),
+		sequencer: seq,
+		Clock:     clock,
+		breakers:  newCircuitBreakers(),
+	}
+
+	cfg := Markets[MarketETH]
+	l, err := ex.registry.Create(MarketETH, "ETH", "USD", cfg, MarketOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What the loop does after a trade
+	check := func() error {
+		l.do(func(ob *orderbook.Orderbook) { ex.checkBreaker(l, ob) })
+		return ex.haltTripped(l)
+	}
+
+	// A 10% move is inside the breaker
+	now := clock.now.UnixNano()
+	l.orderbook.Trades = append(l.orderbook.Trades, &orderbook.Trade{ID: 1, Price: 200_000, Timestamp: now})
+	l.orderbook.Trades = append(l.orderbook.Trades, &orderbook.Trade{ID: 2, Price: 220_000, Timestamp: now})
+
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := ex.registry.Status(MarketETH); status != MarketOpen {
+		t.Fatalf("halted on a 10%% move: %s", status)
+	}
+
+	// 20% isn't
+	l.orderbook.Trades = append(l.orderbook.Trades, &orderbook.Trade{ID: 3, Price: 240_000, Timestamp: now})
+
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ex.registry.Open(MarketETH); err == nil {
+		t.Errorf("halted market takes orders")
+	}
+
+	// Still cooling off
+	clock.now = clock.now.Add(cfg.CoolOff - time.Second)
+	ex.ResumeMarkets()
+
+	if status, _ := ex.registry.Status(MarketETH); status != MarketHalted {
+		t.Errorf("resumed during the cool-off: %s", status)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	ex.ResumeMarkets()
+
+	if status, _ := ex.registry.Status(MarketETH); status != MarketAuction || !l.orderbook.InAuction() {
+		t.Errorf("not reopening through an auction: %s", status)
+	}
+
+	clock.now = clock.now.Add(cfg.ReopenAuction)
+	ex.ResumeMarkets()
+
+	if status, _ := ex.registry.Status(MarketETH); status != MarketOpen || l.orderbook.InAuction() {
+		t.Errorf("not reopened: %s", status)
+	}
+
+	// Trades from before the halt don't trip it again
+	if err := check(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := ex.events.Since(0)
+	want := []MarketStatus{MarketHalted, MarketAuction, MarketOpen}
+
+	if len(events) != len(want) {
+		t.Fatalf("events: got %+v", events)
+	}
+
+	for i, e := range events {
+		if e.Type != EventMarketStatus || e.Status != want[i] || e.Reason == "" {
+			t.Errorf("event %d: got %+v", i, e)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+type EventType string
+
+const (
+	// A GTD or DAY order reached its expiry time and left the book
+	EventOrderExpired EventType = "expired"
+	// A market changed status, e.g. halted by its circuit breaker or reopened
+	// after the cool-off
+	EventMarketStatus EventType = "market_status"
+)
+
+type Event struct {
+	Seq       uint64 // From the exchange sequencer, strictly increasing
+	Type      EventType
+	Market    Market
+	OrderID   int64        `json:",omitempty"`
+	UserID    int64        `json:",omitempty"`
+	Status    MarketStatus `json:",omitempty"`
+	Reason    string       `json:",omitempty"`
+	Timestamp int64
+}
+
+// In memory log of everything the exchange emitted, clients poll it with the
+// last sequence number they saw
+// TODO: Trim old events once there is somewhere to persist them
+type EventLog struct {
+	mu     sync.RWMutex
+	events []Event
+}
+
+// Numbers the event under the lock so the log always stays in sequence order
+func (l *EventLog) append(e Event, seq *orderbook.Sequencer) {
+	l.mu.Lock()
+	e.Seq = seq.NextEventSeq()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+// Events with a sequence number above seq
+func (l *EventLog) Since(seq uint64) []Event {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	i := sort.Search(len(l.events), func(i int) bool { return l.events[i].Seq > seq })
+
+	return append([]Event{}, l.events[i:]...)
+}
+
+func (ex *Exchange) emit(e Event) {
+	e.Timestamp = ex.Clock.Now().UnixNano()
+
+	ex.events.append(e, ex.sequencer)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kkomitski/exchange/orderbook"
+	"github.com/kkomitski/exchange/utils"
+)
+
+// Source of the current time for everything time based in the exchange.
+// Swap it out to drive expiry deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Whatever clock the exchange has at the time, so swapping Exchange.Clock
+// swaps it for the ledger, the settlement queue and the orderbooks too
+type exchangeClock struct {
+	ex *Exchange
+}
+
+func (c exchangeClock) Now() time.Time {
+	return c.ex.Clock.Now()
+}
+
+// Checks for expired orders and markets due to reopen every interval until
+// stop is closed
+func (ex *Exchange) runScheduler(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ex.ExpireOrders()
+			ex.ResumeMarkets()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Takes every GTD and DAY order that is past its expiry out of the books,
+// forgets about it and emits an expired event for it
+func (ex *Exchange) ExpireOrders() {
+	now := ex.Clock.Now().UnixNano()
+
+	for _, l := range ex.registry.List() {
+		var (
+			expired []*orderbook.Order
+			fills   []fill
+		)
+		l.do(func(ob *orderbook.Orderbook) {
+			var matches []orderbook.Match
+
+			// Expired bracket entries send their legs in
+			expired, matches = ob.ExpireOrders(now)
+			fills = ex.handleMatches(l, matches)
+
+			ex.UserOrders.mu.Lock()
+			ex.untrackDone(expired...)
+			ex.UserOrders.mu.Unlock()
+		})
+
+		if err := ex.settle(l, fills); err != nil {
+			fmt.Println(utils.PrintColor("red", fmt.Sprintf("SERVER: Settling expiry of [%s] failed: %v", l.Symbol, err)))
+		}
+
+		// Only the IDs are read from here on, they never change
+		for _, order := range expired {
+			ex.emit(Event{
+				Type:    EventOrderExpired,
+				Market:  l.Symbol,
+				OrderID: order.ID,
+				UserID:  order.UserID,
+			})
+
+			str := fmt.Sprintf("SERVER: Expired order [%d] of user [%d]", order.ID, order.UserID)
+			fmt.Println(utils.PrintColor("yellow", str))
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kkomitski/exchange/decimal"
+)
+
+// An asset users hold balances in, e.g. ETH or USD. Amounts of an asset are at
+// the scale the registry keeps for it - the size scale of the markets it's the
+// base of and the price scale of the markets it's the quote of.
+type Asset string
+
+// Where a posting lands. Every transaction is a set of postings that add up to
+// zero for each asset, so funds only ever move between accounts.
+type Account string
+
+const (
+	AccountAvailable Account = "AVAILABLE"
+	// Held for open orders
+	AccountLocked Account = "LOCKED"
+	// Outside the exchange, deposits come out of it
+	AccountExternal Account = "EXTERNAL"
+)
+
+type EntryType string
+
+const (
+	EntryDeposit EntryType = "DEPOSIT"
+	// Available to locked when an order is placed or grows
+	EntryHold EntryType = "HOLD"
+	// Locked back to available when an order finishes or shrinks
+	EntryRelease EntryType = "RELEASE"
+	// Locked funds of one user to the available funds of the other
+	EntryTrade EntryType = "TRADE"
+)
+
+// One posting of a transaction
+type Entry struct {
+	ID        int64 // Postings of the same transaction share it
+	Type      EntryType
+	UserID    int64
+	Asset     Asset
+	Account   Account
+	Amount    decimal.Decimal // Positive for a credit, negative for a debit
+	OrderID   int64           `json:",omitempty"`
+	TradeID   int64           `json:",omitempty"`
+	Timestamp int64
+}
+
+type Balance struct {
+	Available decimal.Decimal
+	Locked    decimal.Decimal
+}
+
+var (
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrUnfundedTrade       = errors.New("trade not covered by its holds")
+)
+
+// Holds are keyed by the order they fund, or the group for legs that share
+// one, and the asset
+type holdKey struct {
+	ID    int64
+	Asset Asset
+}
+
+type hold struct {
+	UserID int64
+	Amount decimal.Decimal
+}
+
+// Off-chain balances of every user, kept as a double-entry journal. Safe to
+// use from any market's matching loop.
+type Ledger struct {
+	mu       sync.Mutex
+	clock    Clock
+	balances map[int64]map[Asset]*Balance
+	holds    map[holdKey]*hold
+	entries  []Entry
+	lastID   int64
+}
+
+func NewLedger(clock Clock) *Ledger {
+	return &Ledger{
+		clock:    clock,
+		balances: make(map[int64]map[Asset]*Balance),
+		holds:    make(map[holdKey]*hold),
+	}
+}
+
+func (lg *Ledger) balance(userID int64, asset Asset) *Balance {
+	if lg.balances[userID] == nil {
+		lg.balances[userID] = make(map[Asset]*Balance)
+	}
+
+	if lg.balances[userID][asset] == nil {
+		lg.balances[userID][asset] = &Balance{}
+	}
+
+	return lg.balances[userID][asset]
+}
+
+// Journals the postings as one transaction and applies them to the balances
+func (lg *Ledger) post(postings ...Entry) {
+	lg.lastID++
+	now := lg.clock.Now().UnixNano()
+
+	for _, p := range postings {
+		p.ID = lg.lastID
+		p.Timestamp = now
+		lg.entries = append(lg.entries, p)
+
+		b := lg.balance(p.UserID, p.Asset)
+		switch p.Account {
+		case AccountAvailable:
+			b.Available += p.Amount
+		case AccountLocked:
+			b.Locked += p.Amount
+		}
+	}
+}
+
+// Moves amount between the user's available and locked funds, towards locked
+// for a positive amount
+func (lg *Ledger) lock(typ EntryType, userID int64, asset Asset, amount decimal.Decimal, orderID int64) {
+	lg.post(
+		Entry{Type: typ, UserID: userID, Asset: asset, Account: AccountAvailable, Amount: -amount, OrderID: orderID},
+		Entry{Type: typ, UserID: userID, Asset: asset, Account: AccountLocked, Amount: amount, OrderID: orderID},
+	)
+}
+
+func (lg *Ledger) Deposit(userID int64, asset Asset, amount decimal.Decimal) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	lg.post(
+		Entry{Type: EntryDeposit, UserID: userID, Asset: asset, Account: AccountExternal, Amount: -amount},
+		Entry{Type: EntryDeposit, UserID: userID, Asset: asset, Account: AccountAvailable, Amount: amount},
+	)
+}
+
+// Locks amount of the user's available funds for the order (or group) id,
+// adding to whatever it already holds
+func (lg *Ledger) Hold(userID int64, id int64, asset Asset, amount decimal.Decimal) error {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	return lg.hold(userID, id, asset, amount)
+}
+
+func (lg *Ledger) hold(userID int64, id int64, asset Asset, amount decimal.Decimal) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	if available := lg.balance(userID, asset).Available; available < amount {
+		return &InsufficientBalanceError{Asset: asset, Needed: amount, Available: available}
+	}
+
+	key := holdKey{ID: id, Asset: asset}
+	if lg.holds[key] == nil {
+		lg.holds[key] = &hold{UserID: userID}
+	}
+	lg.holds[key].Amount += amount
+
+	lg.lock(EntryHold, userID, asset, amount, id)
+
+	return nil
+}
+
+// Grows or shrinks the hold of id to amount, e.g. after an amend
+func (lg *Ledger) SetHold(userID int64, id int64, asset Asset, amount decimal.Decimal) error {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	var held decimal.Decimal
+	if h := lg.holds[holdKey{ID: id, Asset: asset}]; h != nil {
+		held = h.Amount
+	}
+
+	if amount > held {
+		return lg.hold(userID, id, asset, amount-held)
+	}
+
+	lg.release(id, asset, held-amount)
+
+	return nil
+}
+
+// What id still holds of asset
+func (lg *Ledger) Held(id int64, asset Asset) decimal.Decimal {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	if h := lg.holds[holdKey{ID: id, Asset: asset}]; h != nil {
+		return h.Amount
+	}
+
+	return 0
+}
+
+// Unlocks whatever id still holds of the assets
+func (lg *Ledger) Release(id int64, assets ...Asset) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	for _, asset := range assets {
+		if h := lg.holds[holdKey{ID: id, Asset: asset}]; h != nil {
+			lg.release(id, asset, h.Amount)
+		}
+	}
+}
+
+func (lg *Ledger) release(id int64, asset Asset, amount decimal.Decimal) {
+	key := holdKey{ID: id, Asset: asset}
+
+	h := lg.holds[key]
+	if h == nil || amount <= 0 {
+		return
+	}
+
+	h.Amount -= amount
+	if h.Amount == 0 {
+		delete(lg.holds, key)
+	}
+
+	lg.lock(EntryRelease, h.UserID, asset, -amount, id)
+}
+
+// Fails unless id holds at least amount of asset
+func (lg *Ledger) covered(id int64, asset Asset, amount decimal.Decimal) error {
+	var held decimal.Decimal
+	if h := lg.holds[holdKey{ID: id, Asset: asset}]; h != nil {
+		held = h.Amount
+	}
+
+	if held < amount {
+		return fmt.Errorf("%w: %d %s needed from hold %d, %d held", ErrUnfundedTrade, amount, asset, id, held)
+	}
+
+	return nil
+}
+
+// Takes amount out of the funds id holds, which must cover it
+func (lg *Ledger) spend(id int64, asset Asset, amount decimal.Decimal) {
+	key := holdKey{ID: id, Asset: asset}
+
+	h := lg.holds[key]
+	if h == nil {
+		return
+	}
+
+	h.Amount -= amount
+	if h.Amount == 0 {
+		delete(lg.holds, key)
+	}
+}
+
+// What a trade moves. Each side is paid out of the hold of the order (or
+// group) that funds it.
+type ledgerTrade struct {
+	TradeID  int64
+	Base     Asset
+	Quote    Asset
+	Size     decimal.Decimal // In the base asset
+	Notional decimal.Decimal // In the quote asset
+
+	BuyerID     int64
+	BuyOrderID  int64
+	BuyHold     int64
+	SellerID    int64
+	SellOrderID int64
+	SellHold    int64
+}
+
+// Books a trade - the buyer's locked quote to the seller and the seller's
+// locked base to the buyer. Orders are funded before they can trade, so holds
+// that don't cover it are a bug - nothing is booked and it's an
+// ErrUnfundedTrade rather than funds nobody locked.
+func (lg *Ledger) Trade(t ledgerTrade) error {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	if err := lg.covered(t.BuyHold, t.Quote, t.Notional); err != nil {
+		return err
+	}
+	if err := lg.covered(t.SellHold, t.Base, t.Size); err != nil {
+		return err
+	}
+
+	lg.spend(t.BuyHold, t.Quote, t.Notional)
+	lg.spend(t.SellHold, t.Base, t.Size)
+
+	lg.post(
+		Entry{Type: EntryTrade, UserID: t.BuyerID, Asset: t.Quote, Account: AccountLocked, Amount: -t.Notional, OrderID: t.BuyOrderID, TradeID: t.TradeID},
+		Entry{Type: EntryTrade, UserID: t.SellerID, Asset: t.Quote, Account: AccountAvailable, Amount: t.Notional, OrderID: t.SellOrderID, TradeID: t.TradeID},
+		Entry{Type: EntryTrade, UserID: t.SellerID, Asset: t.Base, Account: AccountLocked, Amount: -t.Size, OrderID: t.SellOrderID, TradeID: t.TradeID},
+		Entry{Type: EntryTrade, UserID: t.BuyerID, Asset: t.Base, Account: AccountAvailable, Amount: t.Size, OrderID: t.BuyOrderID, TradeID: t.TradeID},
+	)
+
+	return nil
+}
+
+// Every balance the user has
+func (lg *Ledger) Balances(userID int64) map[Asset]Balance {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	balances := make(map[Asset]Balance)
+	for asset, b := range lg.balances[userID] {
+		balances[asset] = *b
+	}
+
+	return balances
+}
+
+// The user's postings, oldest first
+func (lg *Ledger) Entries(userID int64) []Entry {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+
+	entries := []Entry{}
+	for _, e := range lg.entries {
+		if e.UserID == userID {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries
+}
+
+type InsufficientBalanceError struct {
+	Asset     Asset
+	Needed    decimal.Decimal
+	Available decimal.Decimal
+}
+
+func (e *InsufficientBalanceError) Error() string {
+	return fmt.Sprintf("%v: %d %s needed, %d available", ErrInsufficientBalance, e.Needed, e.Asset, e.Available)
+}
+
+func (e *InsufficientBalanceError) Unwrap() error {
+	return ErrInsufficientBalance
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+func TestLedger(t *testing.T) {
+	lg := NewLedger(systemClock{})
+
+	lg.Deposit(1, "USD", 1000)
+	lg.Deposit(2, "ETH", 10)
+
+	if err := lg.Hold(1, 100, "USD", 1001); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("held more than available: %v", err)
+	}
+
+	if err := lg.Hold(1, 100, "USD", 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := lg.Hold(2, 200, "ETH", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bought 3 for 450 out of a hold of 600
+	err := lg.Trade(ledgerTrade{
+		TradeID:  1,
+		Base:     "ETH",
+		Quote:    "USD",
+		Size:     3,
+		Notional: 450,
+		BuyerID:  1, BuyOrderID: 100, BuyHold: 100,
+		SellerID: 2, SellOrderID: 200, SellHold: 200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More than what's left of the hold - booked in full or not at all
+	unfunded := ledgerTrade{
+		TradeID:  2,
+		Base:     "ETH",
+		Quote:    "USD",
+		Size:     1,
+		Notional: 151,
+		BuyerID:  1, BuyOrderID: 100, BuyHold: 100,
+		SellerID: 2, SellOrderID: 200, SellHold: 200,
+	}
+	if err := lg.Trade(unfunded); !errors.Is(err, ErrUnfundedTrade) {
+		t.Errorf("unfunded trade: %v", err)
+	}
+
+	lg.Release(100, "ETH", "USD")
+
+	want := map[int64]map[Asset]Balance{
+		1: {"USD": {Available: 550}, "ETH": {Available: 3}},
+		2: {"USD": {Available: 450}, "ETH": {Available: 6, Locked: 1}},
+	}
+	for user, balances := range want {
+		for asset, b := range balances {
+			if got := lg.Balances(user)[asset]; got != b {
+				t.Errorf("user %d %s: got %+v, want %+v", user, asset, got, b)
+			}
+		}
+	}
+
+	// Double entry - every transaction adds up to zero for each asset
+	sums := make(map[string]decimal.Decimal)
+	for _, user := range []int64{1, 2} {
+		for _, e := range lg.Entries(user) {
+			sums[fmt.Sprintf("%d %s", e.ID, e.Asset)] += e.Amount
+
+			if e.Type == EntryTrade && (e.TradeID != 1 || e.OrderID == 0) {
+				t.Errorf("trade entry not linked: %+v", e)
+			}
+		}
+	}
+	for tx, sum := range sums {
+		if sum != 0 {
+			t.Errorf("transaction %s adds up to %d", tx, sum)
+		}
+	}
+}
+
+func TestOrderFunding(t *testing.T) {
+	chain := NewSimulatedChain()
+	ex, err := NewExchange(exchangePrivateKey, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Markets[MarketETH]
+	ex.ledger.Deposit(1, "USD", cfg.PriceScale.FromInt(1000))
+	ex.ledger.Deposit(2, "ETH", cfg.SizeScale.FromInt(1))
+
+	oneETH, _ := cfg.SettlementAmount(cfg.SizeScale.FromInt(1))
+	for _, id := range []int64{1, 2} {
+		ex.Users[id] = newTestUser(t, id)
+	}
+	chain.Fund(ex.Users[2].Address, oneETH)
+
+	e := echo.New()
+	e.POST("/order", ex.handlePlaceOrder)
+	e.DELETE("/order/:id", ex.cancelOrder)
+	e.PATCH("/order/:id", ex.handleAmendOrder)
+
+	balance := func(user int64, asset Asset) Balance {
+		return ex.ledger.Balances(user)[asset]
+	}
+
+	bid := PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "2000.00", Market: MarketETH}
+	if rec := request(e, http.MethodPost, "/order", bid); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unaffordable order: %d %s", rec.Code, rec.Body)
+	}
+
+	bid.Size, bid.Price = "0.5", "1000.00"
+	rec := request(e, http.MethodPost, "/order", bid)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	if got := balance(1, "USD"); got.Available != 50_000 || got.Locked != 50_000 {
+		t.Errorf("hold: got %+v", got)
+	}
+
+	var resp PlaceOrderResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	path := fmt.Sprintf("/order/%d", resp.OrderID)
+
+	// 1,500.00 needed with 1,000.00 on the account
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Size: "1.5"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unaffordable amend: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Size: "0.2"}); rec.Code != http.StatusOK {
+		t.Fatalf("amend: %d %s", rec.Code, rec.Body)
+	}
+
+	if got := balance(1, "USD"); got.Available != 80_000 || got.Locked != 20_000 {
+		t.Errorf("after amend: got %+v", got)
+	}
+
+	if rec := request(e, http.MethodDelete, path, nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancel: %d %s", rec.Code, rec.Body)
+	}
+
+	if got := balance(1, "USD"); got.Available != 100_000 || got.Locked != 0 {
+		t.Errorf("after cancel: got %+v", got)
+	}
+
+	ask := PlaceOrderRequest{UserID: 2, Type: LimitOrder, Size: "0.5", Price: "1000.00", Market: MarketETH}
+	if rec := request(e, http.MethodPost, "/order", ask); rec.Code != http.StatusOK {
+		t.Fatalf("ask: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := request(e, http.MethodPost, "/order", bid); rec.Code != http.StatusOK {
+		t.Fatalf("crossing bid: %d %s", rec.Code, rec.Body)
+	}
+
+	want := map[int64]map[Asset]Balance{
+		1: {"USD": {Available: 50_000}, "ETH": {Available: 50_000_000}},
+		2: {"USD": {Available: 50_000}, "ETH": {Available: 50_000_000}},
+	}
+	for user, balances := range want {
+		for asset, b := range balances {
+			if got := balance(user, asset); got != b {
+				t.Errorf("user %d %s: got %+v, want %+v", user, asset, got, b)
+			}
+		}
+	}
+
+	// Settled on the chain too
+	ex.settlements.Process(context.Background())
+	if got := ex.settlements.ForUser(1); len(got) != 1 || got[0].Status != SettlementConfirmed {
+		t.Errorf("settlements: got %+v", got)
+	}
+
+	halfETH := new(big.Int).Div(oneETH, big.NewInt(2))
+	for _, id := range []int64{1, 2} {
+		if got, _ := chain.Balance(context.Background(), ex.Users[id].Address); got.Cmp(halfETH) != 0 {
+			t.Errorf("user %d on chain: got %v, want %v", id, got, halfETH)
+		}
+	}
+}
+
+// Orders the book sends in on its own are funded at the price they go in at,
+// or cancelled if the user can't cover it
+func TestFundingTopUps(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+	cfg := Markets[MarketETH]
+
+	// Nothing on the account
+	ex.Users[3] = newTestUser(t, 3)
+	// Enough for a bid at 900.00 but not at 950.00
+	ex.Users[4] = newTestUser(t, 4)
+	ex.ledger.Deposit(4, "USD", cfg.PriceScale.FromInt(900))
+
+	balance := func(user int64, asset Asset) Balance {
+		return ex.ledger.Balances(user)[asset]
+	}
+
+	place := func(req any) {
+		t.Helper()
+
+		path := "/order"
+		if _, ok := req.(PlaceGroupRequest); ok {
+			path = "/orders/group"
+		}
+
+		if rec := request(e, http.MethodPost, path, req); rec.Code != http.StatusOK {
+			t.Fatalf("place: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	// No asks, so the stop holds nothing until it triggers
+	place(PlaceOrderRequest{UserID: 3, Type: StopMarketOrder, Bid: true, Size: "1", StopPrice: "1000.00", Market: MarketETH})
+	place(PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: "2", Price: "1000.00", Market: MarketETH})
+	place(PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: "1", Market: MarketETH})
+
+	if got := balance(3, "USD"); got != (Balance{}) {
+		t.Errorf("triggered stop: got %+v", got)
+	}
+	if got := balance(1, "ETH").Locked; got != cfg.SizeScale.FromInt(1) {
+		t.Errorf("stop traded: %d ETH still offered", got)
+	}
+
+	// Uncapped pegged bids follow the touch up, holding more as they go
+	place(PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "900.00", Market: MarketETH})
+	place(PlaceOrderRequest{UserID: 2, Type: PeggedOrder, Bid: true, Size: "1", PegReference: orderbook.PegBestBid, Market: MarketETH})
+	place(PlaceOrderRequest{UserID: 4, Type: PeggedOrder, Bid: true, Size: "1", PegReference: orderbook.PegBestBid, Market: MarketETH})
+	place(PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "950.00", Market: MarketETH})
+
+	if got := balance(2, "USD").Locked; got != cfg.PriceScale.FromInt(950) {
+		t.Errorf("repriced peg: %d USD locked", got)
+	}
+	if got := balance(4, "USD"); got != (Balance{Available: cfg.PriceScale.FromInt(900)}) {
+		t.Errorf("unaffordable peg: got %+v", got)
+	}
+
+	// The bracket's legs lock what the entry bought once it fills
+	place(PlaceGroupRequest{
+		UserID: 2,
+		Market: MarketETH,
+		Type:   orderbook.Bracket,
+		Entry:  &GroupLegRequest{Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00"},
+		Legs: []*GroupLegRequest{
+			{Type: LimitOrder, Size: "1", Price: "1200.00"},
+			{Type: StopMarketOrder, Size: "1", StopPrice: "900.00"},
+		},
+	})
+
+	if got := balance(2, "ETH").Locked; got != cfg.SizeScale.FromInt(1) {
+		t.Errorf("bracket legs: %d ETH locked", got)
+	}
+}
+
+// Group legs are amended against their group's hold
+func TestAmendGroupLeg(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+	cfg := Markets[MarketETH]
+
+	rec := request(e, http.MethodPost, "/orders/group", PlaceGroupRequest{
+		UserID: 1,
+		Market: MarketETH,
+		Type:   orderbook.OneCancelsOther,
+		Legs: []*GroupLegRequest{
+			{Type: LimitOrder, Size: "1", Price: "1500.00"},
+			{Type: StopMarketOrder, Size: "1", StopPrice: "900.00"},
+		},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	var group OrderGroup
+	json.Unmarshal(rec.Body.Bytes(), &group)
+	path := fmt.Sprintf("/order/%d", group.Legs[0].ID)
+
+	// 100 ETH on the account
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Size: "150"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("unaffordable amend: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Size: "50"}); rec.Code != http.StatusOK {
+		t.Fatalf("amend: %d %s", rec.Code, rec.Body)
+	}
+
+	if got := ex.ledger.Balances(1)["ETH"].Locked; got != cfg.SizeScale.FromInt(50) {
+		t.Errorf("group hold: %d ETH locked", got)
+	}
+
+	if rec := request(e, http.MethodPost, "/order", PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: "30", Market: MarketETH}); rec.Code != http.StatusOK {
+		t.Fatalf("buy: %d %s", rec.Code, rec.Body)
+	}
+
+	if got := ex.ledger.Balances(2)["ETH"].Available; got != cfg.SizeScale.FromInt(130) {
+		t.Errorf("fill not booked: buyer has %d ETH", got)
+	}
+}
+
+// A trade the ledger refuses isn't paid for, so it isn't settled either
+func TestRefusedTradeNotSettled(t *testing.T) {
+	ex, _ := newTestExchange(t, 1, 2)
+	l, _ := ex.registry.Get(MarketETH)
+
+	// Neither order holds anything
+	bid, ask := orderbook.NewOrder(true, 1, 1), orderbook.NewOrder(false, 1, 2)
+	bid.ID, ask.ID = 1_000, 1_001
+	matches := []orderbook.Match{{Bid: bid, Ask: ask, SizeFilled: 1, Price: 100_000, TradeID: 1}}
+
+	var fills []fill
+	l.do(func(ob *orderbook.Orderbook) {
+		fills = ex.handleMatches(l, matches)
+	})
+
+	if len(fills) != 0 {
+		t.Errorf("settled a refused trade: %+v", fills)
+	}
+	if entries := ex.ledger.Entries(1); entries[len(entries)-1].Type == EntryTrade {
+		t.Errorf("booked an unfunded trade")
+	}
+}
+
+// A market buy's hold covers the user's own asks it will trade with
+func TestHoldOwnAsks(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+	l, _ := ex.registry.Get(MarketETH)
+	cfg := l.Config
+
+	for _, ask := range []PlaceOrderRequest{
+		{UserID: 1, Type: LimitOrder, Size: "1", Price: "1000.00", Market: MarketETH},
+		{UserID: 2, Type: LimitOrder, Size: "1", Price: "1001.00", Market: MarketETH},
+	} {
+		if rec := request(e, http.MethodPost, "/order", ask); rec.Code != http.StatusOK {
+			t.Fatalf("ask: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	one := cfg.SizeScale.FromInt(1)
+	cost := func(price string) decimal.Decimal {
+		p, _ := cfg.PriceScale.Parse(price)
+		return toDecimal(cfg.NotionalUp(p, one))
+	}
+
+	cases := map[orderbook.SelfTradePrevention]decimal.Decimal{
+		"":                           cost("1000.00") + cost("1001.00"),
+		orderbook.CancelOldest:       cost("1001.00"),
+		orderbook.DecrementAndCancel: cost("1001.00"),
+		orderbook.CancelNewest:       0,
+		orderbook.CancelBoth:         0,
+	}
+
+	for stp, want := range cases {
+		buy := orderbook.NewOrder(true, 2*one, 1)
+		buy.SelfTradePrevention = stp
+
+		var got decimal.Decimal
+		l.do(func(ob *orderbook.Orderbook) {
+			_, got = holdAmount(l, ob, buy, 0, buy.Size)
+		})
+
+		if got != want {
+			t.Errorf("%q: hold %d, want %d", stp, got, want)
+		}
+	}
+}
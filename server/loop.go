@@ -0,0 +1,180 @@
+package server
+
+import (
+	"sync/atomic"
+
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+// Every change to a market's orderbook runs on one goroutine, in the order the
+// commands were submitted. Reads are served from a snapshot of the book, built
+// on the loop the first time something reads it after a change and shared by
+// every read until the next one, so matching never pays for it.
+type matchingLoop struct {
+	commands chan command
+	snapshot atomic.Pointer[bookSnapshot]
+	// Bumped by every command that can change the book, the snapshot is
+	// current while it was built at the same version
+	version atomic.Uint64
+}
+
+type command struct {
+	fn   func(ob *orderbook.Orderbook)
+	done chan struct{}
+	// Only reads the book, so the snapshot stays current
+	read bool
+}
+
+func newMatchingLoop(l *Listing) *matchingLoop {
+	m := &matchingLoop{
+		commands: make(chan command, 64),
+	}
+	m.snapshot.Store(newBookSnapshot(l))
+
+	go m.run(l)
+
+	return m
+}
+
+func (m *matchingLoop) run(l *Listing) {
+	for cmd := range m.commands {
+		cmd.fn(l.orderbook)
+
+		// Bumped before the command counts as done, so whoever submitted it
+		// reads their own writes
+		if !cmd.read {
+			m.version.Add(1)
+		}
+		close(cmd.done)
+	}
+}
+
+// Runs fn on the market's matching loop and waits for it. fn has the
+// orderbook to itself - it must not submit commands of its own, and orders it
+// touches must only be read inside a command.
+func (l *Listing) do(fn func(ob *orderbook.Orderbook)) {
+	l.loop.submit(command{fn: fn, done: make(chan struct{})})
+}
+
+func (m *matchingLoop) submit(cmd command) {
+	m.commands <- cmd
+	<-cmd.done
+}
+
+// The market as of the last command. Never modified once published. May wait
+// on the loop, so it can't be called from a command or with a lock a command
+// takes.
+func (l *Listing) snapshot() *bookSnapshot {
+	m := l.loop
+
+	if s := m.snapshot.Load(); s.version == m.version.Load() {
+		return s
+	}
+
+	m.submit(command{
+		fn: func(ob *orderbook.Orderbook) {
+			// Another read may have got there first
+			version := m.version.Load()
+			if m.snapshot.Load().version == version {
+				return
+			}
+
+			s := newBookSnapshot(l)
+			s.version = version
+			m.snapshot.Store(s)
+		},
+		done: make(chan struct{}),
+		read: true,
+	})
+
+	return m.snapshot.Load()
+}
+
+type bookSnapshot struct {
+	version uint64 // Of the loop when it was built
+
+	book *OrderBookuserOrders // What GET /book returns
+
+	// Zero when that side is empty
+	bestBid decimal.Decimal
+	bestAsk decimal.Decimal
+
+	// Every order still live in the market - resting orders, pending stops and
+	// bracket legs waiting for their entry
+	orders map[int64]*Order
+	// Group of each grouped order in orders
+	groups map[int64]*OrderGroup
+
+	// Trades are never modified after they're made, only appended to
+	trades []*orderbook.Trade
+
+	inAuction bool
+	auction   orderbook.AuctionState
+}
+
+func newBookSnapshot(l *Listing) *bookSnapshot {
+	ob := l.orderbook
+	cfg := l.Config
+
+	s := &bookSnapshot{
+		book: &OrderBookuserOrders{
+			TotalBidVolume: cfg.FormatSize(ob.BidDisplayVolume()),
+			TotalAskVolume: cfg.FormatSize(ob.AskDisplayVolume()),
+			Asks:           []*Order{},
+			Bids:           []*Order{},
+		},
+		orders:    make(map[int64]*Order),
+		groups:    make(map[int64]*OrderGroup),
+		trades:    ob.Trades[:len(ob.Trades):len(ob.Trades)],
+		inAuction: ob.InAuction(),
+	}
+
+	if best := ob.BestBid(); best != nil {
+		s.bestBid = best.Price
+	}
+	if best := ob.BestAsk(); best != nil {
+		s.bestAsk = best.Price
+	}
+
+	if s.inAuction {
+		s.auction = ob.Indicative()
+	}
+
+	for _, limit := range ob.Asks() {
+		for _, o := range limit.Orders() {
+			s.book.Asks = append(s.book.Asks, newBookOrder(l, o))
+			s.add(l, o)
+		}
+	}
+
+	for _, limit := range ob.Bids() {
+		for _, o := range limit.Orders() {
+			s.book.Bids = append(s.book.Bids, newBookOrder(l, o))
+			s.add(l, o)
+		}
+	}
+
+	for _, o := range ob.Stops() {
+		s.add(l, o)
+	}
+
+	return s
+}
+
+// Adds the order, and the rest of its group if it has one
+func (s *bookSnapshot) add(l *Listing, o *orderbook.Order) {
+	s.orders[o.ID] = newOrder(l, o)
+
+	if o.Group == nil || s.groups[o.ID] != nil {
+		return
+	}
+
+	group := newOrderGroup(l, o.Group)
+	for _, member := range o.Group.Orders() {
+		if !member.IsDone() {
+			s.groups[member.ID] = group
+			s.orders[member.ID] = newOrder(l, member)
+		}
+	}
+}
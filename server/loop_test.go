@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func request(e *echo.Echo, method, path string, body any) *httptest.ResponseRecorder {
+	var b []byte
+	if body != nil {
+		b, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, path, strings.NewReader(string(b)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// Writers and readers hammer one market at once. Run with -race.
+func TestMatchingLoopConcurrent(t *testing.T) {
+	ex, err := NewExchange(exchangePrivateKey, NewSimulatedChain())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Markets[MarketETH]
+	for user := int64(1); user <= 8; user++ {
+		ex.ledger.Deposit(user, "ETH", cfg.SizeScale.FromInt(100))
+		ex.ledger.Deposit(user, "USD", cfg.PriceScale.FromInt(100_000))
+	}
+
+	e := echo.New()
+	e.GET("/book/:market", ex.handleGetBook)
+	e.GET("/book/:market/bid", ex.handleGetBestBid)
+	e.GET("/orders/:userID", ex.handleGetOrders)
+	e.GET("/orderbook/:market", ex.getOrderBook)
+	e.GET("/trades/:market", ex.handleGetTrades)
+	e.POST("/order", ex.handlePlaceOrder)
+	e.DELETE("/order/:id", ex.cancelOrder)
+	e.PATCH("/order/:id", ex.handleAmendOrder)
+
+	const (
+		users  = 8
+		orders = 50
+	)
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+	resting := make([]int, users+1)
+
+	for user := 1; user <= users; user++ {
+		writers.Add(1)
+		go func(user int) {
+			defer writers.Done()
+
+			for i := 0; i < orders; i++ {
+				// Bids and asks never cross, so nothing needs settling
+				bid := i%2 == 0
+				price := fmt.Sprintf("1000.0%d", i%10)
+				if !bid {
+					price = fmt.Sprintf("1100.0%d", i%10)
+				}
+
+				rec := request(e, http.MethodPost, "/order", PlaceOrderRequest{
+					UserID: int64(user),
+					Type:   LimitOrder,
+					Bid:    bid,
+					Size:   "0.01",
+					Price:  price,
+					Market: MarketETH,
+				})
+				if rec.Code != http.StatusOK {
+					t.Errorf("place: %d %s", rec.Code, rec.Body)
+					return
+				}
+
+				var resp PlaceOrderResponse
+				json.Unmarshal(rec.Body.Bytes(), &resp)
+				path := fmt.Sprintf("/order/%d", resp.OrderID)
+
+				if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Size: "0.02"}); rec.Code != http.StatusOK {
+					t.Errorf("amend: %d %s", rec.Code, rec.Body)
+				}
+
+				if i%3 == 0 {
+					if rec := request(e, http.MethodDelete, path, nil); rec.Code != http.StatusOK {
+						t.Errorf("cancel: %d %s", rec.Code, rec.Body)
+					}
+					continue
+				}
+
+				resting[user]++
+			}
+		}(user)
+	}
+
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+
+			paths := []string{"/book/ETH", "/book/ETH/bid", "/orderbook/ETH", "/trades/ETH", fmt.Sprintf("/orders/%d", i+1)}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				for _, path := range paths {
+					request(e, http.MethodGet, path, nil)
+				}
+			}
+		}(i)
+	}
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	var book OrderBookuserOrders
+	json.Unmarshal(request(e, http.MethodGet, "/book/ETH", nil).Body.Bytes(), &book)
+
+	total := 0
+	for user := 1; user <= users; user++ {
+		var resp GetOrdersResponse
+		json.Unmarshal(request(e, http.MethodGet, fmt.Sprintf("/orders/%d", user), nil).Body.Bytes(), &resp)
+
+		if got := len(resp.Bids) + len(resp.Asks); got != resting[user] {
+			t.Errorf("user %d: got %d orders, want %d", user, got, resting[user])
+		}
+
+		total += resting[user]
+	}
+
+	if got := len(book.Bids) + len(book.Asks); got != total {
+		t.Errorf("book: got %d orders, want %d", got, total)
+	}
+
+	for _, o := range append(book.Bids, book.Asks...) {
+		if o.Size != "0.02000000" {
+			t.Errorf("order %d not amended: %s", o.ID, o.Size)
+			break
+		}
+	}
+}
+
+// Commands leave the snapshot alone, the first read after them builds it
+func TestSnapshotBuiltOnRead(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+	l, _ := ex.registry.Get(MarketETH)
+
+	before := l.snapshot()
+
+	rec := request(e, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00", Market: MarketETH})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	if l.loop.snapshot.Load() != before {
+		t.Errorf("snapshot built by the command")
+	}
+
+	after := l.snapshot()
+	if after == before || len(after.orders) != 1 {
+		t.Errorf("read after the command: got %d orders", len(after.orders))
+	}
+
+	if l.snapshot() != after {
+		t.Errorf("rebuilt without a change")
+	}
+}
@@ -0,0 +1,396 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+// Prices and sizes travel through the API as decimal strings and through the
+// orderbook as raw fixed-point units. The scales here are what convert one
+// into the other for a given market.
+type MarketConfig struct {
+	PriceScale decimal.Scale
+	SizeScale  decimal.Scale
+
+	// Decimals of the base asset on chain, e.g. 18 for wei
+	SettlementScale decimal.Scale
+
+	// Time after midnight UTC when the trading session ends and DAY orders
+	// expire
+	SessionClose time.Duration
+
+	// Trading rules, at the price and size scales. Tick, lot and minimum
+	// size are required, zero turns the notional limits off.
+	TickSize    decimal.Decimal // Prices must be a multiple of this
+	LotSize     decimal.Decimal // Sizes must be a multiple of this
+	MinSize     decimal.Decimal
+	MinNotional decimal.Decimal // Price times size
+	MaxNotional decimal.Decimal
+
+	// Price band either side of the reference price, at
+	// orderbook.PercentScale. Zero turns it off.
+	BandPercent   decimal.Decimal
+	BandReference orderbook.BandReference
+	BandWindow    time.Duration // For a VWAP reference
+
+	// Halts the market for CoolOff when the price moves more than
+	// BreakerPercent within BreakerWindow. Zero turns it off.
+	BreakerPercent decimal.Decimal
+	BreakerWindow  time.Duration
+	CoolOff        time.Duration
+	// Time the market spends in an auction before it reopens after a halt,
+	// zero reopens straight into continuous trading
+	ReopenAuction time.Duration
+}
+
+var Markets = map[Market]MarketConfig{
+	MarketETH: {
+		PriceScale:      2,
+		SizeScale:       8,
+		SettlementScale: 18,
+		SessionClose:    22 * time.Hour,
+		TickSize:        1,              // 0.01
+		LotSize:         10_000,         // 0.0001 ETH
+		MinSize:         100_000,        // 0.001 ETH
+		MinNotional:     100,            // 1.00
+		MaxNotional:     10_000_000_000, // 100,000,000.00
+		BandPercent:     2000,           // 20%
+		BandReference:   orderbook.BandVWAP,
+		BandWindow:      5 * time.Minute,
+		BreakerPercent:  1500, // 15%
+		BreakerWindow:   time.Minute,
+		CoolOff:         2 * time.Minute,
+		ReopenAuction:   30 * time.Second,
+	},
+}
+
+func (m MarketConfig) ParsePrice(s string) (decimal.Decimal, error) {
+	return m.PriceScale.Parse(s)
+}
+
+func (m MarketConfig) ParseSize(s string) (decimal.Decimal, error) {
+	return m.SizeScale.Parse(s)
+}
+
+func (m MarketConfig) FormatPrice(d decimal.Decimal) string {
+	return m.PriceScale.Format(d)
+}
+
+func (m MarketConfig) FormatSize(d decimal.Decimal) string {
+	return m.SizeScale.Format(d)
+}
+
+// Amount of the base asset to move on chain for a fill of this size
+func (m MarketConfig) SettlementAmount(size decimal.Decimal) (*big.Int, error) {
+	return m.SizeScale.Big(size, m.SettlementScale)
+}
+
+// Expiry of a DAY order placed at now - the next session close of the market
+func (m MarketConfig) DayExpiry(now time.Time) time.Time {
+	now = now.UTC()
+
+	close := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(m.SessionClose)
+	if !close.After(now) {
+		close = close.AddDate(0, 0, 1)
+	}
+
+	return close
+}
+
+// Price rounded down to the tick grid
+func (m MarketConfig) RoundPrice(d decimal.Decimal) decimal.Decimal {
+	if m.TickSize == 0 {
+		return d
+	}
+
+	return d - d%m.TickSize
+}
+
+// Size rounded down to a whole number of lots
+func (m MarketConfig) RoundSize(d decimal.Decimal) decimal.Decimal {
+	if m.LotSize == 0 {
+		return d
+	}
+
+	return d - d%m.LotSize
+}
+
+var (
+	ErrMarketRules  = errors.New("order breaks the market rules")
+	ErrMarketConfig = errors.New("invalid market config")
+)
+
+// Checks the config is one a market can trade under
+func (m MarketConfig) Validate() error {
+	if m.PriceScale > decimal.MaxScale || m.SizeScale > decimal.MaxScale {
+		return fmt.Errorf("%w: scales go up to %d", ErrMarketConfig, decimal.MaxScale)
+	}
+
+	// Sizes have to convert to the chain's units for settlement
+	if m.SettlementScale < m.SizeScale {
+		return fmt.Errorf("%w: settlement scale %d is below the size scale %d", ErrMarketConfig, m.SettlementScale, m.SizeScale)
+	}
+
+	positive := []struct {
+		name  string
+		value decimal.Decimal
+	}{
+		{"tick size", m.TickSize},
+		{"lot size", m.LotSize},
+		{"minimum size", m.MinSize},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			return fmt.Errorf("%w: %s must be positive", ErrMarketConfig, p.name)
+		}
+	}
+
+	notNegative := []struct {
+		name  string
+		value decimal.Decimal
+	}{
+		{"minimum notional", m.MinNotional},
+		{"maximum notional", m.MaxNotional},
+		{"band percent", m.BandPercent},
+		{"breaker percent", m.BreakerPercent},
+	}
+	for _, n := range notNegative {
+		if n.value < 0 {
+			return fmt.Errorf("%w: %s can't be negative", ErrMarketConfig, n.name)
+		}
+	}
+
+	switch m.BandReference {
+	// Empty is the last trade
+	case "", orderbook.BandLastTrade, orderbook.BandVWAP:
+	default:
+		return fmt.Errorf("%w: unknown band reference %q", ErrMarketConfig, m.BandReference)
+	}
+
+	return nil
+}
+
+func (m MarketConfig) ValidatePrice(price decimal.Decimal) error {
+	if price <= 0 {
+		return fmt.Errorf("%w: price %s must be positive", ErrMarketRules, m.FormatPrice(price))
+	}
+
+	return m.ValidateIncrement(price)
+}
+
+// For price offsets and amounts - they can be anything on the tick grid
+func (m MarketConfig) ValidateIncrement(d decimal.Decimal) error {
+	if m.TickSize != 0 && d%m.TickSize != 0 {
+		return fmt.Errorf("%w: %s is not a multiple of the tick size %s", ErrMarketRules, m.FormatPrice(d), m.FormatPrice(m.TickSize))
+	}
+
+	return nil
+}
+
+func (m MarketConfig) ValidateSize(size decimal.Decimal) error {
+	if size <= 0 {
+		return fmt.Errorf("%w: size %s must be positive", ErrMarketRules, m.FormatSize(size))
+	}
+
+	if size < m.MinSize {
+		return fmt.Errorf("%w: size %s is below the minimum size %s", ErrMarketRules, m.FormatSize(size), m.FormatSize(m.MinSize))
+	}
+
+	if m.LotSize != 0 && size%m.LotSize != 0 {
+		return fmt.Errorf("%w: size %s is not a multiple of the lot size %s", ErrMarketRules, m.FormatSize(size), m.FormatSize(m.LotSize))
+	}
+
+	return nil
+}
+
+// Price times size, at the price scale. Done in big ints since the raw product
+// can overflow an int64.
+func (m MarketConfig) Notional(price, size decimal.Decimal) *big.Int {
+	notional := new(big.Int).Mul(big.NewInt(int64(price)), big.NewInt(int64(size)))
+
+	return notional.Quo(notional, big.NewInt(int64(m.SizeScale.Unit())))
+}
+
+// Notional rounded up instead of down, for what a buyer has to put aside
+func (m MarketConfig) NotionalUp(price, size decimal.Decimal) *big.Int {
+	notional := new(big.Int).Mul(big.NewInt(int64(price)), big.NewInt(int64(size)))
+	unit := big.NewInt(int64(m.SizeScale.Unit()))
+
+	notional.Add(notional, unit)
+	notional.Sub(notional, big.NewInt(1))
+
+	return notional.Quo(notional, unit)
+}
+
+func (m MarketConfig) ValidateNotional(price, size decimal.Decimal) error {
+	notional := m.Notional(price, size)
+
+	if m.MinNotional != 0 && notional.Cmp(big.NewInt(int64(m.MinNotional))) < 0 {
+		return fmt.Errorf("%w: notional %s is below the minimum %s", ErrMarketRules, m.formatNotional(notional), m.FormatPrice(m.MinNotional))
+	}
+
+	if m.MaxNotional != 0 && notional.Cmp(big.NewInt(int64(m.MaxNotional))) > 0 {
+		return fmt.Errorf("%w: notional %s is above the maximum %s", ErrMarketRules, m.formatNotional(notional), m.FormatPrice(m.MaxNotional))
+	}
+
+	return nil
+}
+
+func (m MarketConfig) formatNotional(n *big.Int) string {
+	if !n.IsInt64() {
+		return "too large"
+	}
+
+	return m.FormatPrice(decimal.Decimal(n.Int64()))
+}
+
+// Checks everything about a limit order that the market rules cover
+func (m MarketConfig) ValidateOrder(price, size decimal.Decimal) error {
+	if err := m.ValidatePrice(price); err != nil {
+		return err
+	}
+
+	if err := m.ValidateSize(size); err != nil {
+		return err
+	}
+
+	return m.ValidateNotional(price, size)
+}
+
+// What GET /markets/:market returns, everything as decimal strings. Also the
+// body for listing a new market.
+type MarketSpec struct {
+	Market          Market
+	Base            string
+	Quote           string
+	Status          MarketStatus `json:",omitempty"`
+	PriceScale      decimal.Scale
+	SizeScale       decimal.Scale
+	SettlementScale decimal.Scale
+	SessionClose    string `json:",omitempty"` // e.g. 22h
+	TickSize        string
+	LotSize         string
+	MinSize         string
+	MinNotional     string
+	MaxNotional     string
+
+	// Percentages like 15.00, left out when turned off
+	BandPercent    string                  `json:",omitempty"`
+	BandReference  orderbook.BandReference `json:",omitempty"`
+	BandWindow     string                  `json:",omitempty"`
+	BreakerPercent string                  `json:",omitempty"`
+	BreakerWindow  string                  `json:",omitempty"`
+	CoolOff        string                  `json:",omitempty"`
+	ReopenAuction  string                  `json:",omitempty"`
+}
+
+func newMarketSpec(market Market, m MarketConfig) *MarketSpec {
+	spec := &MarketSpec{
+		Market:          market,
+		PriceScale:      m.PriceScale,
+		SizeScale:       m.SizeScale,
+		SettlementScale: m.SettlementScale,
+		TickSize:        m.FormatPrice(m.TickSize),
+		LotSize:         m.FormatSize(m.LotSize),
+		MinSize:         m.FormatSize(m.MinSize),
+		MinNotional:     m.FormatPrice(m.MinNotional),
+		MaxNotional:     m.FormatPrice(m.MaxNotional),
+		BandReference:   m.BandReference,
+	}
+
+	durations := []struct {
+		dst *string
+		src time.Duration
+	}{
+		{&spec.SessionClose, m.SessionClose},
+		{&spec.BandWindow, m.BandWindow},
+		{&spec.BreakerWindow, m.BreakerWindow},
+		{&spec.CoolOff, m.CoolOff},
+		{&spec.ReopenAuction, m.ReopenAuction},
+	}
+
+	for _, d := range durations {
+		if d.src != 0 {
+			*d.dst = d.src.String()
+		}
+	}
+
+	if m.BandPercent != 0 {
+		spec.BandPercent = orderbook.PercentScale.Format(m.BandPercent)
+	}
+	if m.BreakerPercent != 0 {
+		spec.BreakerPercent = orderbook.PercentScale.Format(m.BreakerPercent)
+	}
+
+	return spec
+}
+
+// Turns the spec back into a config, e.g. for a client to round its own
+// prices and sizes. Fails with ErrMarketConfig if it isn't a valid one.
+func (s *MarketSpec) Config() (MarketConfig, error) {
+	m := MarketConfig{
+		PriceScale:      s.PriceScale,
+		SizeScale:       s.SizeScale,
+		SettlementScale: s.SettlementScale,
+		BandReference:   s.BandReference,
+	}
+
+	var err error
+
+	durations := []struct {
+		dst *time.Duration
+		src string
+	}{
+		{&m.SessionClose, s.SessionClose},
+		{&m.BandWindow, s.BandWindow},
+		{&m.BreakerWindow, s.BreakerWindow},
+		{&m.CoolOff, s.CoolOff},
+		{&m.ReopenAuction, s.ReopenAuction},
+	}
+
+	for _, d := range durations {
+		if d.src == "" {
+			continue
+		}
+
+		if *d.dst, err = time.ParseDuration(d.src); err != nil {
+			return MarketConfig{}, fmt.Errorf("%w: %v", ErrMarketConfig, err)
+		}
+	}
+
+	fields := []struct {
+		dst      *decimal.Decimal
+		src      string
+		scale    decimal.Scale
+		optional bool
+	}{
+		{&m.TickSize, s.TickSize, s.PriceScale, false},
+		{&m.LotSize, s.LotSize, s.SizeScale, false},
+		{&m.MinSize, s.MinSize, s.SizeScale, false},
+		{&m.MinNotional, s.MinNotional, s.PriceScale, false},
+		{&m.MaxNotional, s.MaxNotional, s.PriceScale, false},
+		{&m.BandPercent, s.BandPercent, orderbook.PercentScale, true},
+		{&m.BreakerPercent, s.BreakerPercent, orderbook.PercentScale, true},
+	}
+
+	for _, f := range fields {
+		if f.optional && f.src == "" {
+			continue
+		}
+
+		if *f.dst, err = f.scale.Parse(f.src); err != nil {
+			return MarketConfig{}, fmt.Errorf("%w: %v", ErrMarketConfig, err)
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return MarketConfig{}, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+func TestMarketRules(t *testing.T) {
+	eth := Markets[MarketETH]
+
+	price, _ := eth.ParsePrice("2000.05")
+	size, _ := eth.ParseSize("0.5")
+
+	if err := eth.ValidateOrder(price, size); err != nil {
+		t.Fatalf("valid order rejected: %v", err)
+	}
+
+	cases := map[string][2]string{
+		"zero price":     {"0", "1"},
+		"negative size":  {"2000", "-1"},
+		"below min size": {"2000", "0.0005"},
+		"odd lot":        {"2000", "0.00101"},
+		"min notional":   {"0.5", "1"},
+		"max notional":   {"2000000", "100"},
+	}
+
+	for name, c := range cases {
+		price, _ := eth.ParsePrice(c[0])
+		size, _ := eth.ParseSize(c[1])
+
+		if err := eth.ValidateOrder(price, size); !errors.Is(err, ErrMarketRules) {
+			t.Errorf("%s: expected a market rules error, got %v", name, err)
+		}
+	}
+
+	if got := eth.RoundSize(123_456_789); got != 123_450_000 {
+		t.Errorf("RoundSize: got %d", got)
+	}
+}
+
+func TestMarketSpecRoundTrip(t *testing.T) {
+	eth := Markets[MarketETH]
+
+	cfg, err := newMarketSpec(MarketETH, eth).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.TickSize != eth.TickSize || cfg.LotSize != eth.LotSize || cfg.MaxNotional != eth.MaxNotional {
+		t.Errorf("spec round trip: got %+v", cfg)
+	}
+
+	if cfg.BandPercent != eth.BandPercent || cfg.BandWindow != eth.BandWindow || cfg.CoolOff != eth.CoolOff || cfg.ReopenAuction != eth.ReopenAuction {
+		t.Errorf("spec round trip: got %+v", cfg)
+	}
+}
+
+// A market that couldn't trade or settle is turned away when it's listed
+func TestCreateMarketValidation(t *testing.T) {
+	ex, e := newTestExchange(t)
+	e.POST("/admin/markets", ex.handleCreateMarket)
+
+	cases := map[string]func(s *MarketSpec){
+		"tick size":        func(s *MarketSpec) { s.TickSize = "0.00" },
+		"lot size":         func(s *MarketSpec) { s.LotSize = "-0.0001" },
+		"minimum size":     func(s *MarketSpec) { s.MinSize = "0" },
+		"settlement scale": func(s *MarketSpec) { s.SettlementScale = s.SizeScale - 1 },
+		"band reference":   func(s *MarketSpec) { s.BandReference = "MIDPOINT" },
+		"duration":         func(s *MarketSpec) { s.CoolOff = "2 minutes" },
+	}
+
+	for name, breaks := range cases {
+		spec := newMarketSpec("BTC", Markets[MarketETH])
+		spec.Base, spec.Quote = "BTC", "USD"
+		breaks(spec)
+
+		if rec := request(e, http.MethodPost, "/admin/markets", spec); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	spec := newMarketSpec("BTC", Markets[MarketETH])
+	spec.Base, spec.Quote, spec.BandReference = "BTC", "USD", orderbook.BandLastTrade
+	if rec := request(e, http.MethodPost, "/admin/markets", spec); rec.Code != http.StatusCreated {
+		t.Errorf("valid market: got %d %s", rec.Code, rec.Body)
+	}
+}
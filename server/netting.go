@@ -0,0 +1,328 @@
+package server
+
+import (
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type NettingMode string
+
+const (
+	NettingOff NettingMode = ""
+	// What two users owe each other cancels out, leaving at most one
+	// transfer per pair
+	NettingBilateral NettingMode = "BILATERAL"
+	// Every user pays in or is paid out their net position, leaving at most
+	// one transfer fewer than the users involved
+	NettingMultilateral NettingMode = "MULTILATERAL"
+)
+
+// Fills of one asset settled together through a set of net transfers
+type netting struct {
+	id        int64
+	asset     Asset
+	fills     []*Settlement
+	transfers []*Settlement
+}
+
+// Where the netting is at - failed if any of its transfers failed, confirmed
+// once all of them are. With nothing left to move after netting it's
+// confirmed right away.
+func (n *netting) status() SettlementStatus {
+	status := SettlementConfirmed
+	for _, t := range n.transfers {
+		switch t.Status {
+		case SettlementFailed:
+			return SettlementFailed
+		case SettlementPending:
+			status = SettlementPending
+		case SettlementSubmitted:
+			if status == SettlementConfirmed {
+				status = SettlementSubmitted
+			}
+		}
+	}
+
+	return status
+}
+
+func (q *SettlementQueue) runNetting(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.mu.Lock()
+			q.closeWindow()
+			q.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Nets the fills in the window if it's due and hands the transfers to the
+// workers. Called with mu held.
+func (q *SettlementQueue) closeWindow() {
+	if len(q.window) == 0 {
+		return
+	}
+
+	full := q.cfg.NettingCount > 0 && len(q.window) >= q.cfg.NettingCount
+	over := q.cfg.NettingWindow > 0 && q.clock.Now().Sub(q.windowStart) >= q.cfg.NettingWindow
+	if !full && !over {
+		return
+	}
+
+	byAsset := make(map[Asset][]*Settlement)
+	assets := []Asset{}
+	for _, s := range q.window {
+		if byAsset[s.Asset] == nil {
+			assets = append(assets, s.Asset)
+		}
+		byAsset[s.Asset] = append(byAsset[s.Asset], s)
+	}
+	q.window = nil
+
+	for _, asset := range assets {
+		q.net(asset, byAsset[asset])
+	}
+}
+
+// Called with mu held
+func (q *SettlementQueue) net(asset Asset, fills []*Settlement) {
+	q.lastNetting++
+	n := &netting{id: q.lastNetting, asset: asset, fills: fills}
+	q.nettings[n.id] = n
+
+	var positions []position
+	if q.cfg.Netting == NettingBilateral {
+		positions = netBilateral(fills)
+	} else {
+		positions = netMultilateral(fills)
+	}
+
+	now := q.clock.Now().UnixNano()
+	for _, p := range positions {
+		t := &Settlement{
+			NettingID:  n.id,
+			Asset:      asset,
+			FromUserID: p.from,
+			ToUserID:   p.to,
+			Amount:     p.amount,
+			Status:     SettlementPending,
+			UpdatedAt:  now,
+		}
+		n.transfers = append(n.transfers, t)
+		q.record(t)
+
+		w := q.worker(t.FromUserID)
+		w.queued = append(w.queued, t)
+	}
+
+	for _, s := range fills {
+		s.NettingID = n.id
+		s.UpdatedAt = now
+		q.record(s)
+	}
+	q.updateFills(n)
+}
+
+// Brings the fills of the netting in line with its transfers. Called with mu
+// held.
+func (q *SettlementQueue) updateFills(n *netting) {
+	status := n.status()
+	now := q.clock.Now().UnixNano()
+
+	for _, s := range n.fills {
+		if s.Status == status {
+			continue
+		}
+
+		s.Status = status
+		s.UpdatedAt = now
+		q.record(s)
+	}
+}
+
+// Called with mu held
+func (q *SettlementQueue) nettingFor(id int64, asset Asset) *netting {
+	n, ok := q.nettings[id]
+	if !ok {
+		n = &netting{id: id, asset: asset}
+		q.nettings[id] = n
+	}
+
+	q.lastNetting = max(q.lastNetting, id)
+
+	return n
+}
+
+// Called with mu held while restoring
+func (q *SettlementQueue) restoreNetTransfer(s *Settlement) {
+	n := q.nettingFor(s.NettingID, s.Asset)
+
+	for i, t := range n.transfers {
+		if t.FromUserID == s.FromUserID && t.ToUserID == s.ToUserID {
+			n.transfers[i] = s
+			return
+		}
+	}
+
+	n.transfers = append(n.transfers, s)
+}
+
+// A net amount one user pays another
+type position struct {
+	from   int64
+	to     int64
+	amount *big.Int
+}
+
+func netBilateral(fills []*Settlement) []position {
+	type pair struct{ a, b int64 }
+
+	// Positive when a pays b
+	owed := make(map[pair]*big.Int)
+	pairs := []pair{}
+	for _, s := range fills {
+		if s.FromUserID == s.ToUserID {
+			continue
+		}
+
+		p, amount := pair{s.FromUserID, s.ToUserID}, s.Amount
+		if p.a > p.b {
+			p, amount = pair{p.b, p.a}, new(big.Int).Neg(amount)
+		}
+
+		if owed[p] == nil {
+			owed[p] = new(big.Int)
+			pairs = append(pairs, p)
+		}
+		owed[p].Add(owed[p], amount)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].a != pairs[j].a {
+			return pairs[i].a < pairs[j].a
+		}
+		return pairs[i].b < pairs[j].b
+	})
+
+	positions := []position{}
+	for _, p := range pairs {
+		switch amount := owed[p]; amount.Sign() {
+		case 1:
+			positions = append(positions, position{from: p.a, to: p.b, amount: amount})
+		case -1:
+			positions = append(positions, position{from: p.b, to: p.a, amount: new(big.Int).Neg(amount)})
+		}
+	}
+
+	return positions
+}
+
+// Matches whoever is owed with whoever owes, lowest user IDs first
+func netMultilateral(fills []*Settlement) []position {
+	// Positive when the user is owed
+	net := make(map[int64]*big.Int)
+	for _, s := range fills {
+		for _, u := range []int64{s.FromUserID, s.ToUserID} {
+			if net[u] == nil {
+				net[u] = new(big.Int)
+			}
+		}
+
+		net[s.FromUserID].Sub(net[s.FromUserID], s.Amount)
+		net[s.ToUserID].Add(net[s.ToUserID], s.Amount)
+	}
+
+	var payers, payees []int64
+	for u, amount := range net {
+		switch amount.Sign() {
+		case -1:
+			payers = append(payers, u)
+			amount.Neg(amount)
+		case 1:
+			payees = append(payees, u)
+		}
+	}
+	sort.Slice(payers, func(i, j int) bool { return payers[i] < payers[j] })
+	sort.Slice(payees, func(i, j int) bool { return payees[i] < payees[j] })
+
+	positions := []position{}
+	for len(payers) > 0 && len(payees) > 0 {
+		from, to := payers[0], payees[0]
+
+		amount := new(big.Int).Set(net[from])
+		if net[to].Cmp(amount) < 0 {
+			amount.Set(net[to])
+		}
+		positions = append(positions, position{from: from, to: to, amount: amount})
+
+		if net[from].Sub(net[from], amount).Sign() == 0 {
+			payers = payers[1:]
+		}
+		if net[to].Sub(net[to], amount).Sign() == 0 {
+			payees = payees[1:]
+		}
+	}
+
+	return positions
+}
+
+// The fills of a netting next to the transfers they were settled with, for
+// auditing one against the other
+type Netting struct {
+	ID        int64
+	Asset     Asset
+	Status    SettlementStatus
+	Fills     []Settlement
+	Transfers []Settlement
+}
+
+func (q *SettlementQueue) Netting(id int64) (Netting, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n, ok := q.nettings[id]
+	if !ok {
+		return Netting{}, false
+	}
+
+	resp := Netting{
+		ID:        n.id,
+		Asset:     n.asset,
+		Status:    n.status(),
+		Fills:     []Settlement{},
+		Transfers: []Settlement{},
+	}
+	for _, s := range n.fills {
+		resp.Fills = append(resp.Fills, *s)
+	}
+	for _, t := range n.transfers {
+		resp.Transfers = append(resp.Transfers, *t)
+	}
+
+	return resp, true
+}
+
+func (ex *Exchange) handleGetNetting(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid netting id"})
+	}
+
+	n, ok := ex.settlements.Netting(id)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: "netting not found"})
+	}
+
+	return c.JSON(http.StatusOK, n)
+}
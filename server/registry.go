@@ -0,0 +1,264 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/kkomitski/exchange/decimal"
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+type MarketStatus string
+
+const (
+	// Listed but not trading yet. Orders collect for the opening auction.
+	MarketPreOpen MarketStatus = "PRE_OPEN"
+	MarketOpen    MarketStatus = "OPEN"
+	// A call auction during the day, e.g. the closing auction
+	MarketAuction MarketStatus = "AUCTION"
+	// Trading stopped for now, e.g. by an admin
+	MarketHalted MarketStatus = "HALTED"
+	MarketClosed MarketStatus = "CLOSED"
+)
+
+func (s MarketStatus) valid() bool {
+	switch s {
+	case MarketPreOpen, MarketOpen, MarketAuction, MarketHalted, MarketClosed:
+		return true
+	}
+
+	return false
+}
+
+// Whether orders collect in the book for an auction instead of matching
+func (s MarketStatus) inAuction() bool {
+	return s == MarketPreOpen || s == MarketAuction
+}
+
+// Whether the market takes new orders
+func (s MarketStatus) trading() bool {
+	return s == MarketOpen || s.inAuction()
+}
+
+// A trading pair listed on the exchange
+type Listing struct {
+	Symbol Market
+	Base   string // Asset being bought and sold, e.g. ETH
+	Quote  string // Asset prices are in, e.g. USD
+	Config MarketConfig
+
+	// Only touched through the loop once the market is listed
+	orderbook *orderbook.Orderbook
+	loop      *matchingLoop
+	// Ledger hold ID -> orders drawing on the hold, only touched in the loop
+	funded map[int64][]*orderbook.Order
+
+	// Guarded by the registry lock
+	status MarketStatus
+}
+
+var (
+	ErrMarketNotFound = errors.New("market not found")
+	ErrMarketExists   = errors.New("market already exists")
+	ErrMarketNotOpen  = errors.New("market not open")
+	ErrInvalidStatus  = errors.New("invalid market status")
+	ErrAssetScale     = errors.New("asset is listed at another scale")
+)
+
+// Every market the exchange lists, keyed by symbol. Orderbooks of all markets
+// share the exchange sequencer.
+type MarketRegistry struct {
+	mu        sync.RWMutex
+	listings  map[Market]*Listing
+	sequencer *orderbook.Sequencer
+	clock     Clock // Stamps the trades of every orderbook
+	// Funds what every orderbook sends in on its own, nil if nothing is
+	// funded
+	fund func(l *Listing, o *orderbook.Order, price decimal.Decimal) error
+	// Scale the ledger keeps each asset at. Markets size their base asset
+	// and price in their quote asset at it.
+	assets map[Asset]decimal.Scale
+}
+
+func NewMarketRegistry(sequencer *orderbook.Sequencer, clock Clock) *MarketRegistry {
+	return &MarketRegistry{
+		listings:  make(map[Market]*Listing),
+		sequencer: sequencer,
+		clock:     clock,
+		assets:    make(map[Asset]decimal.Scale),
+	}
+}
+
+// Lists a new market with an empty orderbook
+func (r *MarketRegistry) Create(symbol Market, base, quote string, cfg MarketConfig, status MarketStatus) (*Listing, error) {
+	if symbol == "" || base == "" || quote == "" {
+		return nil, errors.New("markets need a symbol, a base and a quote asset")
+	}
+
+	if !status.valid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.listings[symbol]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrMarketExists, symbol)
+	}
+
+	for asset, scale := range map[Asset]decimal.Scale{Asset(base): cfg.SizeScale, Asset(quote): cfg.PriceScale} {
+		if listed, ok := r.assets[asset]; ok && listed != scale {
+			return nil, fmt.Errorf("%w: %s is at scale %d, not %d", ErrAssetScale, asset, listed, scale)
+		}
+	}
+	r.assets[Asset(base)] = cfg.SizeScale
+	r.assets[Asset(quote)] = cfg.PriceScale
+
+	ob := orderbook.NewOrderbookWithSequencer(r.sequencer)
+	ob.Clock = r.clock.Now
+	// Post-only and pegged orders reprice in whole ticks
+	if cfg.TickSize != 0 {
+		ob.TickSize = cfg.TickSize
+	}
+
+	if cfg.BandPercent != 0 {
+		ob.Band = &orderbook.PriceBand{
+			Percent:   cfg.BandPercent,
+			Reference: cfg.BandReference,
+			Window:    cfg.BandWindow,
+		}
+	}
+
+	if status.inAuction() {
+		ob.StartAuction()
+	}
+
+	l := &Listing{
+		Symbol:    symbol,
+		Base:      base,
+		Quote:     quote,
+		Config:    cfg,
+		orderbook: ob,
+		funded:    make(map[int64][]*orderbook.Order),
+		status:    status,
+	}
+	if r.fund != nil {
+		ob.Fund = func(o *orderbook.Order, price decimal.Decimal) error {
+			return r.fund(l, o, price)
+		}
+	}
+
+	l.loop = newMatchingLoop(l)
+	r.listings[symbol] = l
+
+	return l, nil
+}
+
+func (r *MarketRegistry) AssetScale(asset Asset) (decimal.Scale, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	scale, ok := r.assets[asset]
+	return scale, ok
+}
+
+func (r *MarketRegistry) Get(symbol Market) (*Listing, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	l, ok := r.listings[symbol]
+	return l, ok
+}
+
+// Every market, ordered by symbol
+func (r *MarketRegistry) List() []*Listing {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	listings := make([]*Listing, 0, len(r.listings))
+	for _, l := range r.listings {
+		listings = append(listings, l)
+	}
+
+	sort.Slice(listings, func(i, j int) bool { return listings[i].Symbol < listings[j].Symbol })
+
+	return listings
+}
+
+// Looks up a market for order entry, which open markets and markets in an
+// auction take
+func (r *MarketRegistry) Open(symbol Market) (*Listing, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	l, ok := r.listings[symbol]
+	if !ok {
+		return nil, ErrMarketNotFound
+	}
+
+	if !l.status.trading() {
+		return nil, fmt.Errorf("%w: %s is %s", ErrMarketNotOpen, symbol, l.status)
+	}
+
+	return l, nil
+}
+
+func (r *MarketRegistry) Status(symbol Market) (MarketStatus, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	l, ok := r.listings[symbol]
+	if !ok {
+		return "", ErrMarketNotFound
+	}
+
+	return l.status, nil
+}
+
+func (r *MarketRegistry) SetStatus(symbol Market, status MarketStatus) error {
+	if !status.valid() {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.listings[symbol]
+	if !ok {
+		return ErrMarketNotFound
+	}
+
+	l.status = status
+	return nil
+}
+
+func (r *MarketRegistry) Spec(l *Listing) *MarketSpec {
+	spec := newMarketSpec(l.Symbol, l.Config)
+	spec.Base = l.Base
+	spec.Quote = l.Quote
+
+	r.mu.RLock()
+	spec.Status = l.status
+	r.mu.RUnlock()
+
+	return spec
+}
+
+// HTTP status for a failed market lookup
+func marketErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrMarketNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrMarketNotOpen), errors.Is(err, ErrMarketExists):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
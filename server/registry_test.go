@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kkomitski/exchange/orderbook"
+)
+
+func TestMarketRegistry(t *testing.T) {
+	r := NewMarketRegistry(orderbook.NewSequencer(orderbook.SequencerState{}), systemClock{})
+
+	if _, err := r.Create(MarketETH, "ETH", "USD", Markets[MarketETH], MarketOpen); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Create(MarketETH, "ETH", "USD", Markets[MarketETH], MarketOpen); !errors.Is(err, ErrMarketExists) {
+		t.Errorf("duplicate market: got %v", err)
+	}
+
+	btc, err := r.Create("BTC", "BTC", "USD", Markets[MarketETH], MarketPreOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if btc.orderbook.TickSize != Markets[MarketETH].TickSize {
+		t.Errorf("tick size: got %d", btc.orderbook.TickSize)
+	}
+
+	if list := r.List(); len(list) != 2 || list[0].Symbol != "BTC" || list[1].Symbol != MarketETH {
+		t.Errorf("list: got %+v", list)
+	}
+
+	// Pre-open markets collect orders for the opening auction
+	if _, err := r.Open("BTC"); err != nil || !btc.orderbook.InAuction() {
+		t.Errorf("pre-open market: got %v", err)
+	}
+
+	if err := r.SetStatus("BTC", MarketClosed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Open("BTC"); !errors.Is(err, ErrMarketNotOpen) {
+		t.Errorf("closed market: got %v", err)
+	}
+
+	if _, err := r.Open("DOGE"); !errors.Is(err, ErrMarketNotFound) {
+		t.Errorf("unknown market: got %v", err)
+	}
+
+	if err := r.SetStatus(MarketETH, MarketHalted); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Open(MarketETH); err == nil || err.Error() != "market not open: ETH is HALTED" {
+		t.Errorf("halted market: got %v", err)
+	}
+
+	if err := r.SetStatus("BTC", MarketOpen); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := r.Open("BTC"); err != nil || l != btc {
+		t.Errorf("opened market: got %v", err)
+	}
+
+	if err := r.SetStatus("BTC", "PAUSED"); err == nil {
+		t.Errorf("invalid status accepted")
+	}
+
+	if spec := r.Spec(btc); spec.Base != "BTC" || spec.Quote != "USD" || spec.Status != MarketOpen {
+		t.Errorf("spec: got %+v", spec)
+	}
+}
@@ -8,17 +8,20 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/kkomitski/exchange/decimal"
 	"github.com/kkomitski/exchange/orderbook"
 	"github.com/kkomitski/exchange/utils"
 	"github.com/labstack/echo/v4"
@@ -31,6 +34,16 @@ const (
 
 	MarketOrder OrderType = "MARKET"
 	LimitOrder OrderType = "LIMIT"
+	// Held back until the last trade price reaches StopPrice, then placed as a
+	// market or limit order
+	StopMarketOrder OrderType = "STOP"
+	StopLimitOrder OrderType = "STOP_LIMIT"
+	// Stop orders whose StopPrice follows the market by TrailAmount or
+	// TrailPercent
+	TrailingStopOrder OrderType = "TRAILING_STOP"
+	TrailingStopLimitOrder OrderType = "TRAILING_STOP_LIMIT"
+	// Limit order priced off the touch and repriced as it moves
+	PeggedOrder OrderType = "PEGGED"
 )
 
 type ( 
@@ -41,37 +54,95 @@ type (
 		UserID int64
 		Type OrderType // Limit or market
 		Bid bool
-		Size float64
-		Price float64
+		Size string // Decimal string at the market's size scale
+		Price string // Decimal string at the market's price scale - LIMIT and STOP_LIMIT orders only
+		StopPrice string // STOP and STOP_LIMIT orders only
+		TrailAmount string // Trailing stops only - either a price offset...
+		TrailPercent string // ...or a percentage like "1.5"
+		LimitOffset string // TRAILING_STOP_LIMIT only - how far past the trigger the limit price sits
+		PegReference orderbook.PegReference // PEGGED only - BEST_BID, BEST_ASK or MID
+		PegOffset string // PEGGED only - added to the reference, can be negative
+		PegCap string // PEGGED only, optional - highest price for a bid, lowest for an ask
 		Market Market
+		FillPolicy orderbook.FillPolicy // Market orders only - defaults to a partial fill
+		ClientOrderID string // Optional, must be unique per user
+		TimeInForce orderbook.TimeInForce // GTC, IOC, FOK, GTD or DAY - defaults to GTC
+		ExpiresAt int64 // GTD orders only - Unix nanoseconds
+		PostOnly orderbook.PostOnlyMode // LIMIT GTC orders only - REJECT or REPRICE
+		SelfTradePrevention orderbook.SelfTradePrevention // Optional, defaults to the user's setting
+		DisplaySize string // LIMIT GTC orders only - makes it an iceberg showing this much at a time
 	}
 
 	Order struct {
 		UserID int64
 		ID    int64
-		Price float64
-		Size float64
+		ClientOrderID string `json:",omitempty"`
+		Market Market
+		Price string
+		StopPrice string `json:",omitempty"` // Current trigger level for trailing stops
+		TrailAmount string `json:",omitempty"`
+		TrailPercent string `json:",omitempty"`
+		Size string
+		DisplaySize string `json:",omitempty"` // Icebergs only
+		PegReference orderbook.PegReference `json:",omitempty"`
+		PegOffset string `json:",omitempty"`
 		Bid bool
 		Timestamp int64
+		TimeInForce orderbook.TimeInForce
+		ExpiresAt int64 `json:",omitempty"`
+		Status orderbook.OrderStatus
+		Filled string
 	}
 
 	OrderBookuserOrders struct {
-		TotalBidVolume float64
-		TotalAskVolume float64
+		TotalBidVolume string
+		TotalAskVolume string
 		Asks []*Order
 		Bids []*Order
 	}
 	
 	MatchedOrder struct {
 		UserID int64
-		Price float64
-		Size float64
+		Price string
+		Size string
 		ID int64
 	}
 
+	Trade struct {
+		Price string
+		Size string
+		Bid bool
+		Timestamp int64
+	}
+
 	APIError struct {
 		Error string
 	}
+
+	// One order of a group
+	GroupLegRequest struct {
+		Type OrderType // LIMIT, STOP or STOP_LIMIT - MARKET is allowed for a bracket entry
+		Bid bool
+		Size string
+		Price string
+		StopPrice string
+		ClientOrderID string
+	}
+
+	PlaceGroupRequest struct {
+		UserID int64
+		Market Market
+		Type orderbook.GroupType // OCO or BRACKET
+		Entry *GroupLegRequest // BRACKET only
+		Legs []*GroupLegRequest
+	}
+
+	OrderGroup struct {
+		ID int64
+		Type orderbook.GroupType
+		Entry *Order `json:",omitempty"`
+		Legs []*Order
+	}
 )
 
 func StartServer() {
@@ -79,12 +150,18 @@ func StartServer() {
 
 	e.HTTPErrorHandler = httpErrorHandler
 
-	client, err := ethclient.Dial("HTTP://127.0.0.1:8545")
+	// SETTLER=simulated runs the exchange without a chain
+	settlementConfig, err := SettlementConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	settler, err := NewSettler(settlementConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ex, err := NewExchange(exchangePrivateKey, client)
+	ex, err := NewExchange(exchangePrivateKey, settler)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,6 +173,8 @@ func StartServer() {
 	pk2 := "2e217ecde538ec3810a1ed4aa812bd8df0b1f1ac7ab7d8b79e9f976f12922d59"
 	addr2 := "0x6D60CAcfdac815fcC6873A400F2DeB80C61D0BDB"
 	user2 := NewUser(pk2, addr2, 22)
+	// Market maker quoting both sides
+	user2.SelfTradePrevention = orderbook.CancelOldest
 
 	pk3 := "01b7ba57f8ca8e547fa37b02f7019bda63ded578b050d848cfd26145ef95aa16"
 	addr3 := "0xdAD83EB015197B5AFF313D3F2dA9bA14d39bA88D"
@@ -105,33 +184,85 @@ func StartServer() {
 	ex.Users[user2.ID] = user2
 	ex.Users[user3.ID] = user3
 
-	balance1 := user1.GetBalance(client, user1.Address)
-	fmt.Printf("Balance: %+v\n", balance1)
-	_ = balance1
-
-	balance2 := user2.GetBalance(client, user2.Address)
-	fmt.Printf("Balance: %+v\n", balance2)
-	_ = balance2
+	// TODO: Credit deposits as they land on chain instead of seeding balances
+	eth := Markets[MarketETH]
+	for _, user := range []*User{user1, user2, user3} {
+		ex.ledger.Deposit(user.ID, "ETH", eth.SizeScale.FromInt(10_000))
+		ex.ledger.Deposit(user.ID, "USD", eth.PriceScale.FromInt(100_000_000))
+
+		// Ganache starts the accounts off with ETH, the simulated chain needs
+		// it handing out
+		if sim, ok := settler.(*SimulatedChain); ok {
+			amount, _ := eth.SettlementAmount(eth.SizeScale.FromInt(10_000))
+			sim.Fund(user.Address, amount)
+		}
 
-	balance3 := user3.GetBalance(client, user3.Address)
-	fmt.Printf("Balance: %+v\n", balance3)
-	_ = balance3
+		balance, err := user.GetBalance(settler)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Balance: %+v\n", balance)
+	}
 
 	e.GET("/book/:market", ex.handleGetBook)
 	e.GET("/book/:market/bid", ex.handleGetBestBid)
 	e.GET("/book/:market/ask", ex.handleGetBestAsk)
 	e.GET("/orders/:userID", ex.handleGetOrders)
 
-	e.GET("/orderbook", ex.getOrderBook)
+	e.GET("/orderbook/:market", ex.getOrderBook)
 	e.GET("/balance", ex.getBalance)
 
 	e.GET("/trades/:market", ex.handleGetTrades)
+	e.GET("/markets/:market", ex.handleGetMarket)
 	
 	e.POST("/order", ex.handlePlaceOrder)
+	e.POST("/orders/group", ex.handlePlaceOrderGroup)
 	e.DELETE("/order/:id", ex.cancelOrder)
+	e.PATCH("/order/:id", ex.handleAmendOrder)
+
+	e.GET("/events", ex.handleGetEvents)
+
+	e.GET("/balances/:userID", ex.handleGetBalances)
+	e.GET("/ledger/:userID", ex.handleGetLedger)
+	e.GET("/settlements/:userID", ex.handleGetSettlements)
+	e.GET("/nettings/:id", ex.handleGetNetting)
+
+	e.GET("/admin/markets", ex.handleListMarkets)
+	e.POST("/admin/markets", ex.handleCreateMarket)
+	e.POST("/admin/markets/:market/halt", ex.handleHaltMarket)
+	e.POST("/admin/markets/:market/open", ex.handleOpenMarket)
+	e.POST("/admin/markets/:market/auction", ex.handleStartAuction)
+	e.POST("/admin/markets/:market/close", ex.handleCloseMarket)
+	e.GET("/markets/:market/auction", ex.handleGetAuction)
+	e.POST("/admin/deposits", ex.handleDeposit)
+	e.POST("/admin/settlements/:tradeID/retry", ex.handleRetrySettlement)
+
+	if err := ex.settlements.Configure(settlementConfig.Queue); err != nil {
+		log.Fatal(err)
+	}
+
+	// SETTLEMENT_JOURNAL keeps unsettled trades across restarts, without it
+	// they're lost when the server stops
+	if settlementConfig.Journal != "" {
+		if err := ex.openSettlementJournal(settlementConfig.Journal); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// SEQUENCER_STATE keeps order IDs, trade IDs and event sequence numbers
+	// increasing across restarts
+	if path := os.Getenv("SEQUENCER_STATE"); path != "" {
+		if err := ex.openSequencerState(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	go ex.runScheduler(time.Second, stop)
+	ex.settlements.Start(stop)
 
 
-	fmt.Printf("%+v", client)
+	fmt.Printf("%+v", settler)
 
 	e.Logger.Fatal(e.Start(":3004"))
 }
@@ -140,6 +271,8 @@ type User struct {
 	ID int64
 	PrivateKey *ecdsa.PrivateKey
 	Address  common.Address
+	// Applied to the user's orders that don't pick a mode of their own
+	SelfTradePrevention orderbook.SelfTradePrevention
 }
 
 func NewUser(privKey string, addr string, id int64) *User {
@@ -157,13 +290,8 @@ func NewUser(privKey string, addr string, id int64) *User {
 	}
 }
 
-func (u *User) GetBalance(client *ethclient.Client, address common.Address) *big.Int {
-	balance, err := client.BalanceAt(context.Background(), address, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return balance
+func (u *User) GetBalance(settler Settler) (*big.Int, error) {
+	return settler.Balance(context.Background(), u.Address)
 }
 
 func httpErrorHandler(err error, c echo.Context){
@@ -185,41 +313,219 @@ users: {
 type UserOrders struct {
 	mu sync.RWMutex
 	orderMap map[int64]map[int64]*orderbook.Order
+	markets map[int64]Market // order ID -> market the order rests in
+	clientOrderIDs map[int64]map[string]int64 // user ID -> client order ID -> order ID
+}
+
+var errDuplicateClientOrderID = errors.New("client order id already used")
+
+// Reserves a client order ID for the user. Once the order is in, the ID is
+// never released, so a client can safely retry a request without placing the
+// same order twice.
+func (u *UserOrders) claimClientOrderID(userID int64, clientOrderID string) error {
+	if clientOrderID == "" {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.clientOrderIDs[userID] == nil {
+		u.clientOrderIDs[userID] = make(map[string]int64)
+	}
+
+	if _, ok := u.clientOrderIDs[userID][clientOrderID]; ok {
+		return errDuplicateClientOrderID
+	}
+
+	u.clientOrderIDs[userID][clientOrderID] = 0
+	return nil
+}
+
+// Gives back the ID of an order that was turned away, so the client can send
+// it again
+func (u *UserOrders) releaseClientOrderID(userID int64, clientOrderID string) {
+	if clientOrderID == "" {
+		return
+	}
+
+	u.mu.Lock()
+	delete(u.clientOrderIDs[userID], clientOrderID)
+	u.mu.Unlock()
+}
+
+func (u *UserOrders) setClientOrderID(o *orderbook.Order) {
+	if o.ClientOrderID == "" {
+		return
+	}
+
+	u.mu.Lock()
+	u.clientOrderIDs[o.UserID][o.ClientOrderID] = o.ID
+	u.mu.Unlock()
 }
 
 type Exchange struct {
-	Client *ethclient.Client
+	Settler Settler // Where trades are paid out
 	Users map[int64]*User
 	// Orders map[int64]map[int64]*orderbook.Order // Orders maps a user ID to a list of his orders
 	PrivateKey *ecdsa.PrivateKey
-	orderbooks map[Market]*orderbook.Orderbook
+	registry *MarketRegistry
+	sequencer *orderbook.Sequencer // Shared by every orderbook so IDs are unique exchange wide
+	Clock Clock // Defaults to the system clock
+	events EventLog
+	breakers circuitBreakers
+	ledger *Ledger // Off-chain balances, orders are funded from it
+	settlements *SettlementQueue // Trades waiting to be paid out on chain
 
 	// mu sync.RWMutex
 	UserOrders // TODO: Maybe attach to the User struct instead of the exchange
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
-	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketETH] = orderbook.NewOrderbook()
+func NewExchange(privateKey string, settler Settler) (*Exchange, error) {
+	// Carried over from storage by openSequencerState and
+	// openSettlementJournal
+	sequencer := orderbook.NewSequencer(orderbook.SequencerState{})
 
 	pk, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return &Exchange{
-		Client: client,
+	ex := &Exchange{
+		Settler: settler,
 		Users: make(map[int64]*User),
 		// Orders: make(map[int64]map[int64]*orderbook.Order),
-		UserOrders:     UserOrders{orderMap: make(map[int64]map[int64]*orderbook.Order)},
+		UserOrders:     UserOrders{
+			orderMap: make(map[int64]map[int64]*orderbook.Order),
+			markets: make(map[int64]Market),
+			clientOrderIDs: make(map[int64]map[string]int64),
+		},
 		PrivateKey: pk,
-		orderbooks: orderbooks,
-	}, nil
+		sequencer: sequencer,
+		Clock: systemClock{},
+		breakers: newCircuitBreakers(),
+	}
+
+	// Everything time based follows ex.Clock, even when it's swapped later
+	clock := exchangeClock{ex}
+	ex.registry = NewMarketRegistry(sequencer, clock)
+	ex.registry.fund = ex.topUp
+	ex.ledger = NewLedger(clock)
+	ex.settlements = NewSettlementQueue(settler, clock, ex.user, DefaultSettlementQueueConfig)
+
+	if _, err := ex.registry.Create(MarketETH, "ETH", "USD", Markets[MarketETH], MarketOpen); err != nil {
+		return nil, err
+	}
+
+	return ex, nil
 }
 
 type GetOrdersResponse struct {
-	Asks []*orderbook.Order
-	Bids []*orderbook.Order
+	Asks []*Order
+	Bids []*Order
+	Stops []*Order // Stop orders that haven't triggered yet
+	Groups []*OrderGroup // OCO and bracket orders, kept out of the lists above
+}
+
+// Converts a resting orderbook order into its API representation
+func newOrder(l *Listing, o *orderbook.Order) *Order {
+	cfg := l.Config
+
+	order := &Order{
+		UserID: o.UserID,
+		ID: o.ID,
+		ClientOrderID: o.ClientOrderID,
+		Market: l.Symbol,
+		Size: cfg.FormatSize(o.Size),
+		Bid: o.Bid,
+		Timestamp: o.Timestamp,
+		TimeInForce: o.TimeInForce,
+		ExpiresAt: o.ExpiresAt,
+		Status: o.Status,
+		Filled: cfg.FormatSize(o.Filled),
+	}
+
+	if o.Limit != nil {
+		order.Price = cfg.FormatPrice(o.Limit.Price)
+	}
+
+	if o.IsIceberg() {
+		order.DisplaySize = cfg.FormatSize(o.Display)
+	}
+
+	if o.Peg != nil {
+		order.PegReference = o.Peg.Reference
+		order.PegOffset = cfg.FormatPrice(o.Peg.Offset)
+	}
+
+	if o.Stop != nil {
+		order.StopPrice = cfg.FormatPrice(o.Stop.Price)
+
+		if o.Limit == nil && o.Stop.IsLimit() {
+			order.Price = cfg.FormatPrice(o.Stop.LimitPrice)
+		}
+
+		if trail := o.Stop.Trail; trail != nil {
+			if trail.Amount != 0 {
+				order.TrailAmount = cfg.FormatPrice(trail.Amount)
+			}
+			if trail.Percent != 0 {
+				order.TrailPercent = orderbook.PercentScale.Format(trail.Percent)
+			}
+
+			// No trigger level until the stop has seen a trade
+			if trail.Extreme == 0 {
+				order.StopPrice = ""
+			}
+		}
+	}
+
+	return order
+}
+
+// Like newOrder, but only with what the public book shows - the hidden reserve
+// of an iceberg stays hidden
+func newBookOrder(l *Listing, o *orderbook.Order) *Order {
+	order := newOrder(l, o)
+	order.Size = l.Config.FormatSize(o.Visible())
+	order.DisplaySize = ""
+
+	return order
+}
+
+func newOrderGroup(l *Listing, g *orderbook.OrderGroup) *OrderGroup {
+	cfg := l.Config
+
+	// Legs still waiting for a bracket entry aren't in the book yet, so show
+	// the prices they will go in at
+	newLeg := func(leg *orderbook.GroupLeg) *Order {
+		order := newOrder(l, leg.Order)
+
+		if order.Price == "" && leg.Price != 0 {
+			order.Price = cfg.FormatPrice(leg.Price)
+		}
+		if order.StopPrice == "" && leg.Stop != nil {
+			order.StopPrice = cfg.FormatPrice(leg.Stop.Price)
+		}
+
+		return order
+	}
+
+	group := &OrderGroup{
+		ID: g.ID,
+		Type: g.Type,
+		Legs: []*Order{},
+	}
+
+	if g.Entry != nil {
+		group.Entry = newLeg(g.Entry)
+	}
+
+	for _, leg := range g.Legs {
+		group.Legs = append(group.Legs, newLeg(leg))
+	}
+
+	return group
 }
 
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
@@ -229,19 +535,78 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 		return err
 	}
 
-	var userOrders []*orderbook.Order
+	var userOrders []*Order
 
-	for _, val := range ex.orderMap[userID] {
-		userOrders = append(userOrders, val)
+	ordersResp := &GetOrdersResponse{
+		Asks: []*Order{},
+		Bids: []*Order{},
+		Stops: []*Order{},
+		Groups: []*OrderGroup{},
 	}
 
-	ordersResp := &GetOrdersResponse{
-		Asks: []*orderbook.Order{},
-		Bids: []*orderbook.Order{},
+	groups := make(map[int64]bool)
+
+	// The orders themselves belong to their matching loops, so everything is
+	// read from each market's snapshot. Building one can wait on the loop,
+	// which takes the lock, so the lock is only held to list the IDs.
+	ids := make(map[Market][]int64)
+
+	ex.UserOrders.mu.Lock()
+	for id := range ex.orderMap[userID] {
+		market := ex.markets[id]
+		ids[market] = append(ids[market], id)
+	}
+	ex.UserOrders.mu.Unlock()
+
+	missing := make(map[Market][]int64)
+
+	for market, marketIDs := range ids {
+		// Markets are never delisted, so this is always found
+		l, _ := ex.registry.Get(market)
+		snap := l.snapshot()
+
+		for _, id := range marketIDs {
+			order, ok := snap.orders[id]
+			if !ok {
+				missing[market] = append(missing[market], id)
+				continue
+			}
+
+			// The whole group is listed once, finished legs included
+			if group := snap.groups[id]; group != nil {
+				if !groups[group.ID] {
+					groups[group.ID] = true
+					ordersResp.Groups = append(ordersResp.Groups, group)
+				}
+				continue
+			}
+
+			userOrders = append(userOrders, order)
+		}
+	}
+
+	// Orders can finish without going through this user's requests, e.g. a
+	// triggered stop that found no liquidity - drop them here. One that isn't
+	// done was placed after the snapshot and shows up next time.
+	for market, ids := range missing {
+		l, _ := ex.registry.Get(market)
+		l.do(func(ob *orderbook.Orderbook) {
+			ex.UserOrders.mu.Lock()
+			defer ex.UserOrders.mu.Unlock()
+
+			for _, id := range ids {
+				if order, ok := ex.orderMap[userID][id]; ok && order.IsDone() {
+					delete(ex.orderMap[userID], id)
+					delete(ex.markets, id)
+				}
+			}
+		})
 	}
 
 	for i := 0; i < len(userOrders); i++ {
-		if userOrders[i].Bid {
+		if userOrders[i].Status == orderbook.StatusPending {
+			ordersResp.Stops = append(ordersResp.Stops, userOrders[i])
+		} else if userOrders[i].Bid {
 			ordersResp.Bids = append(ordersResp.Bids, userOrders[i])
 		} else {
 			ordersResp.Asks = append(ordersResp.Asks, userOrders[i])
@@ -252,9 +617,21 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	// return c.JSON(http.StatusOK, userOrders)
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match){
-	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
+func (ex *Exchange) handlePlaceMarketOrder(l *Listing, order *orderbook.Order, policy orderbook.FillPolicy) ([]orderbook.Match, error) {
+	ob := l.orderbook
+
+	if policy == "" {
+		policy = orderbook.PartialFill
+	}
+
+	matches, err := ob.PlaceMarketOrder(order, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 {
+		return matches, nil
+	}
 
 	// matchedOrders := make([]*MatchedOrder, len(matches))
 
@@ -264,11 +641,14 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 	// 	isBid = true
 	// }
 
-	totalSizeFilled := 0.0
-	sumPrice := 0.0
+	cfg := l.Config
+
+	totalSizeFilled := decimal.Decimal(0)
+	sumPrice := decimal.Decimal(0)
+	trades := 0
 
 	// Create a prices set
-	pricesMap := make(map[float64]bool)
+	pricesMap := make(map[decimal.Decimal]bool)
 
 	for i := 0; i < len(matches); i++ {
 	// for i := 0; i < len(matchedOrders); i++ {
@@ -283,6 +663,12 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		// 	Price: matches[i].Price,
 		// }
 
+		// Self-trade prevented, nothing was filled
+		if !matches[i].IsTrade() {
+			continue
+		}
+
+		trades++
 		totalSizeFilled += matches[i].SizeFilled
 
 		sumPrice += matches[i].Price
@@ -292,25 +678,89 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 	}
 
 	// Create an array from the SET
-	var prices []float64
+	var prices []string
 	for price := range pricesMap {
-		prices = append(prices, price)
+		prices = append(prices, cfg.FormatPrice(price))
+	}
+
+	if trades == 0 {
+		return matches, nil
 	}
 
-	avgPrice := sumPrice / float64(len(matches))
+	avgPrice := cfg.FormatPrice(sumPrice / decimal.Decimal(trades))
 
-	strOut := fmt.Sprintf("\nSERVER: Filled MARKET order: \n- UID: %v | Order ID: %d | Bid: %v | Size: %.2f | AvgPrice: %v | Prices: %v \n ", order.UserID, order.ID, order.Bid, totalSizeFilled, avgPrice, prices)
+	strOut := fmt.Sprintf("\nSERVER: Filled MARKET order: \n- UID: %v | Order ID: %d | Bid: %v | Size: %v | Unfilled: %v | AvgPrice: %v | Prices: %v \n ", order.UserID, order.ID, order.Bid, cfg.FormatSize(totalSizeFilled), cfg.FormatSize(order.Size), avgPrice, prices)
 
 	fmt.Println(utils.PrintColor("blue", strOut))
 
 	// return matches, matchedOrders
-	return matches
+	return matches, nil
+}
+
+func (ex *Exchange) handlePlaceLimitOrder(l *Listing, price decimal.Decimal, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob := l.orderbook
+
+	if !ob.InBand(price) {
+		order.Status = orderbook.StatusRejected
+		return nil, orderbook.ErrOutsideBand
+	}
+
+	matches := ob.PlaceLimitOrder(price, order)
+
+	// Repriced behind a touch that's outside the band
+	if order.Status == orderbook.StatusRejected && order.PostOnlyResult == orderbook.PostOnlyRepriced {
+		return matches, orderbook.ErrOutsideBand
+	}
+
+	// Filled, killed or cancelled on arrival - nothing rests in the book so
+	// there is nothing to track
+	if order.Limit == nil {
+		return matches, nil
+	}
+
+	ex.trackOrder(l.Symbol, order)
+
+	return matches, nil
+}
+
+func (ex *Exchange) handlePlaceStopOrder(l *Listing, stop orderbook.Stop, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob := l.orderbook
+	matches := ob.PlaceStopOrder(order, stop)
+
+	// Still waiting for its trigger, or triggered straight away and resting
+	if !order.IsDone() {
+		ex.trackOrder(l.Symbol, order)
+	}
+
+	return matches, nil
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
-	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
+func (ex *Exchange) handlePlacePeggedOrder(l *Listing, peg orderbook.Peg, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob := l.orderbook
+	matches, err := ob.PlacePeggedOrder(order, peg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rejected if there was nothing to peg to
+	if order.Limit == nil {
+		return matches, nil
+	}
+
+	// Pegged orders never match on arrival, so one the user can't afford can
+	// come straight back out
+	asset, amount := holdAmount(l, ob, order, worstPrice(order), order.Size)
+	if err := ex.fund(l, order.ID, order.UserID, asset, amount, order); err != nil {
+		ob.CancelOrder(order)
+		return matches, err
+	}
+
+	ex.trackOrder(l.Symbol, order)
 
+	return matches, nil
+}
+
+func (ex *Exchange) trackOrder(market Market, order *orderbook.Order) {
 	ex.UserOrders.mu.Lock()
 	defer ex.UserOrders.mu.Unlock()
 
@@ -321,13 +771,38 @@ func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *o
 
 
 	ex.orderMap[order.UserID][order.ID] = order
+	ex.markets[order.ID] = market
+}
 
+// Forgets about the orders that are done, and the rest of their groups that
+// are - legs are cancelled or finish without trading themselves. Runs inside
+// the loop with UserOrders.mu held.
+func (ex *Exchange) untrackDone(orders ...*orderbook.Order) {
+	for _, order := range orders {
+		members := []*orderbook.Order{order}
+		if order.Group != nil {
+			members = order.Group.Orders()
+		}
 
-	return nil
+		for _, o := range members {
+			if o.IsDone() {
+				delete(ex.orderMap[o.UserID], o.ID)
+				delete(ex.markets, o.ID)
+			}
+		}
+	}
 }
 
 type PlaceOrderResponse struct {
 	OrderID int64
+	ClientOrderID string `json:",omitempty"`
+	// What happened to the order on arrival, e.g. a FOK order comes back KILLED
+	// and an IOC order with a remainder comes back CANCELLED
+	Status orderbook.OrderStatus
+	PostOnly orderbook.PostOnlyResult `json:",omitempty"` // ACCEPTED, REJECTED or REPRICED
+	Price string `json:",omitempty"` // Price the order rests at, may differ from the request if repriced
+	Filled string
+	Unfilled string // Size left over after matching - rests in the book for GTC limit orders, dropped otherwise
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
@@ -337,243 +812,1030 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 		return err
 	}
 
-	market := Market(placeOrderuserOrders.Market)
-	order := orderbook.NewOrder(placeOrderuserOrders.Bid, placeOrderuserOrders.Size, placeOrderuserOrders.UserID)
+	l, err := ex.registry.Open(Market(placeOrderuserOrders.Market))
+	if err != nil {
+		return c.JSON(marketErrorStatus(err), APIError{Error: err.Error()})
+	}
 
-	// Limit orders
-	if placeOrderuserOrders.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderuserOrders.Price, order); err != nil {
-			return err
+	cfg := l.Config
+
+	size, err := cfg.ParseSize(placeOrderuserOrders.Size)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid size: %v", err)})
+	}
+
+	switch placeOrderuserOrders.TimeInForce {
+	case "":
+		placeOrderuserOrders.TimeInForce = orderbook.GoodTillCancel
+	case orderbook.GoodTillCancel, orderbook.ImmediateOrCancel, orderbook.FillOrKill, orderbook.GoodTillDate, orderbook.Day:
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid time in force: %q", placeOrderuserOrders.TimeInForce)})
+	}
+
+	// Market orders never rest so they can't expire
+	if placeOrderuserOrders.Type == MarketOrder && (placeOrderuserOrders.TimeInForce == orderbook.GoodTillDate || placeOrderuserOrders.TimeInForce == orderbook.Day) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market orders can't be GTD or DAY"})
+	}
+
+	now := ex.Clock.Now()
+
+	var expiresAt int64
+	switch placeOrderuserOrders.TimeInForce {
+	case orderbook.GoodTillDate:
+		if placeOrderuserOrders.ExpiresAt <= now.UnixNano() {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "GTD orders need an expiry in the future"})
+		}
+		expiresAt = placeOrderuserOrders.ExpiresAt
+	case orderbook.Day:
+		expiresAt = cfg.DayExpiry(now).UnixNano()
+	default:
+		if placeOrderuserOrders.ExpiresAt != 0 {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "expiry is only supported for GTD orders"})
 		}
 	}
-	
-	// Market orders
-	if placeOrderuserOrders.Type == MarketOrder {
-		matches:= ex.handlePlaceMarketOrder(market, order)
 
-		if err := ex.handleMatches(matches); err != nil {
-			return err
+	switch placeOrderuserOrders.PostOnly {
+	case "":
+	case orderbook.PostOnlyReject, orderbook.PostOnlyReprice:
+		if placeOrderuserOrders.Type != LimitOrder || !placeOrderuserOrders.TimeInForce.Rests() {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "post-only is only supported for GTC, GTD and DAY limit orders"})
 		}
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid post-only mode: %q", placeOrderuserOrders.PostOnly)})
 	}
 
-	resp := &PlaceOrderResponse{
-		OrderID: order.ID,
+	switch placeOrderuserOrders.SelfTradePrevention {
+	case "", orderbook.CancelNewest, orderbook.CancelOldest, orderbook.CancelBoth, orderbook.DecrementAndCancel:
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid self-trade prevention mode: %q", placeOrderuserOrders.SelfTradePrevention)})
 	}
 
-	return c.JSON(200, resp)
-}
+	switch placeOrderuserOrders.FillPolicy {
+	case "", orderbook.PartialFill, orderbook.RejectUnfilled:
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid fill policy: %q", placeOrderuserOrders.FillPolicy)})
+	}
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
-	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
-			return fmt.Errorf("User not found: %d", match.Ask.UserID)
+	var display decimal.Decimal
+	if placeOrderuserOrders.DisplaySize != "" {
+		if placeOrderuserOrders.Type != LimitOrder || !placeOrderuserOrders.TimeInForce.Rests() {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "display size is only supported for GTC, GTD and DAY limit orders"})
 		}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
-			return fmt.Errorf("User not found: %d", match.Bid.UserID)
+		display, err = cfg.ParseSize(placeOrderuserOrders.DisplaySize)
+		if err == nil && (display <= 0 || display > size) {
+			err = decimal.ErrInvalidDecimal
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid display size: %v", err)})
 		}
-		
-		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
+	}
 
-		// TODO: Implement this - will be used to charge fees
-		// exchangePubKey := ex.PrivateKey.Public()
-		// publicKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
-		// }
+	switch placeOrderuserOrders.Type {
+	case MarketOrder, LimitOrder, StopMarketOrder, StopLimitOrder, TrailingStopOrder, TrailingStopLimitOrder, PeggedOrder:
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid order type: %q", placeOrderuserOrders.Type)})
+	}
+
+	var price, stopPrice decimal.Decimal
+	if placeOrderuserOrders.Type == LimitOrder || placeOrderuserOrders.Type == StopLimitOrder {
+		price, err = cfg.ParsePrice(placeOrderuserOrders.Price)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid price: %v", err)})
+		}
+	}
 
-		// TODO: Fix this typing issue
-		amount := big.NewInt(int64(match.SizeFilled))
+	if placeOrderuserOrders.Type == StopMarketOrder || placeOrderuserOrders.Type == StopLimitOrder {
+		stopPrice, err = cfg.ParsePrice(placeOrderuserOrders.StopPrice)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid stop price: %v", err)})
+		}
+	}
 
-		transferETH(ex.Client, fromUser.PrivateKey, toAddress, amount, match.Ask.UserID, match.Bid.UserID)
+	var trail *orderbook.Trail
+	if placeOrderuserOrders.Type == TrailingStopOrder || placeOrderuserOrders.Type == TrailingStopLimitOrder {
+		trail = &orderbook.Trail{}
 
-		// Clear the Exchange order store if order is empty
-		if match.Ask.Size == 0.0 {
-			orderID := match.Ask.ID
-			userID := match.Ask.UserID
-			delete(ex.orderMap[userID], orderID)
+		switch {
+		case placeOrderuserOrders.TrailAmount != "" && placeOrderuserOrders.TrailPercent == "":
+			trail.Amount, err = cfg.ParsePrice(placeOrderuserOrders.TrailAmount)
+			if err == nil && trail.Amount <= 0 {
+				err = decimal.ErrInvalidDecimal
+			}
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid trail amount: %v", err)})
+			}
+		case placeOrderuserOrders.TrailPercent != "" && placeOrderuserOrders.TrailAmount == "":
+			trail.Percent, err = orderbook.PercentScale.Parse(placeOrderuserOrders.TrailPercent)
+			if err == nil && (trail.Percent <= 0 || trail.Percent >= orderbook.PercentScale.FromInt(100)) {
+				err = decimal.ErrInvalidDecimal
+			}
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid trail percent: %v", err)})
+			}
+		default:
+			return c.JSON(http.StatusBadRequest, APIError{Error: "trailing stops need exactly one of a trail amount or a trail percent"})
 		}
 
-		if match.Bid.Size == 0.0 {
-			orderID := match.Bid.ID
-			userID := match.Bid.UserID
-			delete(ex.orderMap[userID], orderID)
+		if placeOrderuserOrders.Type == TrailingStopLimitOrder {
+			trail.Limit = true
+			trail.LimitOffset, err = cfg.ParsePrice(placeOrderuserOrders.LimitOffset)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid limit offset: %v", err)})
+			}
 		}
 	}
 
-	return nil
-}
+	var peg orderbook.Peg
+	if placeOrderuserOrders.Type == PeggedOrder {
+		if !placeOrderuserOrders.TimeInForce.Rests() {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "pegged orders must be GTC, GTD or DAY"})
+		}
 
-func (ex *Exchange) handleGetBook(c echo.Context) error {
-	market := Market(c.Param("market"))
+		switch placeOrderuserOrders.PegReference {
+		case orderbook.PegBestBid, orderbook.PegBestAsk, orderbook.PegMid:
+			peg.Reference = placeOrderuserOrders.PegReference
+		default:
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid peg reference: %q", placeOrderuserOrders.PegReference)})
+		}
 
-	ob, ok := ex.orderbooks[market]
+		if placeOrderuserOrders.PegOffset != "" {
+			if peg.Offset, err = cfg.ParsePrice(placeOrderuserOrders.PegOffset); err != nil {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid peg offset: %v", err)})
+			}
+		}
 
-	if !ok {
-		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
+		if placeOrderuserOrders.PegCap != "" {
+			peg.Cap, err = cfg.ParsePrice(placeOrderuserOrders.PegCap)
+			if err == nil && peg.Cap <= 0 {
+				err = decimal.ErrInvalidDecimal
+			}
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid peg cap: %v", err)})
+			}
+		}
 	}
 
-	orderbookuserOrders := OrderBookuserOrders{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
+	// Market rules - every broken rule is reported, not just the first
+	rules := []error{cfg.ValidateSize(size)}
 
-		Asks: []*Order{},
-		Bids: []*Order{},
+	if display != 0 {
+		rules = append(rules, cfg.ValidateSize(display))
 	}
 
-	for _, limit := range ob.Asks(){
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID: order.UserID,
-				ID: order.ID,
-				Price: order.Limit.Price,
-				Size: order.Size,
-				Bid: order.Bid,
-				Timestamp: order.Timestamp,
-			}
+	if placeOrderuserOrders.Type == LimitOrder || placeOrderuserOrders.Type == StopLimitOrder {
+		rules = append(rules, cfg.ValidatePrice(price), cfg.ValidateNotional(price, size))
+	}
 
-			orderbookuserOrders.Asks = append(orderbookuserOrders.Asks, &o)
-		}
+	if placeOrderuserOrders.Type == StopMarketOrder || placeOrderuserOrders.Type == StopLimitOrder {
+		rules = append(rules, cfg.ValidatePrice(stopPrice))
 	}
 
-	for _, limit := range ob.Bids(){
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID: order.UserID,
-				ID: order.ID,
-				Price: order.Limit.Price,
-				Size: order.Size,
-				Bid: order.Bid,
-				Timestamp: order.Timestamp,
-			}
+	if trail != nil {
+		rules = append(rules, cfg.ValidateIncrement(trail.Amount), cfg.ValidateIncrement(trail.LimitOffset))
+	}
 
-			orderbookuserOrders.Bids = append(orderbookuserOrders.Bids, &o)
+	if placeOrderuserOrders.Type == PeggedOrder {
+		rules = append(rules, cfg.ValidateIncrement(peg.Offset))
+		if peg.Cap != 0 {
+			rules = append(rules, cfg.ValidatePrice(peg.Cap))
 		}
 	}
 
-	return c.JSON(http.StatusOK, orderbookuserOrders)
-}
-
-type CancelOrderRequest struct {
-	Bid bool
-	ID int64
-}
+	if err := errors.Join(rules...); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
 
-func (ex *Exchange) cancelOrder(c echo.Context) error {
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
+	if err := ex.claimClientOrderID(placeOrderuserOrders.UserID, placeOrderuserOrders.ClientOrderID); err != nil {
+		return c.JSON(http.StatusConflict, APIError{Error: err.Error()})
+	}
 
-	ob := ex.orderbooks[MarketETH]
-	order := ob.Orders[int64(id)]
+	order := orderbook.NewOrder(placeOrderuserOrders.Bid, size, placeOrderuserOrders.UserID)
+	order.Timestamp = now.UnixNano()
+	order.ClientOrderID = placeOrderuserOrders.ClientOrderID
+	order.TimeInForce = placeOrderuserOrders.TimeInForce
+	order.ExpiresAt = expiresAt
+	order.PostOnly = placeOrderuserOrders.PostOnly
+	order.Display = display
+	order.SelfTradePrevention = placeOrderuserOrders.SelfTradePrevention
+	if user, ok := ex.Users[order.UserID]; ok && order.SelfTradePrevention == "" {
+		order.SelfTradePrevention = user.SelfTradePrevention
+	}
 
-	ob.CancelOrder(order)
+	var (
+		matches []orderbook.Match
+		placeErr error
+		fills []fill
+		resp *PlaceOrderResponse
+	)
+
+	l.do(func(ob *orderbook.Orderbook) {
+		// The hold is keyed by the order ID, so it's handed out before the
+		// order goes in the book
+		order.ID = ex.sequencer.NextOrderID()
+
+		// Pegged orders only know their price once they rest, they're funded
+		// after
+		if placeOrderuserOrders.Type != PeggedOrder {
+			asset, amount := holdAmount(l, ob, order, price, size)
+			if placeErr = ex.fund(l, order.ID, order.UserID, asset, amount, order); placeErr != nil {
+				return
+			}
+		}
 
-	// fmt.Println("Order cancelled ")
+		switch {
+		// Limit orders
+		case placeOrderuserOrders.Type == LimitOrder:
+			matches, placeErr = ex.handlePlaceLimitOrder(l, price, order)
 
-	return c.JSON(200, map[string]any{ "msg": "order deleted" })
-}
+		// Market orders
+		case placeOrderuserOrders.Type == MarketOrder:
+			policy := placeOrderuserOrders.FillPolicy
 
-func (ex *Exchange) getOrderBook(c echo.Context) error {
-	ob := ex.orderbooks[MarketETH]
+			// Market orders are IOC by nature, FOK is the same as rejecting anything
+			// the book can't fill completely
+			if policy == "" && placeOrderuserOrders.TimeInForce == orderbook.FillOrKill {
+				policy = orderbook.RejectUnfilled
+			}
 
-	// return c.JSON(200, map[string]any{ jsonuserOrders})
-	return c.JSON(200, ob.Orders)
-}
+			matches, placeErr = ex.handlePlaceMarketOrder(l, order, policy)
 
-func (ex *Exchange) getBalance(c echo.Context) error {
-	balance1 := ex.Users[11].GetBalance(ex.Client, ex.Users[11].Address)
-	fmt.Printf("Balance: %+v\n", balance1)
+		// Pegged orders
+		case placeOrderuserOrders.Type == PeggedOrder:
+			matches, placeErr = ex.handlePlacePeggedOrder(l, peg, order)
 
-	balance2 := ex.Users[22].GetBalance(ex.Client, ex.Users[22].Address)
-	fmt.Printf("Balance: %+v\n", balance2)
+		// Stop orders
+		case placeOrderuserOrders.Type == StopMarketOrder || placeOrderuserOrders.Type == StopLimitOrder || trail != nil:
+			stop := orderbook.Stop{
+				Price: stopPrice,
+				Policy: placeOrderuserOrders.FillPolicy,
+				Trail: trail,
+			}
 
-	balance3 := ex.Users[33].GetBalance(ex.Client, ex.Users[33].Address)
-	fmt.Printf("Balance: %+v\n", balance3)
+			if placeOrderuserOrders.Type == StopLimitOrder {
+				stop.LimitPrice = price
+			}
 
-	return c.JSON(200, map[string]any{"1": balance1.String(), "2": balance2.String(), "3": balance3.String()})
-}
+			matches, placeErr = ex.handlePlaceStopOrder(l, stop, order)
+		}
 
-// TODO: Change userOrders structure to use negative and positive ids for asks and bids]
-func transferETH(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey, to common.Address, amount *big.Int, fromUserID int64, toUserID int64) error {
-	ctx := context.Background()
+		fills = ex.handleMatches(l, matches)
+		resp = newPlaceOrderResponse(cfg, order)
+	})
 
-	publicKey := fromPrivKey.Public()
-	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
-	if !ok {
-		return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
+	// Nothing went in the book
+	if placeErr != nil {
+		ex.releaseClientOrderID(order.UserID, order.ClientOrderID)
 	}
 
-	fromAddress := crypto.PubkeyToAddress(*publicKeyECDSA)
+	var liquidityErr *orderbook.InsufficientLiquidityError
+	if errors.As(placeErr, &liquidityErr) {
+		return c.JSON(http.StatusUnprocessableEntity, APIError{Error: liquidityErr.Error()})
+	}
+	var balanceErr *InsufficientBalanceError
+	if errors.As(placeErr, &balanceErr) {
+		return c.JSON(http.StatusUnprocessableEntity, APIError{Error: ex.balanceError(balanceErr)})
+	}
+	if errors.Is(placeErr, orderbook.ErrInAuction) {
+		return c.JSON(http.StatusConflict, APIError{Error: placeErr.Error()})
+	}
+	if errors.Is(placeErr, orderbook.ErrOutsideBand) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: placeErr.Error()})
+	}
+	if placeErr != nil {
+		return placeErr
+	}
 
-	nonce, err := client.PendingNonceAt(ctx, fromAddress)
-	if err != nil {
+	if err := ex.settle(l, fills); err != nil {
 		return err
 	}
 
-	gasLimit := uint64(21000) // in units
+	ex.setClientOrderID(order)
 
-	gasPrice, err := client.SuggestGasPrice(ctx)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return c.JSON(200, resp)
+}
 
-	tx := types.NewTransaction(nonce, to, amount, gasLimit, gasPrice, nil)
+// Has to run inside the matching loop, the order is still live
+func newPlaceOrderResponse(cfg MarketConfig, order *orderbook.Order) *PlaceOrderResponse {
+	resp := &PlaceOrderResponse{
+		OrderID: order.ID,
+		ClientOrderID: order.ClientOrderID,
+		Status: order.Status,
+		PostOnly: order.PostOnlyResult,
+		Filled: cfg.FormatSize(order.Filled),
+		Unfilled: cfg.FormatSize(order.Size),
+	}
+
+	if order.Limit != nil {
+		resp.Price = cfg.FormatPrice(order.Limit.Price)
+	}
+
+	return resp
+}
+
+func newGroupLeg(cfg MarketConfig, userID int64, req *GroupLegRequest, entry bool) (*orderbook.GroupLeg, error) {
+	if req == nil {
+		return nil, errors.New("missing leg")
+	}
+
+	size, err := cfg.ParseSize(req.Size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size: %v", err)
+	}
+
+	if err := cfg.ValidateSize(size); err != nil {
+		return nil, err
+	}
+
+	order := orderbook.NewOrder(req.Bid, size, userID)
+	order.ClientOrderID = req.ClientOrderID
+
+	leg := &orderbook.GroupLeg{Order: order}
+
+	switch req.Type {
+	case MarketOrder:
+		if !entry {
+			return nil, errors.New("only a bracket entry can be a market order")
+		}
+		leg.Market = true
+	case LimitOrder, StopLimitOrder:
+		if leg.Price, err = cfg.ParsePrice(req.Price); err != nil {
+			return nil, fmt.Errorf("invalid price: %v", err)
+		}
 
-	chainID := big.NewInt(1337)
+		if err := cfg.ValidateOrder(leg.Price, size); err != nil {
+			return nil, err
+		}
+	case StopMarketOrder:
+	default:
+		return nil, fmt.Errorf("invalid order type: %q", req.Type)
+	}
+
+	if req.Type == StopMarketOrder || req.Type == StopLimitOrder {
+		stopPrice, err := cfg.ParsePrice(req.StopPrice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop price: %v", err)
+		}
+
+		if err := cfg.ValidatePrice(stopPrice); err != nil {
+			return nil, err
+		}
+
+		leg.Stop = &orderbook.Stop{Price: stopPrice, LimitPrice: leg.Price}
+	}
+
+	return leg, nil
+}
 
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(chainID), fromPrivKey)
+func (ex *Exchange) handlePlaceOrderGroup(c echo.Context) error {
+	var placeGroupRequest PlaceGroupRequest
+
+	if err := json.NewDecoder(c.Request().Body).Decode(&placeGroupRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	l, err := ex.registry.Open(placeGroupRequest.Market)
 	if err != nil {
+		return c.JSON(marketErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	cfg := l.Config
+
+	group := &orderbook.OrderGroup{Type: placeGroupRequest.Type}
+
+	switch placeGroupRequest.Type {
+	case orderbook.OneCancelsOther:
+		if placeGroupRequest.Entry != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "OCO groups have no entry order"})
+		}
+	case orderbook.Bracket:
+		entry, err := newGroupLeg(cfg, placeGroupRequest.UserID, placeGroupRequest.Entry, true)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("entry: %v", err)})
+		}
+		group.Entry = entry
+	default:
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid group type: %q", placeGroupRequest.Type)})
+	}
+
+	if len(placeGroupRequest.Legs) < 2 {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "groups need at least two legs"})
+	}
+
+	for i, req := range placeGroupRequest.Legs {
+		leg, err := newGroupLeg(cfg, placeGroupRequest.UserID, req, false)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("leg %d: %v", i, err)})
+		}
+		group.Legs = append(group.Legs, leg)
+	}
+
+	now := ex.Clock.Now().UnixNano()
+	for _, order := range group.Orders() {
+		order.Timestamp = now
+	}
+
+	releaseClientOrderIDs := func(orders []*orderbook.Order) {
+		for _, order := range orders {
+			ex.releaseClientOrderID(order.UserID, order.ClientOrderID)
+		}
+	}
+
+	for i, order := range group.Orders() {
+		if err := ex.claimClientOrderID(order.UserID, order.ClientOrderID); err != nil {
+			releaseClientOrderIDs(group.Orders()[:i])
+			return c.JSON(http.StatusConflict, APIError{Error: err.Error()})
+		}
+	}
+
+	var (
+		fills []fill
+		resp *OrderGroup
+	)
+
+	l.do(func(ob *orderbook.Orderbook) {
+		// Limit legs that go straight in have to be inside the price band,
+		// bracket legs are checked when they're armed
+		straightIn := group.Legs
+		if group.Entry != nil {
+			straightIn = []*orderbook.GroupLeg{group.Entry}
+		}
+		for _, leg := range straightIn {
+			if !leg.Market && leg.Stop == nil && !ob.InBand(leg.Price) {
+				err = orderbook.ErrOutsideBand
+				return
+			}
+		}
+
+		if err = ex.fundGroup(l, ob, group); err != nil {
+			return
+		}
+
+		matches := ob.PlaceOrderGroup(group)
+
+		for _, order := range group.Orders() {
+			if !order.IsDone() {
+				ex.trackOrder(l.Symbol, order)
+			}
+		}
+
+		fills = ex.handleMatches(l, matches)
+		resp = newOrderGroup(l, group)
+	})
+
+	if err != nil {
+		releaseClientOrderIDs(group.Orders())
+	}
+
+	var balanceErr *InsufficientBalanceError
+	if errors.As(err, &balanceErr) {
+		return c.JSON(http.StatusUnprocessableEntity, APIError{Error: ex.balanceError(balanceErr)})
+	}
+	if errors.Is(err, orderbook.ErrOutsideBand) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, order := range group.Orders() {
+		ex.setClientOrderID(order)
+	}
+
+	if err := ex.settle(l, fills); err != nil {
 		return err
 	}
 
-	client.SendTransaction(ctx, signedTx)
+	return c.JSON(http.StatusOK, resp)
+}
+
+// A trade copied out of the matching loop, so it can be settled once the
+// command is done
+type fill struct {
+	TradeID int64
+	Price decimal.Decimal
+	Size decimal.Decimal
+	AskUserID int64
+	BidUserID int64
+}
+
+// Runs inside the matching loop. Books the trades in the ledger, forgets
+// about the orders the matches finished and copies out the trades for settle.
+func (ex *Exchange) handleMatches(l *Listing, matches []orderbook.Match) []fill {
+	fills := []fill{}
+
+	// Trades are paid out of the holds, so they go in before the holds of
+	// the orders they finished are released
+	refused := ex.bookTrades(l, matches)
+	ex.releaseHolds(l)
+
+	for _, match := range matches {
+		if match.IsTrade() {
+			ex.checkBreaker(l, l.orderbook)
+			break
+		}
+	}
+
+	ex.UserOrders.mu.Lock()
+	defer ex.UserOrders.mu.Unlock()
+
+	for _, match := range matches {
+		// Clear the Exchange order store of finished orders
+		ex.untrackDone(match.Ask, match.Bid)
+
+		// Self-trade prevented, or refused by the ledger - nothing to settle
+		if !match.IsTrade() || refused[match.TradeID] {
+			continue
+		}
+
+		fills = append(fills, fill{
+			TradeID: match.TradeID,
+			Price: match.Price,
+			Size: match.SizeFilled,
+			AskUserID: match.Ask.UserID,
+			BidUserID: match.Bid.UserID,
+		})
+	}
+
+	return fills
+}
+
+// Queues the fills to be paid out on chain and halts the market if they
+// tripped its circuit breaker. Runs outside the matching loop.
+func (ex *Exchange) settle(l *Listing, fills []fill) error {
+	cfg := l.Config
+
+	settlements := make([]*Settlement, 0, len(fills))
+	for _, f := range fills {
+		// TODO: Implement this - will be used to charge fees
+		// exchangePubKey := ex.PrivateKey.Public()
+		// publicKeyECDSA, ok := exchangePubKey.(*ecdsa.PublicKey)
+		// if !ok {
+		// 	return fmt.Errorf("cannot assert type: publicKey is not of type *ecdsa.PublicKey")
+		// }
 
-	fromBalance, err := client.BalanceAt(ctx, fromAddress, nil)
+		amount, err := cfg.SettlementAmount(f.Size)
+		if err != nil {
+			return err
+		}
+
+		settlements = append(settlements, &Settlement{
+			TradeID: f.TradeID,
+			Market: l.Symbol,
+			Asset: Asset(l.Base),
+			FromUserID: f.AskUserID,
+			ToUserID: f.BidUserID,
+			Amount: amount,
+		})
+	}
+
+	// The trades stand either way, they're in the ledger already
+	if len(settlements) > 0 {
+		ex.settlements.Enqueue(settlements...)
+	}
+
+	return ex.haltTripped(l)
+}
+
+// Restores the settlement queue from the journal at path. Settlements are
+// kept by trade ID, so new trades are numbered after the restored ones.
+func (ex *Exchange) openSettlementJournal(path string) error {
+	if err := ex.settlements.Open(path); err != nil {
+		return err
+	}
+
+	ex.sequencer.Skip(orderbook.SequencerState{LastTradeID: ex.settlements.LastTradeID()})
+
+	return nil
+}
+
+// Carries the order, trade and event sequences over from the state saved at
+// path, if there is one, and keeps saving them there as they're handed out
+func (ex *Exchange) openSequencerState(path string) error {
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		var state orderbook.SequencerState
+		if err := json.Unmarshal(b, &state); err != nil {
+			return fmt.Errorf("sequencer state %s: %w", path, err)
+		}
+		ex.sequencer.Skip(state)
+	}
+
+	return ex.sequencer.Persist(func(state orderbook.SequencerState) error {
+		return writeFileSynced(path, state)
+	})
+}
+
+// Replaces the file with v as JSON, so it holds either the old or the new
+// value whenever the process dies
+func writeFileSynced(path string, v any) error {
+	b, err := json.Marshal(v)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	
-	toBalance, err := client.BalanceAt(ctx, to, nil)
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (ex *Exchange) user(id int64) (*User, bool) {
+	u, ok := ex.Users[id]
+	return u, ok
+}
+
+func (ex *Exchange) handleGetMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	l, ok := ex.registry.Get(market)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
+
+	return c.JSON(http.StatusOK, ex.registry.Spec(l))
+}
+
+// TODO: The admin endpoints need auth before this goes anywhere near prod
+func (ex *Exchange) handleListMarkets(c echo.Context) error {
+	specs := []*MarketSpec{}
+	for _, l := range ex.registry.List() {
+		specs = append(specs, ex.registry.Spec(l))
+	}
+
+	return c.JSON(http.StatusOK, specs)
+}
+
+// Lists a new trading pair. New markets start PRE_OPEN unless the request
+// says otherwise.
+func (ex *Exchange) handleCreateMarket(c echo.Context) error {
+	var spec MarketSpec
+	if err := json.NewDecoder(c.Request().Body).Decode(&spec); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	cfg, err := spec.Config()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	if spec.Status == "" {
+		spec.Status = MarketPreOpen
+	}
+
+	l, err := ex.registry.Create(spec.Market, spec.Base, spec.Quote, cfg, spec.Status)
+	if err != nil {
+		return c.JSON(marketErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	str := fmt.Sprintf("SERVER: Listed market [%s] %s/%s as %s", l.Symbol, l.Base, l.Quote, spec.Status)
+	fmt.Println(utils.PrintColor("yellow", str))
+
+	return c.JSON(http.StatusCreated, ex.registry.Spec(l))
+}
+
+func (ex *Exchange) handleHaltMarket(c echo.Context) error {
+	return ex.setMarketStatus(c, MarketHalted)
+}
+
+func (ex *Exchange) handleOpenMarket(c echo.Context) error {
+	return ex.setMarketStatus(c, MarketOpen)
+}
+
+func (ex *Exchange) handleStartAuction(c echo.Context) error {
+	return ex.setMarketStatus(c, MarketAuction)
+}
+
+func (ex *Exchange) handleCloseMarket(c echo.Context) error {
+	return ex.setMarketStatus(c, MarketClosed)
+}
+
+// Resting orders stay in the book while a market is halted and can still be
+// cancelled, only new orders and amends are turned away
+func (ex *Exchange) setMarketStatus(c echo.Context, status MarketStatus) error {
+	market := Market(c.Param("market"))
+
+	if err := ex.SetMarketStatus(market, status); err != nil {
+		if errors.Is(err, ErrMarketNotFound) || errors.Is(err, ErrInvalidStatus) {
+			return c.JSON(marketErrorStatus(err), APIError{Error: err.Error()})
+		}
+		return err
+	}
+
+	l, _ := ex.registry.Get(market)
+	return c.JSON(http.StatusOK, ex.registry.Spec(l))
+}
+
+func (ex *Exchange) handleGetBook(c echo.Context) error {
+	market := Market(c.Param("market"))
+
+	l, ok := ex.registry.Get(market)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
+
+	return c.JSON(http.StatusOK, l.snapshot().book)
+}
+
+// Events after the ?after= sequence number, all of them without it
+func (ex *Exchange) handleGetEvents(c echo.Context) error {
+	var after uint64
+	if s := c.QueryParam("after"); s != "" {
+		var err error
+		if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "invalid sequence number"})
+		}
+	}
+
+	return c.JSON(http.StatusOK, ex.events.Since(after))
+}
+
+type CancelOrderRequest struct {
+	Bid bool
+	ID int64
+}
+
+func (ex *Exchange) cancelOrder(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
+	}
+
+	ex.UserOrders.mu.RLock()
+	market, ok := ex.markets[id]
+	ex.UserOrders.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: orderbook.ErrOrderNotFound.Error()})
+	}
+
+	// Cancelling is allowed whatever the market status, so orders can be
+	// pulled out of a halted market
+	l, _ := ex.registry.Get(market)
+
+	var fills []fill
+	l.do(func(ob *orderbook.Orderbook) {
+		var (
+			order *orderbook.Order
+			matches []orderbook.Match
+		)
+
+		// Cancelling a bracket entry can send its legs in
+		if order, matches, err = ob.CancelOrderByID(id); err != nil {
+			return
+		}
+
+		fills = ex.handleMatches(l, matches)
+
+		ex.UserOrders.mu.Lock()
+		ex.untrackDone(order)
+		ex.UserOrders.mu.Unlock()
+	})
+	if errors.Is(err, orderbook.ErrOrderNotFound) {
+		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
+	}
+
+	if err := ex.settle(l, fills); err != nil {
+		return err
+	}
+
+	// fmt.Println("Order cancelled ")
+
+	return c.JSON(200, map[string]any{ "msg": "order deleted" })
+}
+
+type AmendOrderRequest struct {
+	Price string // Leave empty to keep the current price
+	Size string // New open size, leave empty to keep the current one
+}
+
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid order id"})
+	}
+
+	var amendOrderRequest AmendOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&amendOrderRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid request body"})
+	}
+
+	ex.UserOrders.mu.RLock()
+	market, ok := ex.markets[id]
+	ex.UserOrders.mu.RUnlock()
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: orderbook.ErrOrderNotFound.Error()})
+	}
+
+	l, err := ex.registry.Open(market)
+	if err != nil {
+		return c.JSON(marketErrorStatus(err), APIError{Error: err.Error()})
+	}
+
+	cfg := l.Config
+
+	var price, size decimal.Decimal
+	if amendOrderRequest.Price != "" {
+		if price, err = cfg.ParsePrice(amendOrderRequest.Price); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid price: %v", err)})
+		}
+
+		if err := cfg.ValidatePrice(price); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+	}
+
+	if amendOrderRequest.Size != "" {
+		if size, err = cfg.ParseSize(amendOrderRequest.Size); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid size: %v", err)})
+		}
+
+		if err := cfg.ValidateSize(size); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
 	}
 
+	var (
+		fills []fill
+		resp *PlaceOrderResponse
+	)
+
+	l.do(func(ob *orderbook.Orderbook) {
+		var (
+			order *orderbook.Order
+			matches []orderbook.Match
+		)
+
+		// An amend that needs more funds locks them before it goes through.
+		// Group legs draw on their group's hold.
+		var (
+			userID, hold int64
+			asset Asset
+			held, need decimal.Decimal
+		)
+		if o, ok := ob.Orders[id]; ok {
+			// Whichever of price and size isn't sent stays what it is, and
+			// the amended order still has to fit the notional limits
+			newPrice, newSize := price, size
+			if newSize == 0 {
+				newSize = o.Size
+			}
+			if newPrice == 0 {
+				newPrice = o.Limit.Price
+			}
+
+			if err = cfg.ValidateNotional(newPrice, newSize); err != nil {
+				return
+			}
+
+			if hold = holdID(o); l.funded[hold] != nil {
+				if price == 0 {
+					newPrice = worstPrice(o)
+				}
 
-	fbOut := fmt.Sprintf("Transferred %v \n- From: User [%v] | balance %+v \n- To:   User [%v] | balance %+v \n", amount, fromUserID, fromBalance, toUserID, toBalance)
-	fmt.Println(utils.PrintColor("blue", fbOut))
+				userID = o.UserID
+				asset, need = holdAmount(l, ob, o, newPrice, newSize)
+				held = ex.ledger.Held(hold, asset)
 
-	return client.SendTransaction(ctx, signedTx)
+				if need > held {
+					if err = ex.ledger.SetHold(userID, hold, asset, need); err != nil {
+						return
+					}
+				}
+			}
+		}
+
+		order, matches, err = ob.AmendOrder(id, price, size)
+		if err != nil {
+			if need > held {
+				ex.ledger.SetHold(userID, hold, asset, held)
+			}
+			return
+		}
+
+		fills = ex.handleMatches(l, matches)
+		// Smaller now, or matched some of the way
+		ex.trimHold(l, order)
+
+		// e.g. a post-only order moved to a price where it got rejected
+		ex.UserOrders.mu.Lock()
+		ex.untrackDone(order)
+		ex.UserOrders.mu.Unlock()
+
+		resp = newPlaceOrderResponse(cfg, order)
+	})
+	if errors.Is(err, orderbook.ErrOrderNotFound) {
+		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
+	}
+	if errors.Is(err, orderbook.ErrInvalidAmend) || errors.Is(err, orderbook.ErrAmendPegged) || errors.Is(err, orderbook.ErrOutsideBand) || errors.Is(err, ErrMarketRules) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	// The order stands as it was, the amend is what's wrong
+	var balanceErr *InsufficientBalanceError
+	if errors.As(err, &balanceErr) {
+		return c.JSON(http.StatusBadRequest, APIError{Error: ex.balanceError(balanceErr)})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := ex.settle(l, fills); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resp)
 }
 
+func (ex *Exchange) getOrderBook(c echo.Context) error {
+	l, ok := ex.registry.Get(Market(c.Param("market")))
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
+
+	// The orders the public book shows, keyed by ID - only the visible slice
+	// of an iceberg
+	book := l.snapshot().book
+	orders := make(map[int64]*Order, len(book.Asks)+len(book.Bids))
+	for _, o := range book.Asks {
+		orders[o.ID] = o
+	}
+	for _, o := range book.Bids {
+		orders[o.ID] = o
+	}
+
+	return c.JSON(200, orders)
+}
+
+func (ex *Exchange) getBalance(c echo.Context) error {
+	balances := map[string]any{}
+
+	for i, id := range []int64{11, 22, 33} {
+		balance, err := ex.Users[id].GetBalance(ex.Settler)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Balance: %+v\n", balance)
+
+		balances[strconv.Itoa(i+1)] = balance.String()
+	}
+
+	return c.JSON(200, balances)
+}
+
+// TODO: Change userOrders structure to use negative and positive ids for asks and bids]
 type PriceResponse struct {
-	Price float64
+	Price string
 }
 
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 	market := Market(c.Param("market"))
 
-	ob := ex.orderbooks[market]
+	l, ok := ex.registry.Get(market)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
 
-	if len(ob.Bids()) == 0{ 
+	bestBid := l.snapshot().bestBid
+	if bestBid == 0 {
 		return fmt.Errorf(utils.PrintColor("Blue", "SERVER: No bids to show!"))
 	}
-	bestBid := ob.Bids()[0]
 
 	// DEBUGGING
 	// str := fmt.Sprintf("SERVER: Best bid: %v", ob.Bids())
 	// fmt.Println(utils.PrintColor("red", str))
 
-	return c.JSON(http.StatusOK, bestBid)
+	return c.JSON(http.StatusOK, PriceResponse{Price: l.Config.FormatPrice(bestBid)})
 }
 
 func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	market := Market(c.Param("market"))
 
-	ob := ex.orderbooks[market]
+	l, ok := ex.registry.Get(market)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
 
-	if len(ob.Asks()) == 0{ 
+	bestAsk := l.snapshot().bestAsk
+	if bestAsk == 0 {
 		return fmt.Errorf(utils.PrintColor("Blue", "SERVER: No asks to show!"))
 	}
 
@@ -581,21 +1843,35 @@ func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
 	// str := fmt.Sprintf("SERVER: Best ask: %v", ob.Asks())
 	// fmt.Println(utils.PrintColor("red", str))
 
-	bestAsk := ob.Asks()[0]
-
-	return c.JSON(http.StatusOK, bestAsk)
+	return c.JSON(http.StatusOK, PriceResponse{Price: l.Config.FormatPrice(bestAsk)})
 }
 
 type GetTradesResponse struct {
-	Trades []*orderbook.Trade
+	Trades []*Trade
 }
 
 func (ex *Exchange) handleGetTrades(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	l, ok := ex.registry.Get(market)
 	if ! ok {
-		return c.JSON(http.StatusBadRequest, APIError{Error: "Orderbook not found"})
+		return c.JSON(http.StatusNotFound, APIError{Error: ErrMarketNotFound.Error()})
+	}
+
+	trades := l.snapshot().trades
+	cfg := l.Config
+
+	resp := &GetTradesResponse{
+		Trades: make([]*Trade, len(trades)),
+	}
+
+	for i, trade := range trades {
+		resp.Trades[i] = &Trade{
+			Price: cfg.FormatPrice(trade.Price),
+			Size: cfg.FormatSize(trade.Size),
+			Bid: trade.Bid,
+			Timestamp: trade.Timestamp,
+		}
 	}
 
-	return c.JSON(http.StatusOK, ob.Trades)
+	return c.JSON(http.StatusOK, resp)
 }
\ No newline at end of file
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kkomitski/exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// Exchange on a simulated chain with every user funded and the order entry
+// routes up
+func newTestExchange(t *testing.T, users ...int64) (*Exchange, *echo.Echo) {
+	ex, err := NewExchange(exchangePrivateKey, NewSimulatedChain())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := Markets[MarketETH]
+	for _, user := range users {
+		ex.Users[user] = newTestUser(t, user)
+		ex.ledger.Deposit(user, "ETH", cfg.SizeScale.FromInt(100))
+		ex.ledger.Deposit(user, "USD", cfg.PriceScale.FromInt(100_000))
+	}
+
+	e := echo.New()
+	e.GET("/orders/:userID", ex.handleGetOrders)
+	e.POST("/order", ex.handlePlaceOrder)
+	e.POST("/orders/group", ex.handlePlaceOrderGroup)
+	e.DELETE("/order/:id", ex.cancelOrder)
+	e.PATCH("/order/:id", ex.handleAmendOrder)
+
+	return ex, e
+}
+
+func TestPlaceOrderValidation(t *testing.T) {
+	_, e := newTestExchange(t, 1)
+
+	cases := map[string]PlaceOrderRequest{
+		"fill policy":   {UserID: 1, Type: MarketOrder, Bid: true, Size: "1", Market: MarketETH, FillPolicy: "PARTAIL"},
+		"time in force": {UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00", Market: MarketETH, TimeInForce: "GTX"},
+		"order type":    {UserID: 1, Type: "LIMT", Bid: true, Size: "1", Price: "1000.00", Market: MarketETH},
+	}
+
+	for name, req := range cases {
+		if rec := request(e, http.MethodPost, "/order", req); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s", name, rec.Code, rec.Body)
+		}
+	}
+}
+
+// An order that doesn't go in leaves its client order ID free for a resend
+func TestClientOrderIDReleased(t *testing.T) {
+	_, e := newTestExchange(t, 1)
+
+	bid := PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "200000.00", Market: MarketETH, ClientOrderID: "a"}
+	if rec := request(e, http.MethodPost, "/order", bid); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("unaffordable order: %d %s", rec.Code, rec.Body)
+	}
+
+	bid.Price = "1000.00"
+	if rec := request(e, http.MethodPost, "/order", bid); rec.Code != http.StatusOK {
+		t.Fatalf("resend: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := request(e, http.MethodPost, "/order", bid); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate: %d %s", rec.Code, rec.Body)
+	}
+
+	// The second leg reuses "a", so the first leg's "b" is given back
+	group := PlaceGroupRequest{
+		UserID: 1,
+		Market: MarketETH,
+		Type:   orderbook.OneCancelsOther,
+		Legs: []*GroupLegRequest{
+			{Type: LimitOrder, Size: "1", Price: "1500.00", ClientOrderID: "b"},
+			{Type: StopMarketOrder, Size: "1", StopPrice: "900.00", ClientOrderID: "a"},
+		},
+	}
+	if rec := request(e, http.MethodPost, "/orders/group", group); rec.Code != http.StatusConflict {
+		t.Fatalf("group with a used id: %d %s", rec.Code, rec.Body)
+	}
+
+	group.Legs[1].ClientOrderID = "c"
+	if rec := request(e, http.MethodPost, "/orders/group", group); rec.Code != http.StatusOK {
+		t.Errorf("group resend: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Swapping the exchange clock swaps it for everything that stamps a time
+func TestExchangeClock(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+	clock := &fakeClock{now: time.Unix(1_000, 0)}
+	ex.Clock = clock
+
+	for _, req := range []PlaceOrderRequest{
+		{UserID: 1, Type: LimitOrder, Size: "1", Price: "1000.00", Market: MarketETH},
+		{UserID: 2, Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00", Market: MarketETH},
+	} {
+		if rec := request(e, http.MethodPost, "/order", req); rec.Code != http.StatusOK {
+			t.Fatalf("place: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	want := clock.now.UnixNano()
+
+	l, _ := ex.registry.Get(MarketETH)
+	if trades := l.snapshot().trades; len(trades) != 1 || trades[0].Timestamp != want {
+		t.Errorf("trades: got %+v", trades)
+	}
+
+	// The deposits went in before the clock was swapped
+	for _, entry := range ex.ledger.Entries(2) {
+		if entry.Type != EntryDeposit && entry.Timestamp != want {
+			t.Errorf("ledger entry %d: got %d", entry.ID, entry.Timestamp)
+		}
+	}
+
+	if s := ex.settlements.ForUser(2); len(s) != 1 || s[0].UpdatedAt != want {
+		t.Errorf("settlements: got %+v", s)
+	}
+}
+
+// A bracket whose entry finishes without filling leaves nothing behind
+func TestBracketEntryUntracked(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+
+	// No asks, the market entry fills nothing
+	group := PlaceGroupRequest{
+		UserID: 1,
+		Market: MarketETH,
+		Type:   orderbook.Bracket,
+		Entry:  &GroupLegRequest{Type: MarketOrder, Bid: true, Size: "1"},
+		Legs: []*GroupLegRequest{
+			{Type: LimitOrder, Size: "1", Price: "1200.00"},
+			{Type: StopMarketOrder, Size: "1", StopPrice: "900.00"},
+		},
+	}
+	rec := request(e, http.MethodPost, "/orders/group", group)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	var resp OrderGroup
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	for _, leg := range resp.Legs {
+		if leg.Status != orderbook.StatusCancelled {
+			t.Errorf("leg %d: got %s", leg.ID, leg.Status)
+		}
+	}
+
+	ex.UserOrders.mu.RLock()
+	defer ex.UserOrders.mu.RUnlock()
+	if n := len(ex.orderMap[1]); n != 0 {
+		t.Errorf("still tracking %d orders", n)
+	}
+}
+
+// DELETE on a leg waiting for its entry pulls the whole bracket and its holds
+func TestCancelPendingBracketLeg(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+
+	group := PlaceGroupRequest{
+		UserID: 1,
+		Market: MarketETH,
+		Type:   orderbook.Bracket,
+		Entry:  &GroupLegRequest{Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00"},
+		Legs: []*GroupLegRequest{
+			{Type: LimitOrder, Size: "1", Price: "1200.00"},
+			{Type: StopMarketOrder, Size: "1", StopPrice: "900.00"},
+		},
+	}
+	rec := request(e, http.MethodPost, "/orders/group", group)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	var resp OrderGroup
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+
+	if rec := request(e, http.MethodDelete, fmt.Sprintf("/order/%d", resp.Legs[1].ID), nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancel: %d %s", rec.Code, rec.Body)
+	}
+
+	for asset, b := range ex.ledger.Balances(1) {
+		if b.Locked != 0 {
+			t.Errorf("%s: %d still locked", asset, b.Locked)
+		}
+	}
+
+	ex.UserOrders.mu.RLock()
+	defer ex.UserOrders.mu.RUnlock()
+	if n := len(ex.orderMap[1]); n != 0 {
+		t.Errorf("still tracking %d orders", n)
+	}
+}
+
+// Amending only the price or only the size can't take an order past the
+// notional limits
+func TestAmendNotional(t *testing.T) {
+	_, e := newTestExchange(t, 1)
+
+	// 1.00 notional, right at the minimum
+	rec := request(e, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "0.001", Price: "1000.00", Market: MarketETH})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	var resp PlaceOrderResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	path := fmt.Sprintf("/order/%d", resp.OrderID)
+
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Price: "999.00"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("below the minimum: %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Size: "0.002"}); rec.Code != http.StatusOK {
+		t.Fatalf("amend size: %d %s", rec.Code, rec.Body)
+	}
+
+	// 120,000,000.00 at the new size
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Price: "60000000000.00"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("above the maximum: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// The public book only shows the visible slice of an iceberg
+func TestBookHidesIcebergReserve(t *testing.T) {
+	ex, e := newTestExchange(t, 1)
+	e.GET("/book/:market", ex.handleGetBook)
+	e.GET("/orderbook/:market", ex.getOrderBook)
+
+	iceberg := PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "10", DisplaySize: "1", Price: "1000.00", Market: MarketETH}
+	rec := request(e, http.MethodPost, "/order", iceberg)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("place: %d %s", rec.Code, rec.Body)
+	}
+
+	var placed PlaceOrderResponse
+	json.Unmarshal(rec.Body.Bytes(), &placed)
+
+	var orders map[int64]*Order
+	json.Unmarshal(request(e, http.MethodGet, "/orderbook/ETH", nil).Body.Bytes(), &orders)
+
+	o, ok := orders[placed.OrderID]
+	if !ok {
+		t.Fatalf("order %d not in %+v", placed.OrderID, orders)
+	}
+	if o.Size != "1.00000000" || o.DisplaySize != "" {
+		t.Errorf("orderbook shows size %q, display size %q", o.Size, o.DisplaySize)
+	}
+
+	var book OrderBookuserOrders
+	json.Unmarshal(request(e, http.MethodGet, "/book/ETH", nil).Body.Bytes(), &book)
+
+	if len(book.Bids) != 1 || book.Bids[0].Size != o.Size || book.TotalBidVolume != o.Size {
+		t.Errorf("book and orderbook disagree: %+v, %+v", book, o)
+	}
+}
+
+// Placing outside the price band fails the same way amending out of it does
+func TestOutsideBand(t *testing.T) {
+	ex, e := newTestExchange(t, 1, 2)
+
+	// The band goes 20% either side of the trade at 1,000.00
+	for _, req := range []PlaceOrderRequest{
+		{UserID: 1, Type: LimitOrder, Size: "1", Price: "1000.00", Market: MarketETH},
+		{UserID: 2, Type: MarketOrder, Bid: true, Size: "1", Market: MarketETH},
+	} {
+		if rec := request(e, http.MethodPost, "/order", req); rec.Code != http.StatusOK {
+			t.Fatalf("trade: %d %s", rec.Code, rec.Body)
+		}
+	}
+
+	bid := PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: "1", Price: "1500.00", Market: MarketETH}
+	if rec := request(e, http.MethodPost, "/order", bid); rec.Code != http.StatusBadRequest {
+		t.Errorf("limit: got %d %s", rec.Code, rec.Body)
+	}
+
+	oco := PlaceGroupRequest{
+		UserID: 2,
+		Market: MarketETH,
+		Type:   orderbook.OneCancelsOther,
+		Legs: []*GroupLegRequest{
+			{Type: LimitOrder, Bid: true, Size: "1", Price: "500.00"},
+			{Type: StopMarketOrder, Bid: true, Size: "1", StopPrice: "1100.00"},
+		},
+	}
+	if rec := request(e, http.MethodPost, "/orders/group", oco); rec.Code != http.StatusBadRequest {
+		t.Errorf("group: got %d %s", rec.Code, rec.Body)
+	}
+
+	if got := ex.ledger.Balances(2)["USD"].Locked; got != 0 {
+		t.Errorf("%d USD still locked", got)
+	}
+
+	bid.Price = "1100.00"
+	rec := request(e, http.MethodPost, "/order", bid)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("inside the band: %d %s", rec.Code, rec.Body)
+	}
+
+	var resp PlaceOrderResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+
+	path := fmt.Sprintf("/order/%d", resp.OrderID)
+	if rec := request(e, http.MethodPatch, path, AmendOrderRequest{Price: "1500.00"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("amend: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Order IDs and event sequence numbers pick up after the saved state, they
+// don't start over
+func TestSequencerStateRestored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sequencer.json")
+
+	place := func(e *echo.Echo) int64 {
+		t.Helper()
+
+		rec := request(e, http.MethodPost, "/order", PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00", Market: MarketETH})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("place: %d %s", rec.Code, rec.Body)
+		}
+
+		var resp PlaceOrderResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+
+		return resp.OrderID
+	}
+
+	before, e := newTestExchange(t, 1)
+	if err := before.openSequencerState(path); err != nil {
+		t.Fatal(err)
+	}
+	id := place(e)
+	before.emit(Event{Type: EventOrderExpired})
+	seq := before.events.Since(0)[0].Seq
+
+	after, e := newTestExchange(t, 1)
+	if err := after.openSequencerState(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := place(e); got <= id {
+		t.Errorf("order ID %d handed out again after %d", got, id)
+	}
+
+	after.emit(Event{Type: EventOrderExpired})
+	if got := after.events.Since(0)[0].Seq; got <= seq {
+		t.Errorf("event %d numbered again after %d", got, seq)
+	}
+}
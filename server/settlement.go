@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/kkomitski/exchange/utils"
+)
+
+// Where a trade's settlement is at
+type SettlementStatus string
+
+const (
+	// Queued, not sent yet
+	SettlementPending SettlementStatus = "PENDING"
+	// Sent, not in a block yet
+	SettlementSubmitted SettlementStatus = "SUBMITTED"
+	SettlementConfirmed SettlementStatus = "CONFIRMED"
+	// Reverted, dropped or given up on, until it's retried
+	SettlementFailed SettlementStatus = "FAILED"
+)
+
+// A transfer as it goes out on chain. Resending it with the same nonce and a
+// higher gas price replaces it.
+type Transfer struct {
+	Asset    Asset
+	From     *User
+	To       *User
+	Amount   *big.Int
+	Nonce    uint64
+	GasPrice *big.Int
+}
+
+// Where trades are paid out. The exchange only ever talks to a chain through
+// one of these. Amounts are in the chain's smallest unit, e.g. wei.
+type Settler interface {
+	// Sends the transfer, returning the ID to follow it by
+	Transfer(ctx context.Context, t *Transfer) (string, error)
+	Balance(ctx context.Context, address common.Address) (*big.Int, error)
+	// SUBMITTED until the transfer is in a block
+	Status(ctx context.Context, txID string) (SettlementStatus, error)
+	// Next nonce of the address, counting transfers that aren't mined yet
+	Nonce(ctx context.Context, address common.Address) (uint64, error)
+	GasPrice(ctx context.Context) (*big.Int, error)
+	// Whether transfers of the asset can go through it
+	Moves(asset Asset) bool
+}
+
+// The chain's own coin, the only asset the Ethereum settler and the simulated
+// chain move
+const NativeAsset Asset = "ETH"
+
+const (
+	SettlerEthereum  = "ethereum"
+	SettlerSimulated = "simulated"
+)
+
+// Picks the settlement backend. Defaults to the local Ganache node.
+type SettlementConfig struct {
+	Backend string // ethereum or simulated
+	RPCURL  string // Ethereum only
+	ChainID int64  // Ethereum only
+	Journal string // File the settlement queue is kept in, none keeps it in memory and loses it on a restart
+	Queue   SettlementQueueConfig
+}
+
+// Reads SETTLER, ETH_RPC_URL, ETH_CHAIN_ID, SETTLEMENT_JOURNAL and, to net
+// fills before they're settled, SETTLEMENT_NETTING (bilateral or
+// multilateral) with SETTLEMENT_NETTING_WINDOW (e.g. 10s) and
+// SETTLEMENT_NETTING_COUNT, falling back to the defaults. Values that don't
+// parse, and netting setups that would never settle, are errors.
+func SettlementConfigFromEnv() (SettlementConfig, error) {
+	cfg := SettlementConfig{
+		Backend: SettlerEthereum,
+		RPCURL:  "HTTP://127.0.0.1:8545",
+		ChainID: 1337,
+		Queue:   DefaultSettlementQueueConfig,
+	}
+
+	if backend := os.Getenv("SETTLER"); backend != "" {
+		cfg.Backend = backend
+	}
+
+	if url := os.Getenv("ETH_RPC_URL"); url != "" {
+		cfg.RPCURL = url
+	}
+
+	if id := os.Getenv("ETH_CHAIN_ID"); id != "" {
+		chainID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ETH_CHAIN_ID %q: %w", id, err)
+		}
+		cfg.ChainID = chainID
+	}
+
+	cfg.Journal = os.Getenv("SETTLEMENT_JOURNAL")
+
+	if mode := os.Getenv("SETTLEMENT_NETTING"); mode != "" {
+		cfg.Queue.Netting = NettingMode(strings.ToUpper(mode))
+		cfg.Queue.NettingWindow = 10 * time.Second
+	}
+
+	if window := os.Getenv("SETTLEMENT_NETTING_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SETTLEMENT_NETTING_WINDOW %q: %w", window, err)
+		}
+		cfg.Queue.NettingWindow = d
+	}
+
+	if count := os.Getenv("SETTLEMENT_NETTING_COUNT"); count != "" {
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SETTLEMENT_NETTING_COUNT %q: %w", count, err)
+		}
+		cfg.Queue.NettingCount = n
+	}
+
+	return cfg, cfg.Queue.Validate()
+}
+
+func NewSettler(cfg SettlementConfig) (Settler, error) {
+	switch cfg.Backend {
+	case SettlerEthereum:
+		client, err := ethclient.Dial(cfg.RPCURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewEthereumSettler(client, big.NewInt(cfg.ChainID)), nil
+	case SettlerSimulated:
+		return NewSimulatedChain(), nil
+	}
+
+	return nil, fmt.Errorf("unknown settlement backend: %q", cfg.Backend)
+}
+
+// Settles in ETH transfers signed with the users' keys
+type EthereumSettler struct {
+	client  *ethclient.Client
+	chainID *big.Int
+}
+
+func NewEthereumSettler(client *ethclient.Client, chainID *big.Int) *EthereumSettler {
+	return &EthereumSettler{
+		client:  client,
+		chainID: chainID,
+	}
+}
+
+func (s *EthereumSettler) Transfer(ctx context.Context, t *Transfer) (string, error) {
+	if !s.Moves(t.Asset) {
+		return "", fmt.Errorf("can't transfer %s", t.Asset)
+	}
+
+	gasLimit := uint64(21000) // in units
+
+	tx := types.NewTransaction(t.Nonce, t.To.Address, t.Amount, gasLimit, t.GasPrice, nil)
+
+	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(s.chainID), t.From.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.client.SendTransaction(ctx, signedTx); err != nil {
+		return "", err
+	}
+
+	fbOut := fmt.Sprintf("Transferred %v \n- From: User [%v] \n- To:   User [%v] \n- Nonce: %d | Gas price: %v | Tx: %s \n", t.Amount, t.From.ID, t.To.ID, t.Nonce, t.GasPrice, signedTx.Hash().Hex())
+	fmt.Println(utils.PrintColor("blue", fbOut))
+
+	return signedTx.Hash().Hex(), nil
+}
+
+func (s *EthereumSettler) Balance(ctx context.Context, address common.Address) (*big.Int, error) {
+	return s.client.BalanceAt(ctx, address, nil)
+}
+
+func (s *EthereumSettler) Status(ctx context.Context, txID string) (SettlementStatus, error) {
+	receipt, err := s.client.TransactionReceipt(ctx, common.HexToHash(txID))
+	if errors.Is(err, ethereum.NotFound) {
+		return SettlementSubmitted, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		return SettlementFailed, nil
+	}
+
+	return SettlementConfirmed, nil
+}
+
+func (s *EthereumSettler) Nonce(ctx context.Context, address common.Address) (uint64, error) {
+	return s.client.PendingNonceAt(ctx, address)
+}
+
+func (s *EthereumSettler) Moves(asset Asset) bool {
+	return asset == NativeAsset
+}
+
+func (s *EthereumSettler) GasPrice(ctx context.Context) (*big.Int, error) {
+	return s.client.SuggestGasPrice(ctx)
+}
+
+var ErrUnknownTransfer = errors.New("unknown transfer")
+
+// A chain that lives in memory, for tests and running locally without a node.
+// Transfers are mined as soon as they're sent, in nonce order, unless they're
+// priced below MinGasPrice - those wait until they're replaced with a better
+// price.
+type SimulatedChain struct {
+	mu       sync.Mutex
+	balances map[common.Address]*big.Int
+	// Next nonce to be mined
+	nonces map[common.Address]uint64
+	// Sent but not mined, by nonce
+	pool      map[common.Address]map[uint64]*simulatedTx
+	transfers map[string]SettlementStatus
+	lastTx    int64
+
+	MinGasPrice *big.Int // Nil mines everything
+	// What GasPrice suggests
+	SuggestedGasPrice *big.Int
+}
+
+type simulatedTx struct {
+	id string
+	t  Transfer
+}
+
+func NewSimulatedChain() *SimulatedChain {
+	return &SimulatedChain{
+		balances:          make(map[common.Address]*big.Int),
+		nonces:            make(map[common.Address]uint64),
+		pool:              make(map[common.Address]map[uint64]*simulatedTx),
+		transfers:         make(map[string]SettlementStatus),
+		SuggestedGasPrice: big.NewInt(1),
+	}
+}
+
+// Credits the address out of thin air, e.g. to set up test accounts
+func (c *SimulatedChain) Fund(address common.Address, amount *big.Int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.balances[address] = new(big.Int).Add(c.balance(address), amount)
+}
+
+// Lets transfers priced at or above price through, mining whatever was
+// waiting on it
+func (c *SimulatedChain) SetMinGasPrice(price *big.Int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.MinGasPrice = price
+	for address := range c.pool {
+		c.mine(address)
+	}
+}
+
+func (c *SimulatedChain) balance(address common.Address) *big.Int {
+	if b, ok := c.balances[address]; ok {
+		return b
+	}
+
+	return new(big.Int)
+}
+
+func (c *SimulatedChain) Transfer(ctx context.Context, t *Transfer) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.Moves(t.Asset) {
+		return "", fmt.Errorf("can't transfer %s", t.Asset)
+	}
+
+	from := t.From.Address
+	pool := c.pool[from]
+
+	if next := c.nonces[from] + uint64(len(pool)); t.Nonce < c.nonces[from] || t.Nonce > next {
+		return "", fmt.Errorf("invalid nonce %d, next is %d", t.Nonce, next)
+	}
+
+	if c.balance(from).Cmp(t.Amount) < 0 {
+		return "", fmt.Errorf("user %d can't cover a transfer of %v", t.From.ID, t.Amount)
+	}
+
+	// Replacing a transfer takes a better price, like on a real node
+	replaced := pool[t.Nonce]
+	if replaced != nil && t.GasPrice.Cmp(replaced.t.GasPrice) <= 0 {
+		return "", fmt.Errorf("replacement transfer underpriced")
+	}
+
+	c.lastTx++
+	tx := &simulatedTx{id: fmt.Sprintf("sim-%d", c.lastTx), t: *t}
+
+	if replaced != nil {
+		c.transfers[replaced.id] = SettlementFailed
+	}
+
+	if pool == nil {
+		c.pool[from] = make(map[uint64]*simulatedTx)
+	}
+	c.pool[from][t.Nonce] = tx
+	c.transfers[tx.id] = SettlementSubmitted
+
+	c.mine(from)
+
+	return tx.id, nil
+}
+
+// Mines the address's transfers in nonce order for as long as they're priced
+// high enough
+func (c *SimulatedChain) mine(address common.Address) {
+	for {
+		tx := c.pool[address][c.nonces[address]]
+		if tx == nil || (c.MinGasPrice != nil && tx.t.GasPrice.Cmp(c.MinGasPrice) < 0) {
+			return
+		}
+
+		delete(c.pool[address], tx.t.Nonce)
+		c.nonces[address]++
+
+		// The balance was checked on the way in but may have gone since
+		if c.balance(address).Cmp(tx.t.Amount) < 0 {
+			c.transfers[tx.id] = SettlementFailed
+			continue
+		}
+
+		c.balances[address] = new(big.Int).Sub(c.balance(address), tx.t.Amount)
+		c.balances[tx.t.To.Address] = new(big.Int).Add(c.balance(tx.t.To.Address), tx.t.Amount)
+		c.transfers[tx.id] = SettlementConfirmed
+	}
+}
+
+func (c *SimulatedChain) Balance(ctx context.Context, address common.Address) (*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return new(big.Int).Set(c.balance(address)), nil
+}
+
+func (c *SimulatedChain) Status(ctx context.Context, txID string) (SettlementStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status, ok := c.transfers[txID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownTransfer, txID)
+	}
+
+	return status, nil
+}
+
+func (c *SimulatedChain) Nonce(ctx context.Context, address common.Address) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.nonces[address] + uint64(len(c.pool[address])), nil
+}
+
+func (c *SimulatedChain) GasPrice(ctx context.Context) (*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return new(big.Int).Set(c.SuggestedGasPrice), nil
+}
+
+func (c *SimulatedChain) Moves(asset Asset) bool {
+	return asset == NativeAsset
+}
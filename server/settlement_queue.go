@@ -0,0 +1,829 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kkomitski/exchange/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// A trade's payment on chain, the seller's base asset to the buyer. When
+// fills are netted, the transfers of the netting are kept as settlements too,
+// without a trade.
+type Settlement struct {
+	TradeID    int64  `json:",omitempty"`
+	NettingID  int64  `json:",omitempty"` // Netting it's settled through
+	Market     Market `json:",omitempty"`
+	Asset      Asset
+	FromUserID int64
+	ToUserID   int64
+	Amount     *big.Int // In the chain's smallest unit
+	Status     SettlementStatus
+	// Of the transfer it went out in, shared with the trades batched with it.
+	// TxID is the send that was mined, or the latest one until then.
+	TxID      string   `json:",omitempty"`
+	TxIDs     []string `json:",omitempty"` // Every send under Nonce
+	Nonce     uint64   `json:",omitempty"`
+	GasPrice  *big.Int `json:",omitempty"`
+	Attempts  int
+	Error     string `json:",omitempty"` // Why the last attempt didn't go through
+	UpdatedAt int64
+}
+
+var (
+	ErrSettlementNotFound  = errors.New("settlement not found")
+	ErrSettlementNotFailed = errors.New("settlement hasn't failed")
+	ErrUnsettledAsset      = errors.New("asset can't be settled on chain")
+)
+
+type SettlementQueueConfig struct {
+	Interval   time.Duration // How often the workers send and check on their transfers
+	BatchSize  int           // Most settlements a worker sends per round
+	StuckAfter time.Duration // Not mined by then and a transfer is resent with more gas
+	// Percent the gas price goes up by on a resend. Nodes want at least 10 to
+	// take a replacement.
+	GasBump     int64
+	MaxAttempts int
+
+	// Off sends every fill as it comes. Otherwise fills are held back and
+	// netted once NettingWindow has passed since the first one or
+	// NettingCount of them are in, whichever comes first.
+	Netting       NettingMode
+	NettingWindow time.Duration
+	NettingCount  int
+}
+
+var ErrSettlementConfig = errors.New("invalid settlement config")
+
+// Fails for an unknown netting mode, or netting that would hold fills back
+// forever with neither a window nor a count to close on
+func (cfg SettlementQueueConfig) Validate() error {
+	switch cfg.Netting {
+	case NettingOff:
+		return nil
+	case NettingBilateral, NettingMultilateral:
+	default:
+		return fmt.Errorf("%w: unknown netting mode %q", ErrSettlementConfig, cfg.Netting)
+	}
+
+	if cfg.NettingWindow < 0 || cfg.NettingCount < 0 {
+		return fmt.Errorf("%w: negative netting window or count", ErrSettlementConfig)
+	}
+
+	if cfg.NettingWindow == 0 && cfg.NettingCount == 0 {
+		return fmt.Errorf("%w: %s netting needs a window or a count", ErrSettlementConfig, cfg.Netting)
+	}
+
+	return nil
+}
+
+var DefaultSettlementQueueConfig = SettlementQueueConfig{
+	Interval:    time.Second,
+	BatchSize:   50,
+	StuckAfter:  30 * time.Second,
+	GasBump:     20,
+	MaxAttempts: 5,
+}
+
+// Fills waiting to be paid out on chain. Each sending account has a worker of
+// its own that keeps track of the account's nonces, so transfers from the
+// same account never race each other for one. Every change of a settlement
+// is written to the journal, if there is one, so the queue picks up where it
+// left off after a restart. Without a journal unsettled fills are lost on a
+// restart. The journal is synced after every record and only ever grows.
+type SettlementQueue struct {
+	mu          sync.Mutex
+	cfg         SettlementQueueConfig
+	settler     Settler
+	clock       Clock
+	users       func(id int64) (*User, bool)
+	journal     io.Writer                   // Nil keeps the queue in memory only
+	settlements map[int64]*Settlement       // By trade ID
+	workers     map[int64]*settlementWorker // By sending user ID
+	stop        <-chan struct{}             // Set once the workers are running
+
+	// Fills waiting to be netted and when the first of them came in
+	window      []*Settlement
+	windowStart time.Time
+	nettings    map[int64]*netting
+	lastNetting int64
+}
+
+func NewSettlementQueue(settler Settler, clock Clock, users func(id int64) (*User, bool), cfg SettlementQueueConfig) *SettlementQueue {
+	return &SettlementQueue{
+		cfg:         cfg,
+		settler:     settler,
+		clock:       clock,
+		users:       users,
+		settlements: make(map[int64]*Settlement),
+		workers:     make(map[int64]*settlementWorker),
+		nettings:    make(map[int64]*netting),
+	}
+}
+
+// Swaps the config, e.g. for one read from the environment. Call it before
+// the queue is used.
+func (q *SettlementQueue) Configure(cfg SettlementQueueConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cfg = cfg
+
+	return nil
+}
+
+// Restores the queue from the journal at path and keeps journaling to it
+func (q *SettlementQueue) Open(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if err := q.Restore(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	q.mu.Lock()
+	q.journal = f
+	q.mu.Unlock()
+
+	return nil
+}
+
+// Replays a journal, the last record of a settlement wins. Settlements that
+// hadn't confirmed or failed go back to their workers - the submitted ones
+// are followed up by their transaction, the others are sent again. Netted
+// fills are left to their netting's transfers.
+func (q *SettlementQueue) Restore(r io.Reader) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dec := json.NewDecoder(r)
+	for {
+		s := &Settlement{}
+		if err := dec.Decode(s); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading settlement journal: %w", err)
+		}
+
+		if s.TradeID == 0 {
+			q.restoreNetTransfer(s)
+			continue
+		}
+
+		q.settlements[s.TradeID] = s
+	}
+
+	// Netted fills go through their netting's transfers, the fills of an
+	// open window go back in it
+	open := []*Settlement{}
+	for _, n := range q.nettings {
+		n.fills = nil
+		open = append(open, n.transfers...)
+	}
+	fills := []*Settlement{}
+	for _, s := range q.settlements {
+		fills = append(fills, s)
+	}
+	sort.Slice(fills, func(i, j int) bool { return fills[i].TradeID < fills[j].TradeID })
+
+	for _, s := range fills {
+		switch {
+		case s.NettingID != 0:
+			n := q.nettingFor(s.NettingID, s.Asset)
+			n.fills = append(n.fills, s)
+		case s.Status == SettlementPending && q.cfg.Netting != NettingOff:
+			if len(q.window) == 0 {
+				q.windowStart = q.clock.Now()
+			}
+			q.window = append(q.window, s)
+		case s.Status == SettlementPending || s.Status == SettlementSubmitted:
+			open = append(open, s)
+		}
+	}
+
+	open = slices.DeleteFunc(open, func(s *Settlement) bool {
+		return s.Status != SettlementPending && s.Status != SettlementSubmitted
+	})
+
+	sent := make(map[string]*transfer)
+	for _, s := range open {
+		w := q.worker(s.FromUserID)
+
+		if s.Status == SettlementPending {
+			w.queued = append(w.queued, s)
+			continue
+		}
+
+		t := sent[s.TxID]
+		if t == nil {
+			t = &transfer{
+				asset:    s.Asset,
+				toUserID: s.ToUserID,
+				amount:   new(big.Int),
+				nonce:    s.Nonce,
+				gasPrice: s.GasPrice,
+				txID:     s.TxID,
+				txIDs:    s.TxIDs,
+				sentAt:   q.clock.Now(),
+				attempts: s.Attempts,
+			}
+			// Journaled before every send was kept
+			if len(t.txIDs) == 0 {
+				t.txIDs = []string{s.TxID}
+			}
+			sent[s.TxID] = t
+			w.inflight = append(w.inflight, t)
+		}
+
+		t.amount.Add(t.amount, s.Amount)
+		t.settlements = append(t.settlements, s)
+	}
+
+	return nil
+}
+
+// Highest trade ID the queue has a settlement for
+func (q *SettlementQueue) LastTradeID() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var last int64
+	for id := range q.settlements {
+		last = max(last, id)
+	}
+
+	return last
+}
+
+// Runs a worker for every sending account, now and as they turn up, until
+// stop is closed
+func (q *SettlementQueue) Start(stop <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stop = stop
+	for _, w := range q.workers {
+		go w.run(stop)
+	}
+
+	if q.cfg.Netting != NettingOff {
+		go q.runNetting(stop)
+	}
+}
+
+// Runs one round of every worker, after netting the window if it's due, for
+// driving the queue by hand
+func (q *SettlementQueue) Process(ctx context.Context) {
+	q.mu.Lock()
+	q.closeWindow()
+	workers := make([]*settlementWorker, 0, len(q.workers))
+	for _, w := range q.workers {
+		workers = append(workers, w)
+	}
+	q.mu.Unlock()
+
+	for _, w := range workers {
+		w.round(ctx)
+	}
+}
+
+func (q *SettlementQueue) Enqueue(settlements ...*Settlement) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, s := range settlements {
+		s.Status = SettlementPending
+		s.UpdatedAt = q.clock.Now().UnixNano()
+
+		switch {
+		// A self-trade (with prevention off) moves nothing, it's settled as
+		// it stands
+		case s.FromUserID == s.ToUserID:
+			s.Status = SettlementConfirmed
+		// Nothing to pay it with, e.g. the base asset of a market the chain
+		// doesn't have
+		case !q.settler.Moves(s.Asset):
+			s.Status = SettlementFailed
+			s.Error = fmt.Sprintf("%v: %s", ErrUnsettledAsset, s.Asset)
+		}
+
+		q.settlements[s.TradeID] = s
+		q.record(s)
+
+		if s.Status != SettlementPending {
+			continue
+		}
+
+		if q.cfg.Netting != NettingOff {
+			if len(q.window) == 0 {
+				q.windowStart = q.clock.Now()
+			}
+			q.window = append(q.window, s)
+			continue
+		}
+
+		w := q.worker(s.FromUserID)
+		w.queued = append(w.queued, s)
+	}
+
+	q.closeWindow()
+}
+
+// Settlement of the trade, as it stands
+func (q *SettlementQueue) Settlement(tradeID int64) (Settlement, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s, ok := q.settlements[tradeID]
+	if !ok {
+		return Settlement{}, false
+	}
+
+	return *s, true
+}
+
+// Settlements the user pays or is paid by, oldest trade first
+func (q *SettlementQueue) ForUser(userID int64) []Settlement {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	resp := []Settlement{}
+	for _, s := range q.settlements {
+		if s.FromUserID == userID || s.ToUserID == userID {
+			resp = append(resp, *s)
+		}
+	}
+
+	sort.Slice(resp, func(i, j int) bool { return resp[i].TradeID < resp[j].TradeID })
+
+	return resp
+}
+
+// Sends the failed settlement of a trade again, or the failed transfers of
+// its netting if it was netted. Transfers that went out are looked up first so
+// nothing is paid twice - one that was mined after all is confirmed, one that
+// may still be is followed up under its nonce with a fresh set of attempts,
+// and only ones that failed on every send go out again under a new nonce.
+func (q *SettlementQueue) Retry(ctx context.Context, tradeID int64) error {
+	q.mu.Lock()
+
+	s, ok := q.settlements[tradeID]
+	if !ok {
+		q.mu.Unlock()
+		return fmt.Errorf("%w: trade %d", ErrSettlementNotFound, tradeID)
+	}
+
+	if !q.settler.Moves(s.Asset) {
+		q.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnsettledAsset, s.Asset)
+	}
+
+	failed := []*Settlement{}
+	if n := q.nettings[s.NettingID]; n != nil {
+		for _, t := range n.transfers {
+			if t.Status == SettlementFailed {
+				failed = append(failed, t)
+			}
+		}
+	} else if s.Status == SettlementFailed {
+		failed = append(failed, s)
+	}
+
+	if len(failed) == 0 {
+		q.mu.Unlock()
+		return fmt.Errorf("%w: trade %d is %s", ErrSettlementNotFailed, tradeID, s.Status)
+	}
+
+	// Off FAILED straight away, so they're only retried once
+	for _, f := range failed {
+		f.Status = SettlementPending
+	}
+	q.mu.Unlock()
+
+	for _, f := range failed {
+		t := &transfer{
+			asset:       f.Asset,
+			toUserID:    f.ToUserID,
+			amount:      new(big.Int).Set(f.Amount),
+			settlements: []*Settlement{f},
+			nonce:       f.Nonce,
+			gasPrice:    f.GasPrice,
+			txID:        f.TxID,
+			txIDs:       slices.Clone(f.TxIDs),
+			sentAt:      q.clock.Now(),
+		}
+
+		status := SettlementFailed
+		if len(t.txIDs) > 0 {
+			var err error
+			if status, err = q.status(ctx, t); err != nil {
+				status = SettlementSubmitted
+			}
+		}
+
+		q.mu.Lock()
+		w := q.worker(f.FromUserID)
+		q.mu.Unlock()
+
+		switch status {
+		case SettlementConfirmed:
+			q.update(t, SettlementConfirmed, "")
+		case SettlementSubmitted:
+			w.mu.Lock()
+			w.inflight = append(w.inflight, t)
+			w.mu.Unlock()
+
+			q.update(t, SettlementSubmitted, "")
+		default:
+			q.update(t, SettlementPending, "")
+
+			q.mu.Lock()
+			w.queued = append(w.queued, f)
+			q.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// Called with mu held
+func (q *SettlementQueue) worker(userID int64) *settlementWorker {
+	w, ok := q.workers[userID]
+	if !ok {
+		w = &settlementWorker{q: q, userID: userID}
+		q.workers[userID] = w
+
+		if q.stop != nil {
+			go w.run(q.stop)
+		}
+	}
+
+	return w
+}
+
+// Called with mu held
+func (q *SettlementQueue) record(s *Settlement) {
+	if q.journal == nil {
+		return
+	}
+
+	err := json.NewEncoder(q.journal).Encode(s)
+	// A record only counts once it's on disk, a crash mustn't lose a send
+	if f, ok := q.journal.(interface{ Sync() error }); ok && err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		str := fmt.Sprintf("SERVER: Journaling settlement of trade %d failed: %v", s.TradeID, err)
+		fmt.Println(utils.PrintColor("red", str))
+	}
+}
+
+// Moves every settlement of the transfer to status
+func (q *SettlementQueue) update(t *transfer, status SettlementStatus, errMsg string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now().UnixNano()
+	for _, s := range t.settlements {
+		s.Status = status
+		s.TxID = t.txID
+		s.TxIDs = slices.Clone(t.txIDs)
+		s.Nonce = t.nonce
+		s.GasPrice = t.gasPrice
+		s.Attempts = t.attempts
+		s.Error = errMsg
+		s.UpdatedAt = now
+
+		q.record(s)
+
+		// The fills of a netting follow its transfers
+		if s.TradeID == 0 {
+			q.updateFills(q.nettings[s.NettingID])
+		}
+	}
+}
+
+// One transfer on chain, paying for one or more settlements of an asset to
+// the same user. Netted fills are paid for by the netting's transfers
+// instead.
+type transfer struct {
+	asset       Asset
+	toUserID    int64
+	amount      *big.Int
+	settlements []*Settlement
+
+	nonce    uint64
+	gasPrice *big.Int
+	txID     string   // Of the latest send, or the one that was mined
+	txIDs    []string // Every send under the nonce - any one of them can be mined
+	sentAt   time.Time
+	attempts int
+}
+
+// Pays out the settlements of one sending account
+type settlementWorker struct {
+	mu     sync.Mutex // Held for a round
+	q      *SettlementQueue
+	userID int64
+
+	queued   []*Settlement // Guarded by q.mu
+	retries  []*transfer   // Didn't go out, sent again next round
+	inflight []*transfer   // Sent, waiting to be mined
+
+	// Next nonce of the account, read from the chain again whenever a send
+	// fails in case it went out of step
+	nonce  uint64
+	synced bool
+}
+
+func (w *settlementWorker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.q.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.round(context.Background())
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (w *settlementWorker) round(ctx context.Context) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	retries := w.retries
+	w.retries = nil
+	for _, t := range retries {
+		w.send(ctx, t)
+	}
+
+	for _, t := range w.batch() {
+		w.send(ctx, t)
+	}
+
+	w.check(ctx)
+}
+
+// Takes the next settlements off the queue, the ones of the same asset to the
+// same user going out in one transfer
+func (w *settlementWorker) batch() []*transfer {
+	q := w.q
+
+	q.mu.Lock()
+	n := min(len(w.queued), q.cfg.BatchSize)
+	batch := w.queued[:n]
+	w.queued = w.queued[n:]
+	q.mu.Unlock()
+
+	type recipient struct {
+		asset  Asset
+		userID int64
+	}
+
+	transfers := []*transfer{}
+	byRecipient := make(map[recipient]*transfer)
+	for _, s := range batch {
+		key := recipient{asset: s.Asset, userID: s.ToUserID}
+
+		t, ok := byRecipient[key]
+		if !ok {
+			t = &transfer{asset: s.Asset, toUserID: s.ToUserID, amount: new(big.Int)}
+			byRecipient[key] = t
+			transfers = append(transfers, t)
+		}
+
+		t.amount.Add(t.amount, s.Amount)
+		t.settlements = append(t.settlements, s)
+	}
+
+	return transfers
+}
+
+// Sends a transfer out under the account's next nonce
+func (w *settlementWorker) send(ctx context.Context, t *transfer) {
+	q := w.q
+
+	from, ok := q.users(w.userID)
+	if !ok {
+		q.update(t, SettlementFailed, fmt.Sprintf("user not found: %d", w.userID))
+		return
+	}
+
+	to, ok := q.users(t.toUserID)
+	if !ok {
+		q.update(t, SettlementFailed, fmt.Sprintf("user not found: %d", t.toUserID))
+		return
+	}
+
+	if !w.synced {
+		nonce, err := q.settler.Nonce(ctx, from.Address)
+		if err != nil {
+			w.retry(t, err)
+			return
+		}
+
+		w.nonce, w.synced = nonce, true
+	}
+
+	gasPrice, err := q.settler.GasPrice(ctx)
+	if err != nil {
+		w.retry(t, err)
+		return
+	}
+
+	// A new nonce, nothing sent under it yet
+	t.nonce, t.gasPrice, t.txIDs = w.nonce, gasPrice, nil
+	if err := w.submit(ctx, t, from, to); err != nil {
+		w.synced = false
+		w.retry(t, err)
+		return
+	}
+
+	w.nonce++
+	w.inflight = append(w.inflight, t)
+}
+
+func (w *settlementWorker) submit(ctx context.Context, t *transfer, from, to *User) error {
+	q := w.q
+
+	t.attempts++
+	txID, err := q.settler.Transfer(ctx, &Transfer{
+		Asset:    t.asset,
+		From:     from,
+		To:       to,
+		Amount:   t.amount,
+		Nonce:    t.nonce,
+		GasPrice: t.gasPrice,
+	})
+	if err != nil {
+		return err
+	}
+
+	t.txID, t.sentAt = txID, q.clock.Now()
+	t.txIDs = append(t.txIDs, txID)
+	q.update(t, SettlementSubmitted, "")
+
+	return nil
+}
+
+// Puts a transfer that didn't go out back for the next round, unless it's
+// out of attempts
+func (w *settlementWorker) retry(t *transfer, err error) {
+	str := fmt.Sprintf("SERVER: Settling %d trade(s) from user %d failed: %v", len(t.settlements), w.userID, err)
+	fmt.Println(utils.PrintColor("red", str))
+
+	if t.attempts >= w.q.cfg.MaxAttempts {
+		w.q.update(t, SettlementFailed, err.Error())
+		return
+	}
+
+	w.q.update(t, SettlementPending, err.Error())
+	w.retries = append(w.retries, t)
+}
+
+// Follows up on the transfers in flight, resending the ones that are taking
+// too long with more gas
+func (w *settlementWorker) check(ctx context.Context) {
+	q := w.q
+
+	inflight := []*transfer{}
+	for _, t := range w.inflight {
+		status, err := q.status(ctx, t)
+		if err != nil {
+			inflight = append(inflight, t)
+			continue
+		}
+
+		switch status {
+		case SettlementConfirmed:
+			q.update(t, SettlementConfirmed, "")
+		case SettlementFailed:
+			q.update(t, SettlementFailed, "transfer failed on chain")
+		default:
+			if q.clock.Now().Sub(t.sentAt) < q.cfg.StuckAfter {
+				inflight = append(inflight, t)
+				continue
+			}
+
+			if t.attempts >= q.cfg.MaxAttempts {
+				// It may still be mined, the nonce is read from the chain
+				// again so nothing queues up behind it
+				w.synced = false
+				q.update(t, SettlementFailed, fmt.Sprintf("not mined after %d attempts", t.attempts))
+				continue
+			}
+
+			w.bump(ctx, t)
+			inflight = append(inflight, t)
+		}
+	}
+
+	w.inflight = inflight
+}
+
+// Where a transfer is at across every send of it. Only one of them can be
+// mined under the nonce, so it's confirmed if any of them is - with its txID
+// set to that one - and failed only once all of them have.
+func (q *SettlementQueue) status(ctx context.Context, t *transfer) (SettlementStatus, error) {
+	status := SettlementFailed
+
+	var lastErr error
+	for _, txID := range t.txIDs {
+		s, err := q.settler.Status(ctx, txID)
+		switch {
+		case err != nil:
+			lastErr = err
+		case s == SettlementConfirmed:
+			t.txID = txID
+			return SettlementConfirmed, nil
+		case s == SettlementSubmitted:
+			status = SettlementSubmitted
+		}
+	}
+
+	// Can't tell whether the one that didn't answer failed too
+	if status == SettlementFailed && lastErr != nil {
+		return "", lastErr
+	}
+
+	return status, nil
+}
+
+// Replaces a transfer that's stuck with the same one at a higher gas price
+func (w *settlementWorker) bump(ctx context.Context, t *transfer) {
+	q := w.q
+
+	from, _ := q.users(w.userID)
+	to, _ := q.users(t.toUserID)
+	if from == nil || to == nil {
+		return
+	}
+
+	prev := t.gasPrice
+	gasPrice := new(big.Int).Mul(prev, big.NewInt(100+q.cfg.GasBump))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	if gasPrice.Cmp(prev) <= 0 {
+		gasPrice.Add(prev, big.NewInt(1))
+	}
+
+	t.gasPrice = gasPrice
+	if err := w.submit(ctx, t, from, to); err != nil {
+		// The one out there still stands, the next round tries again
+		t.gasPrice = prev
+		q.update(t, SettlementSubmitted, err.Error())
+	}
+}
+
+// Sends a failed settlement again
+func (ex *Exchange) handleRetrySettlement(c echo.Context) error {
+	tradeID, err := strconv.ParseInt(c.Param("tradeID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid trade id"})
+	}
+
+	err = ex.settlements.Retry(c.Request().Context(), tradeID)
+	switch {
+	case errors.Is(err, ErrSettlementNotFound):
+		return c.JSON(http.StatusNotFound, APIError{Error: err.Error()})
+	case errors.Is(err, ErrSettlementNotFailed), errors.Is(err, ErrUnsettledAsset):
+		return c.JSON(http.StatusConflict, APIError{Error: err.Error()})
+	case err != nil:
+		return err
+	}
+
+	s, _ := ex.settlements.Settlement(tradeID)
+
+	return c.JSON(http.StatusOK, s)
+}
+
+// Where each of the user's trades is at on chain
+func (ex *Exchange) handleGetSettlements(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "invalid user id"})
+	}
+
+	return c.JSON(http.StatusOK, ex.settlements.ForUser(userID))
+}
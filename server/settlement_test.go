@@ -0,0 +1,490 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestUser(t *testing.T, id int64) *User {
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &User{
+		ID:         id,
+		PrivateKey: pk,
+		Address:    crypto.PubkeyToAddress(pk.PublicKey),
+	}
+}
+
+func TestSimulatedChain(t *testing.T) {
+	ctx := context.Background()
+	chain := NewSimulatedChain()
+
+	alice, bob := newTestUser(t, 1), newTestUser(t, 2)
+	chain.Fund(alice.Address, big.NewInt(100))
+
+	transfer := func(amount, nonce, gasPrice int64) (string, error) {
+		return chain.Transfer(ctx, &Transfer{Asset: NativeAsset, From: alice, To: bob, Amount: big.NewInt(amount), Nonce: uint64(nonce), GasPrice: big.NewInt(gasPrice)})
+	}
+
+	if _, err := transfer(101, 0, 1); err == nil {
+		t.Errorf("transferred more than the balance")
+	}
+	if _, err := transfer(10, 1, 1); err == nil {
+		t.Errorf("skipped a nonce")
+	}
+
+	txID, err := transfer(40, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := chain.Status(ctx, txID); err != nil || status != SettlementConfirmed {
+		t.Errorf("status: got %s, %v", status, err)
+	}
+
+	if _, err := chain.Transfer(ctx, &Transfer{Asset: "BTC", From: alice, To: bob, Amount: big.NewInt(1), Nonce: 1, GasPrice: big.NewInt(1)}); err == nil {
+		t.Errorf("transferred an asset the chain doesn't have")
+	}
+
+	if _, err := chain.Status(ctx, "sim-404"); !errors.Is(err, ErrUnknownTransfer) {
+		t.Errorf("unknown transfer: got %v", err)
+	}
+
+	if _, err := transfer(10, 0, 1); err == nil {
+		t.Errorf("reused a nonce")
+	}
+
+	// Underpriced, waits until it's replaced
+	chain.SetMinGasPrice(big.NewInt(5))
+	stuck, err := transfer(10, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nonce, _ := chain.Nonce(ctx, alice.Address); nonce != 2 {
+		t.Errorf("nonce: got %d, want 2", nonce)
+	}
+	if _, err := transfer(10, 1, 1); err == nil {
+		t.Errorf("replaced at the same price")
+	}
+
+	replacement, err := transfer(10, 1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for txID, want := range map[string]SettlementStatus{stuck: SettlementFailed, replacement: SettlementConfirmed} {
+		if status, _ := chain.Status(ctx, txID); status != want {
+			t.Errorf("%s: got %s, want %s", txID, status, want)
+		}
+	}
+
+	for user, want := range map[*User]int64{alice: 50, bob: 50} {
+		balance, _ := chain.Balance(ctx, user.Address)
+		if balance.Int64() != want {
+			t.Errorf("user %d: got %v, want %d", user.ID, balance, want)
+		}
+	}
+}
+
+func TestSettlementQueue(t *testing.T) {
+	ctx := context.Background()
+	chain := NewSimulatedChain()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	users := map[int64]*User{}
+	for id := int64(1); id <= 3; id++ {
+		users[id] = newTestUser(t, id)
+	}
+	lookup := func(id int64) (*User, bool) {
+		u, ok := users[id]
+		return u, ok
+	}
+
+	var journal bytes.Buffer
+	q := NewSettlementQueue(chain, clock, lookup, DefaultSettlementQueueConfig)
+	q.journal = &journal
+
+	settlement := func(tradeID, from, to, amount int64) *Settlement {
+		return &Settlement{TradeID: tradeID, Market: MarketETH, Asset: "ETH", FromUserID: from, ToUserID: to, Amount: big.NewInt(amount)}
+	}
+
+	// Nothing to pay with yet, stays queued for another attempt
+	q.Enqueue(settlement(1, 1, 2, 10), settlement(2, 1, 2, 20), settlement(3, 1, 3, 5))
+	q.Process(ctx)
+
+	if s, _ := q.Settlement(1); s.Status != SettlementPending || s.Attempts != 1 || s.Error == "" {
+		t.Errorf("unfunded: got %+v", s)
+	}
+
+	chain.Fund(users[1].Address, big.NewInt(100))
+	q.Process(ctx)
+
+	// Trades of the same asset to the same user go out together
+	one, _ := q.Settlement(1)
+	two, _ := q.Settlement(2)
+	three, _ := q.Settlement(3)
+	for _, s := range []Settlement{one, two, three} {
+		if s.Status != SettlementConfirmed {
+			t.Errorf("trade %d: got %s", s.TradeID, s.Status)
+		}
+	}
+	if one.TxID != two.TxID || one.TxID == three.TxID {
+		t.Errorf("batching: got %s, %s, %s", one.TxID, two.TxID, three.TxID)
+	}
+	if one.Nonce == three.Nonce {
+		t.Errorf("nonce reused: %d", one.Nonce)
+	}
+
+	for id, want := range map[int64]int64{1: 65, 2: 30, 3: 5} {
+		if balance, _ := chain.Balance(ctx, users[id].Address); balance.Int64() != want {
+			t.Errorf("user %d: got %v, want %d", id, balance, want)
+		}
+	}
+
+	// Never summed into a transfer of another asset
+	btc := settlement(6, 1, 2, 10)
+	btc.Asset = "BTC"
+	q.Enqueue(btc)
+	if s, _ := q.Settlement(6); s.Status != SettlementFailed || s.Error == "" {
+		t.Errorf("unsettled asset: got %+v", s)
+	}
+
+	// A self-trade has nothing to send
+	q.Enqueue(settlement(7, 2, 2, 10))
+	q.Process(ctx)
+	if s, _ := q.Settlement(7); s.Status != SettlementConfirmed || s.TxID != "" || s.Attempts != 0 {
+		t.Errorf("self-trade: got %+v", s)
+	}
+
+	// Underpriced until the gas bumps get it past the minimum
+	chain.SetMinGasPrice(big.NewInt(2))
+	q.Enqueue(settlement(4, 1, 2, 10))
+	q.Process(ctx)
+
+	stuck, _ := q.Settlement(4)
+	if stuck.Status != SettlementSubmitted {
+		t.Fatalf("stuck: got %+v", stuck)
+	}
+
+	for i := 0; i < 3; i++ {
+		clock.now = clock.now.Add(DefaultSettlementQueueConfig.StuckAfter)
+		q.Process(ctx)
+	}
+
+	bumped, _ := q.Settlement(4)
+	if bumped.Status != SettlementConfirmed || bumped.Nonce != stuck.Nonce || bumped.GasPrice.Cmp(big.NewInt(2)) < 0 {
+		t.Errorf("bumped: got %+v", bumped)
+	}
+
+	if got := q.ForUser(3); len(got) != 1 || got[0].TradeID != 3 {
+		t.Errorf("user 3: got %+v", got)
+	}
+
+	// Picks up where it left off from the journal
+	chain.SetMinGasPrice(nil)
+	q.Enqueue(settlement(5, 2, 3, 10))
+
+	restored := NewSettlementQueue(chain, clock, lookup, DefaultSettlementQueueConfig)
+	if err := restored.Restore(&journal); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, _ := restored.Settlement(4); s.Status != SettlementConfirmed {
+		t.Errorf("restored trade 4: got %s", s.Status)
+	}
+
+	chain.Fund(users[2].Address, big.NewInt(10))
+	restored.Process(ctx)
+
+	if s, _ := restored.Settlement(5); s.Status != SettlementConfirmed {
+		t.Errorf("restored trade 5: got %+v", s)
+	}
+}
+
+func TestNetting(t *testing.T) {
+	ctx := context.Background()
+
+	users := map[int64]*User{}
+	for id := int64(1); id <= 3; id++ {
+		users[id] = newTestUser(t, id)
+	}
+	lookup := func(id int64) (*User, bool) {
+		u, ok := users[id]
+		return u, ok
+	}
+
+	// 2 passes on what it's paid, so netting all round leaves 1 paying 3
+	fills := func(from int64) []*Settlement {
+		return []*Settlement{
+			{TradeID: from + 1, Market: MarketETH, Asset: "ETH", FromUserID: 1, ToUserID: 2, Amount: big.NewInt(30)},
+			{TradeID: from + 2, Market: MarketETH, Asset: "ETH", FromUserID: 2, ToUserID: 1, Amount: big.NewInt(10)},
+			{TradeID: from + 3, Market: MarketETH, Asset: "ETH", FromUserID: 2, ToUserID: 3, Amount: big.NewInt(20)},
+			{TradeID: from + 4, Market: MarketETH, Asset: "ETH", FromUserID: 3, ToUserID: 1, Amount: big.NewInt(5)},
+		}
+	}
+
+	// What each user gains, all in
+	net := func(settlements []Settlement) map[int64]int64 {
+		positions := make(map[int64]int64)
+		for _, s := range settlements {
+			positions[s.FromUserID] -= s.Amount.Int64()
+			positions[s.ToUserID] += s.Amount.Int64()
+		}
+		for u, p := range positions {
+			if p == 0 {
+				delete(positions, u)
+			}
+		}
+		return positions
+	}
+
+	for _, tc := range []struct {
+		mode      NettingMode
+		transfers int
+	}{
+		{NettingBilateral, 3},
+		{NettingMultilateral, 1},
+	} {
+		chain := NewSimulatedChain()
+		for _, u := range users {
+			chain.Fund(u.Address, big.NewInt(100))
+		}
+
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		cfg := DefaultSettlementQueueConfig
+		cfg.Netting, cfg.NettingWindow, cfg.NettingCount = tc.mode, time.Minute, 4
+
+		q := NewSettlementQueue(chain, clock, lookup, cfg)
+
+		// Closes on the count
+		q.Enqueue(fills(0)...)
+		q.Process(ctx)
+
+		n, ok := q.Netting(1)
+		if !ok {
+			t.Fatalf("%s: not netted", tc.mode)
+		}
+		if n.Status != SettlementConfirmed || len(n.Transfers) != tc.transfers {
+			t.Errorf("%s: got %s with %d transfers, want %d", tc.mode, n.Status, len(n.Transfers), tc.transfers)
+		}
+
+		// The transfers move what the fills add up to
+		if got, want := net(n.Transfers), net(n.Fills); len(n.Fills) != 4 || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: transfers net %v, fills %v", tc.mode, got, want)
+		}
+
+		for id, want := range map[int64]int64{1: 85, 2: 100, 3: 115} {
+			if balance, _ := chain.Balance(ctx, users[id].Address); balance.Int64() != want {
+				t.Errorf("%s: user %d: got %v, want %d", tc.mode, id, balance, want)
+			}
+		}
+
+		for _, s := range q.ForUser(1) {
+			if s.NettingID != 1 || s.Status != SettlementConfirmed {
+				t.Errorf("%s: fill %d: got %+v", tc.mode, s.TradeID, s)
+			}
+		}
+
+		// Closes on the window
+		q.Enqueue(fills(4)[:2]...)
+		q.Process(ctx)
+		if _, ok := q.Netting(2); ok {
+			t.Errorf("%s: netted before the window closed", tc.mode)
+		}
+
+		clock.now = clock.now.Add(time.Minute)
+		q.Process(ctx)
+		if n, ok := q.Netting(2); !ok || len(n.Transfers) != 1 || n.Transfers[0].Amount.Int64() != 20 {
+			t.Errorf("%s: window: got %+v", tc.mode, n)
+		}
+	}
+}
+
+// Trades after a restart are numbered after the ones in the journal, so they
+// don't take over their settlements
+func TestSettlementJournalTradeIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settlements.jsonl")
+
+	trade := func(ex *Exchange, e *echo.Echo) {
+		t.Helper()
+
+		for _, req := range []PlaceOrderRequest{
+			{UserID: 1, Type: LimitOrder, Size: "1", Price: "1000.00", Market: MarketETH},
+			{UserID: 2, Type: LimitOrder, Bid: true, Size: "1", Price: "1000.00", Market: MarketETH},
+		} {
+			if rec := request(e, http.MethodPost, "/order", req); rec.Code != http.StatusOK {
+				t.Fatalf("place: %d %s", rec.Code, rec.Body)
+			}
+		}
+	}
+
+	before, e := newTestExchange(t, 1, 2)
+	if err := before.openSettlementJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	trade(before, e)
+
+	after, e := newTestExchange(t, 1, 2)
+	if err := after.openSettlementJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	trade(after, e)
+
+	got := after.settlements.ForUser(2)
+	if len(got) != 2 || got[0].TradeID != 1 || got[1].TradeID != 2 {
+		t.Errorf("settlements: got %+v", got)
+	}
+}
+
+// Reports the first send it's told about as the one that was mined and every
+// other as failed, as if the original beat its replacement into a block
+type racedChain struct {
+	*SimulatedChain
+	mined string
+}
+
+func (c *racedChain) Status(ctx context.Context, txID string) (SettlementStatus, error) {
+	if c.mined == "" {
+		return c.SimulatedChain.Status(ctx, txID)
+	}
+
+	if txID == c.mined {
+		return SettlementConfirmed, nil
+	}
+
+	return SettlementFailed, nil
+}
+
+func TestSettlementRetry(t *testing.T) {
+	ctx := context.Background()
+	chain := &racedChain{SimulatedChain: NewSimulatedChain()}
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	users := map[int64]*User{1: newTestUser(t, 1), 2: newTestUser(t, 2)}
+	lookup := func(id int64) (*User, bool) {
+		u, ok := users[id]
+		return u, ok
+	}
+
+	cfg := DefaultSettlementQueueConfig
+	cfg.MaxAttempts = 2
+	q := NewSettlementQueue(chain, clock, lookup, cfg)
+
+	settlement := func(tradeID int64) *Settlement {
+		return &Settlement{TradeID: tradeID, Market: MarketETH, Asset: "ETH", FromUserID: 1, ToUserID: 2, Amount: big.NewInt(10)}
+	}
+
+	paid := func() int64 {
+		balance, _ := chain.Balance(ctx, users[2].Address)
+		return balance.Int64()
+	}
+
+	// Never went out - out of attempts while there was nothing to pay with
+	q.Enqueue(settlement(1))
+	q.Process(ctx)
+	q.Process(ctx)
+
+	if s, _ := q.Settlement(1); s.Status != SettlementFailed || len(s.TxIDs) != 0 {
+		t.Fatalf("unfunded: got %+v", s)
+	}
+
+	chain.Fund(users[1].Address, big.NewInt(100))
+	if err := q.Retry(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	q.Process(ctx)
+
+	if s, _ := q.Settlement(1); s.Status != SettlementConfirmed || paid() != 10 {
+		t.Errorf("retried: got %+v, %d paid", s, paid())
+	}
+
+	if err := q.Retry(ctx, 1); !errors.Is(err, ErrSettlementNotFailed) {
+		t.Errorf("retried a confirmed settlement: %v", err)
+	}
+	if err := q.Retry(ctx, 404); !errors.Is(err, ErrSettlementNotFound) {
+		t.Errorf("retried an unknown trade: %v", err)
+	}
+
+	// Given up on while still waiting to be mined. Retrying follows it up
+	// under the same nonce, so it's only ever paid once.
+	chain.SetMinGasPrice(big.NewInt(100))
+	q.Enqueue(settlement(2))
+	for i := 0; i < 3; i++ {
+		q.Process(ctx)
+		clock.now = clock.now.Add(cfg.StuckAfter)
+	}
+
+	stuck, _ := q.Settlement(2)
+	if stuck.Status != SettlementFailed || len(stuck.TxIDs) != 2 {
+		t.Fatalf("stuck: got %+v", stuck)
+	}
+
+	if err := q.Retry(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	chain.SetMinGasPrice(nil)
+	q.Process(ctx)
+
+	if s, _ := q.Settlement(2); s.Status != SettlementConfirmed || s.Nonce != stuck.Nonce || paid() != 20 {
+		t.Errorf("retried stuck: got %+v, %d paid", s, paid())
+	}
+
+	// The original is mined instead of its replacement
+	chain.SetMinGasPrice(big.NewInt(100))
+	q.Enqueue(settlement(3))
+	q.Process(ctx)
+
+	original, _ := q.Settlement(3)
+
+	clock.now = clock.now.Add(cfg.StuckAfter)
+	q.Process(ctx)
+
+	chain.mined = original.TxID
+	q.Process(ctx)
+
+	if s, _ := q.Settlement(3); s.Status != SettlementConfirmed || s.TxID != original.TxID || len(s.TxIDs) != 2 {
+		t.Errorf("raced replacement: got %+v", s)
+	}
+}
+
+func TestSettlementConfigFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		env map[string]string
+		ok  bool
+	}{
+		{map[string]string{"SETTLEMENT_NETTING": "bilateral"}, true},
+		{map[string]string{"SETTLEMENT_NETTING": "multilateral", "SETTLEMENT_NETTING_WINDOW": "0", "SETTLEMENT_NETTING_COUNT": "10"}, true},
+		{map[string]string{"SETTLEMENT_NETTING": "bilaterl"}, false},
+		{map[string]string{"SETTLEMENT_NETTING": "bilateral", "SETTLEMENT_NETTING_WINDOW": "0"}, false},
+		{map[string]string{"SETTLEMENT_NETTING": "bilateral", "SETTLEMENT_NETTING_WINDOW": "10"}, false},
+		{map[string]string{"SETTLEMENT_NETTING": "bilateral", "SETTLEMENT_NETTING_COUNT": "ten"}, false},
+		{map[string]string{"ETH_CHAIN_ID": "mainnet"}, false},
+	} {
+		for _, name := range []string{"SETTLEMENT_NETTING", "SETTLEMENT_NETTING_WINDOW", "SETTLEMENT_NETTING_COUNT", "ETH_CHAIN_ID"} {
+			t.Setenv(name, tc.env[name])
+		}
+
+		if _, err := SettlementConfigFromEnv(); (err == nil) != tc.ok {
+			t.Errorf("%v: got %v", tc.env, err)
+		}
+	}
+
+	q := NewSettlementQueue(NewSimulatedChain(), systemClock{}, nil, DefaultSettlementQueueConfig)
+	if err := q.Configure(SettlementQueueConfig{Netting: NettingBilateral}); !errors.Is(err, ErrSettlementConfig) {
+		t.Errorf("netting that never closes: got %v", err)
+	}
+}